@@ -0,0 +1,125 @@
+// Checks derived from the ports and the health check in the launch config of a service, so they do not need
+// to be repeated in icinga.custom_checks.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/go-rancher/v2"
+)
+
+const AUTO_CHECKS_LABEL = "icinga.auto_checks"
+
+const (
+	AUTO_CHECK_PORTS       = "ports"
+	AUTO_CHECK_HEALTHCHECK = "healthcheck"
+)
+
+// Parses a list of auto check modes like "ports,healthcheck". "none" disables auto checks.
+func parseAutoChecks(s string) (modes []string, err error) {
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		switch m {
+		case "", "none":
+		case AUTO_CHECK_PORTS, AUTO_CHECK_HEALTHCHECK:
+			modes = append(modes, m)
+		default:
+			return nil, fmt.Errorf("unknown auto check %q", m)
+		}
+	}
+	return
+}
+
+// Generates the auto checks for a service, as configured by its label or the global default. The checks use
+// custom check templates and are expanded like the checks from icinga.custom_checks. Their names start with
+// the name of the service, as all services of a stack share the same Icinga2 host.
+func autoChecksOf(config *RancherIcingaConfig, service client.Service) ([]CustomCheck, error) {
+	modes := config.autoChecks
+
+	if l, ok := service.LaunchConfig.Labels[AUTO_CHECKS_LABEL].(string); ok {
+		var err error
+		if modes, err = parseAutoChecks(l); err != nil {
+			return nil, fmt.Errorf("could not parse label %s: %s", AUTO_CHECKS_LABEL, err)
+		}
+	}
+
+	checks := []CustomCheck{}
+
+	for _, mode := range modes {
+		switch mode {
+		case AUTO_CHECK_PORTS:
+			for _, p := range service.LaunchConfig.Ports {
+				// only published ports are reachable from outside Rancher
+				port, err := parsePort(p)
+				if err != nil || port.Protocol != "tcp" || port.PublicPort == 0 {
+					continue
+				}
+				checks = append(checks, CustomCheck{
+					Name:    fmt.Sprintf("%s-tcp-%d", service.Name, port.PublicPort),
+					Command: "tcp",
+					Vars: map[string]interface{}{
+						"tcp_address": "{{.HostAddress}}",
+						"tcp_port":    strconv.Itoa(port.PublicPort)}})
+			}
+
+		case AUTO_CHECK_HEALTHCHECK:
+			if hc := service.LaunchConfig.HealthCheck; hc != nil && hc.Port != 0 {
+				checks = append(checks, healthCheckOf(service.Name, hc))
+			}
+		}
+	}
+
+	return checks, nil
+}
+
+// A check doing what the Rancher health check does: an HTTP request if it has a request line, otherwise
+// a TCP connect.
+func healthCheckOf(service string, hc *client.InstanceHealthCheck) CustomCheck {
+	check := CustomCheck{
+		Name:    service + "-healthcheck",
+		Command: "tcp",
+		Vars: map[string]interface{}{
+			"tcp_address": "{{.FQDN}}",
+			"tcp_port":    strconv.FormatInt(hc.Port, 10)}}
+
+	// like "GET /health HTTP/1.0" or "GET \"/health\" \"HTTP/1.0\""
+	if fields := strings.Fields(hc.RequestLine); len(fields) > 0 {
+		check.Command = "http"
+		check.Vars = map[string]interface{}{
+			"http_address": "{{.FQDN}}",
+			"http_port":    strconv.FormatInt(hc.Port, 10),
+			"http_uri":     "/"}
+		if len(fields) > 1 {
+			check.Vars["http_uri"] = strings.Trim(fields[1], `"`)
+		}
+		if method := strings.ToUpper(strings.Trim(fields[0], `"`)); method != "GET" {
+			check.Vars["http_method"] = method
+		}
+	}
+
+	if hc.Interval > 0 {
+		interval := Interval(float64(hc.Interval) / 1000)
+		check.CheckInterval = &interval
+	}
+
+	return check
+}
+
+// Adds the auto checks to the custom checks, unless there is a custom check with the same name.
+func mergeAutoChecks(checks, autoChecks []CustomCheck) []CustomCheck {
+	names := make(map[string]bool)
+	for _, check := range checks {
+		names[check.Name] = true
+	}
+
+	for _, check := range autoChecks {
+		if !names[check.Name] {
+			checks = append(checks, check)
+		}
+	}
+
+	return checks
+}
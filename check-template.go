@@ -0,0 +1,187 @@
+// Go template expansion in the name, notes URL and vars of custom checks, so checks can refer to what
+// rancher-icinga already knows about a service instead of hardcoding it.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/rancher/go-rancher/v2"
+)
+
+// The values available in custom check templates.
+type CustomCheckParameters struct {
+	RancherCheckParameters
+	RancherInstallation string
+	Labels              map[string]string
+	Scale               int64
+	Ports               []CheckPort
+	FQDN                string
+
+	// for HostAddress
+	rancher RancherGenClient
+	service client.Service
+}
+
+// A port of a service, from its launch config like "8080:80/tcp".
+type CheckPort struct {
+	PublicPort  int
+	PrivatePort int
+	Protocol    string
+}
+
+var checkTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// {{.RancherService | replace "_" "-"}}
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	// {{.Labels.port | default "80"}}
+	"default": func(def string, v interface{}) string {
+		if s := fmt.Sprintf("%v", v); v != nil && s != "" {
+			return s
+		}
+		return def
+	},
+}
+
+// Generates the template values for the custom checks of a service.
+func customCheckParameters(config *RancherIcingaConfig, service client.Service, environment, stack string) CustomCheckParameters {
+	params := CustomCheckParameters{
+		RancherCheckParameters: RancherCheckParameters{
+			Hostname:           execTemplate(config.stackNameTemplate, "", environment, stack, service.Name),
+			RancherUrl:         os.Getenv("RANCHER_URL"),
+			RancherAccessKey:   os.Getenv("RANCHER_ACCESS_KEY"),
+			RancherSecretKey:   os.Getenv("RANCHER_SECRET_KEY"),
+			RancherEnvironment: environment,
+			RancherStack:       stack,
+			RancherService:     service.Name,
+		},
+		RancherInstallation: config.rancherInstallation,
+		Labels:              make(map[string]string),
+		Scale:               service.Scale,
+		Ports:               []CheckPort{},
+		FQDN:                service.Fqdn,
+		rancher:             config.rancher,
+		service:             service,
+	}
+
+	if params.FQDN == "" {
+		params.FQDN = service.Name + "." + stack + ".rancher.internal"
+	}
+
+	if service.LaunchConfig != nil {
+		for k, v := range service.LaunchConfig.Labels {
+			params.Labels[k] = fmt.Sprintf("%v", v)
+		}
+		for _, p := range service.LaunchConfig.Ports {
+			if port, err := parsePort(p); err == nil {
+				params.Ports = append(params.Ports, port)
+			}
+		}
+	}
+
+	return params
+}
+
+// The agent IP address of the first host running the service by hostname, or "" if the service has no containers.
+// The published ports of a service are reachable there, the FQDN is only known inside Rancher. The hosts are only
+// listed if a check uses the address.
+func (params CustomCheckParameters) HostAddress() (string, error) {
+	hosts, err := serviceHostsOf(params.rancher, params.service)
+	if err != nil {
+		return "", fmt.Errorf("could not get the hosts of service %s: %s", params.service.Name, err)
+	}
+	if len(hosts) == 0 {
+		return "", nil
+	}
+	return hosts[0].AgentIpAddress, nil
+}
+
+// Parses a port as written in a launch config: "80", "8080:80", "0.0.0.0:8080:80/udp".
+func parsePort(p string) (port CheckPort, err error) {
+	port.Protocol = "tcp"
+	if i := strings.Index(p, "/"); i >= 0 {
+		port.Protocol = p[i+1:]
+		p = p[:i]
+	}
+
+	parts := strings.Split(p, ":")
+	if port.PrivatePort, err = strconv.Atoi(parts[len(parts)-1]); err != nil {
+		return
+	}
+	if len(parts) > 1 {
+		port.PublicPort, err = strconv.Atoi(parts[len(parts)-2])
+	}
+	return
+}
+
+// Expands the templates in a custom check. The vars of the returned check are copied.
+func (check CustomCheck) expand(params CustomCheckParameters) (CustomCheck, error) {
+	var err error
+	expanded := check
+
+	if expanded.Name, err = expandCheckTemplate("name", check.Name, params); err != nil {
+		return check, err
+	}
+	if expanded.NotesURL, err = expandCheckTemplate("notes_url", check.NotesURL, params); err != nil {
+		return check, err
+	}
+
+	expanded.Vars = make(map[string]interface{}, len(check.Vars))
+	for k, v := range check.Vars {
+		s, ok := v.(string)
+		if !ok {
+			expanded.Vars[k] = v
+			continue
+		}
+		if expanded.Vars[k], err = expandCheckTemplate("vars."+k, s, params); err != nil {
+			return check, err
+		}
+	}
+
+	return expanded, nil
+}
+
+func expandCheckTemplate(name, text string, params CustomCheckParameters) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	t, err := template.New(name).Funcs(checkTemplateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, params); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// Expands the templates in the custom checks of a service. Checks that cannot be expanded are left out
+// and reported as problems.
+func expandCustomChecks(config *RancherIcingaConfig, checks []CustomCheck, service client.Service,
+	environment, stack string) (expanded []CustomCheck, problems []string) {
+
+	params := customCheckParameters(config, service, environment, stack)
+
+	for _, check := range checks {
+		e, err := check.expand(params)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("custom check %s: %s", check.Name, err))
+			continue
+		}
+		expanded = append(expanded, e)
+	}
+
+	return
+}
@@ -0,0 +1,353 @@
+// An Icinga2 backend that keeps the objects in memory and writes them as Icinga2 configuration instead of creating
+// them through the API, so they are visible to configuration management and survive changes to the cluster. The
+// sync logic is the same for both backends. Actions and objects rancher-icinga does not manage, like downtimes,
+// users and endpoints, still use the API if it is configured.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// The object types written to the configuration.
+var configObjectTypes = []string{"HostGroup", "ServiceGroup", "Host", "Service", "Dependency"}
+
+type IcingaConfigClient struct {
+	objects map[string]map[string]IcingaAttrs
+
+	output       configOutput
+	api          IcingaGenClient // for everything else, can be nil
+	installation string
+	globalZone   string
+
+	// the files written last, by path
+	written map[string]string
+}
+
+// Creates the backend and loads the objects written last.
+func NewIcingaConfigClient(output configOutput, api IcingaGenClient, installation, globalZone string) (*IcingaConfigClient, error) {
+	c := &IcingaConfigClient{
+		objects:      make(map[string]map[string]IcingaAttrs),
+		output:       output,
+		api:          api,
+		installation: installation,
+		globalZone:   globalZone}
+
+	state, err := output.readFile(c.stateFile())
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", c.stateFile(), err)
+	}
+	if state != nil {
+		if err := json.Unmarshal(state, &c.objects); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", c.stateFile(), err)
+		}
+		c.written = c.render()
+	}
+
+	return c, nil
+}
+
+// The file with the objects, so they can be loaded again after a restart. Icinga2 only reads the .conf files.
+func (c *IcingaConfigClient) stateFile() string {
+	return "rancher-icinga-" + c.installation + ".json"
+}
+
+func isConfigObjectType(typ string) bool {
+	return containsStrings(configObjectTypes, []string{typ})
+}
+
+// Writes the configuration if it changed since it was written last.
+func (c *IcingaConfigClient) Commit() error {
+	files := c.render()
+
+	changed := len(files) != len(c.written)
+	for path, content := range files {
+		if c.written[path] != content {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	removed := []string{}
+	for path := range c.written {
+		if _, ok := files[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+
+	debugLog("Writing Icinga2 configuration", 1)
+	if err := c.output.writeFiles(files, removed); err != nil {
+		return fmt.Errorf("error writing icinga configuration: %s", err)
+	}
+	c.written = files
+
+	return nil
+}
+
+// ---------
+
+func (c *IcingaConfigClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	if !isConfigObjectType(typ) {
+		if c.api == nil {
+			return fmt.Errorf("creating %s objects needs the Icinga2 API", typ)
+		}
+		return c.api.CreateObject(typ, name, templates, attrs)
+	}
+
+	if _, ok := c.objects[typ][name]; ok {
+		return fmt.Errorf("object %s %s already exists", typ, name)
+	}
+	for _, host := range []string{stringAttr(attrs, "host_name"), stringAttr(attrs, "child_host_name")} {
+		if _, ok := c.objects["Host"][host]; host != "" && !ok {
+			return fmt.Errorf("host %s does not exist", host)
+		}
+	}
+
+	if c.objects[typ] == nil {
+		c.objects[typ] = make(map[string]IcingaAttrs)
+	}
+
+	stored := mergeAttrs(attrs, nil)
+	if len(templates) > 0 {
+		imports := []interface{}{}
+		for _, t := range templates {
+			imports = append(imports, t)
+		}
+		stored["templates"] = imports
+	}
+	c.objects[typ][name] = stored
+
+	return nil
+}
+
+func (c *IcingaConfigClient) ListObjects(typ string, attrs []string) (map[string]IcingaAttrs, error) {
+	if !isConfigObjectType(typ) {
+		if c.api == nil {
+			return map[string]IcingaAttrs{}, nil
+		}
+		return c.api.ListObjects(typ, attrs)
+	}
+
+	objects := make(map[string]IcingaAttrs, len(c.objects[typ]))
+	for name, o := range c.objects[typ] {
+		objects[name] = o.only(attrs)
+	}
+	return objects, nil
+}
+
+func (c *IcingaConfigClient) ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error) {
+	if !isConfigObjectType(typ) && c.api != nil {
+		return c.api.ListOwnedObjects(typ, installation, attrs)
+	}
+
+	objects, err := c.ListObjects(typ, append([]string{"vars"}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	return filterOwned(objects, installation, attrs), nil
+}
+
+func (c *IcingaConfigClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	if !isConfigObjectType(typ) {
+		if c.api == nil {
+			return fmt.Errorf("updating %s objects needs the Icinga2 API", typ)
+		}
+		return c.api.UpdateObject(typ, name, attrs)
+	}
+
+	o, ok := c.objects[typ][name]
+	if !ok {
+		return fmt.Errorf("object %s %s does not exist", typ, name)
+	}
+	for k, v := range attrs {
+		o[k] = v
+	}
+	return nil
+}
+
+// Like a cascading delete in Icinga2, deleting a host also deletes its services and the dependencies on it, and
+// deleting a service the dependencies on it.
+func (c *IcingaConfigClient) DeleteObject(typ, name string) error {
+	if !isConfigObjectType(typ) {
+		if c.api == nil {
+			return fmt.Errorf("deleting %s objects needs the Icinga2 API", typ)
+		}
+		return c.api.DeleteObject(typ, name)
+	}
+
+	if _, ok := c.objects[typ][name]; !ok {
+		return fmt.Errorf("object %s %s does not exist", typ, name)
+	}
+	delete(c.objects[typ], name)
+
+	switch typ {
+	case "Host":
+		for s := range c.objects["Service"] {
+			if strings.HasPrefix(s, name+"!") {
+				c.DeleteObject("Service", s)
+			}
+		}
+		for d, attrs := range c.objects["Dependency"] {
+			if attrs["child_host_name"] == name || attrs["parent_host_name"] == name {
+				delete(c.objects["Dependency"], d)
+			}
+		}
+	case "Service":
+		for d, attrs := range c.objects["Dependency"] {
+			if stringAttr(attrs, "parent_host_name")+"!"+stringAttr(attrs, "parent_service_name") == name {
+				delete(c.objects["Dependency"], d)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *IcingaConfigClient) PerformAction(action string, params IcingaAttrs) error {
+	if c.api == nil {
+		return fmt.Errorf("%s needs the Icinga2 API", action)
+	}
+	return c.api.PerformAction(action, params)
+}
+
+// ---------
+
+func (c *IcingaConfigClient) GetHost(name string) (icinga2.Host, error) {
+	attrs, ok := c.objects["Host"][name]
+	if !ok {
+		return icinga2.Host{}, fmt.Errorf("host %s does not exist", name)
+	}
+	return hostOfAttrs(name, attrs), nil
+}
+
+func (c *IcingaConfigClient) CreateHost(h icinga2.Host) error {
+	return c.CreateObject("Host", h.Name, nil, attrsForHost(h))
+}
+
+func (c *IcingaConfigClient) ListHosts() ([]icinga2.Host, error) {
+	hosts := []icinga2.Host{}
+	for name, attrs := range c.objects["Host"] {
+		hosts = append(hosts, hostOfAttrs(name, attrs))
+	}
+	return hosts, nil
+}
+
+func (c *IcingaConfigClient) DeleteHost(name string) error {
+	return c.DeleteObject("Host", name)
+}
+
+// Zones cannot be changed.
+func (c *IcingaConfigClient) UpdateHost(h icinga2.Host) error {
+	return c.UpdateObject("Host", h.Name, IcingaAttrs{
+		"address":       h.Address,
+		"check_command": h.CheckCommand,
+		"notes_url":     h.NotesURL,
+		"groups":        h.Groups,
+		"vars":          h.Vars})
+}
+
+func (c *IcingaConfigClient) GetHostGroup(name string) (icinga2.HostGroup, error) {
+	attrs, ok := c.objects["HostGroup"][name]
+	if !ok {
+		return icinga2.HostGroup{}, fmt.Errorf("hostgroup %s does not exist", name)
+	}
+	return hostGroupOfAttrs(name, attrs), nil
+}
+
+func (c *IcingaConfigClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	attrs := IcingaAttrs{"vars": hg.Vars}
+	if hg.DisplayName != "" {
+		attrs["display_name"] = hg.DisplayName
+	}
+	return c.CreateObject("HostGroup", hg.Name, nil, attrs)
+}
+
+func (c *IcingaConfigClient) ListHostGroups() ([]icinga2.HostGroup, error) {
+	hostGroups := []icinga2.HostGroup{}
+	for name, attrs := range c.objects["HostGroup"] {
+		hostGroups = append(hostGroups, hostGroupOfAttrs(name, attrs))
+	}
+	return hostGroups, nil
+}
+
+func (c *IcingaConfigClient) DeleteHostGroup(name string) error {
+	return c.DeleteObject("HostGroup", name)
+}
+
+func (c *IcingaConfigClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	return c.UpdateObject("HostGroup", hg.Name, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars})
+}
+
+func (c *IcingaConfigClient) GetService(name string) (icinga2.Service, error) {
+	attrs, ok := c.objects["Service"][name]
+	if !ok {
+		return icinga2.Service{}, fmt.Errorf("service %s does not exist", name)
+	}
+	return serviceOfAttrs(name, attrs), nil
+}
+
+func (c *IcingaConfigClient) CreateService(s icinga2.Service) error {
+	return c.CreateObject("Service", s.HostName+"!"+s.Name, nil, attrsForService(s))
+}
+
+func (c *IcingaConfigClient) ListServices() ([]icinga2.Service, error) {
+	services := []icinga2.Service{}
+	for name, attrs := range c.objects["Service"] {
+		services = append(services, serviceOfAttrs(name, attrs))
+	}
+	return services, nil
+}
+
+func (c *IcingaConfigClient) DeleteService(name string) error {
+	return c.DeleteObject("Service", name)
+}
+
+// Zones cannot be changed.
+func (c *IcingaConfigClient) UpdateService(s icinga2.Service) error {
+	return c.UpdateObject("Service", s.HostName+"!"+s.Name, IcingaAttrs{
+		"check_command": s.CheckCommand,
+		"notes_url":     s.NotesURL,
+		"vars":          s.Vars})
+}
+
+// ---------
+
+func stringAttr(attrs IcingaAttrs, name string) string {
+	s, _ := attrs[name].(string)
+	return s
+}
+
+func hostOfAttrs(name string, attrs IcingaAttrs) icinga2.Host {
+	return icinga2.Host{
+		Name:         name,
+		Address:      stringAttr(attrs, "address"),
+		CheckCommand: stringAttr(attrs, "check_command"),
+		NotesURL:     stringAttr(attrs, "notes_url"),
+		Groups:       stringList(attrs["groups"]),
+		Vars:         varsOf(attrs),
+		Zone:         stringAttr(attrs, "zone")}
+}
+
+func hostGroupOfAttrs(name string, attrs IcingaAttrs) icinga2.HostGroup {
+	return icinga2.HostGroup{
+		Name:        name,
+		DisplayName: stringAttr(attrs, "display_name"),
+		Vars:        varsOf(attrs),
+		Zone:        stringAttr(attrs, "zone")}
+}
+
+func serviceOfAttrs(name string, attrs IcingaAttrs) icinga2.Service {
+	return icinga2.Service{
+		Name:         name[strings.LastIndex(name, "!")+1:],
+		HostName:     stringAttr(attrs, "host_name"),
+		CheckCommand: stringAttr(attrs, "check_command"),
+		NotesURL:     stringAttr(attrs, "notes_url"),
+		Vars:         varsOf(attrs),
+		Zone:         stringAttr(attrs, "zone")}
+}
@@ -0,0 +1,143 @@
+// Reports problems with the Icinga2 configuration found in Rancher labels as an Icinga2 service, so they
+// are visible where the monitoring is looked at and not only in the log of rancher-icinga.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// The name of the service showing configuration problems on a host or stack.
+const CONFIG_CHECK_NAME = "rancher-icinga-config"
+
+// Problems with the configuration for one Icinga2 host.
+type configErrors struct {
+	vars     icinga2.Vars
+	messages []string
+}
+
+// Logs a configuration problem and records it for the configuration check of the Icinga2 host.
+func (config *RancherIcingaConfig) reportConfigError(hostname string, vars icinga2.Vars, message string) {
+	fmt.Printf("WARNING: %s\n", message)
+	config.recordConfigError(hostname, vars, message)
+}
+
+// Records a problem for the configuration check without logging it.
+func (config *RancherIcingaConfig) recordConfigError(hostname string, vars icinga2.Vars, message string) {
+	if config.configErrors == nil {
+		config.configErrors = make(map[string]*configErrors)
+	}
+	if config.configErrors[hostname] == nil {
+		config.configErrors[hostname] = &configErrors{vars: vars}
+	}
+	config.configErrors[hostname].messages = append(config.configErrors[hostname].messages, message)
+}
+
+// Generates the vars for the configuration check of a stack or a host.
+func varsForConfigCheck(config *RancherIcingaConfig, environment, stack, host string) (vars icinga2.Vars) {
+	vars = mergeVars(config.serviceDefaultIcingaVars, icinga2.Vars{
+		RANCHER_INSTALLATION: config.rancherInstallation,
+		RANCHER_OBJECT_TYPE:  "config-check",
+		RANCHER_ENVIRONMENT:  environment})
+
+	if stack != "" {
+		vars[RANCHER_STACK] = stack
+	}
+	if host != "" {
+		vars[RANCHER_HOST] = host
+	}
+
+	return
+}
+
+// Creates, updates and removes the configuration checks. Hosts with configuration problems get a
+// service in WARNING state listing the problems, the service is removed once the problems are fixed.
+func syncConfigChecks(config *RancherIcingaConfig) error {
+	icingaServices, err := config.icinga.ListServices()
+	if err != nil {
+		return err
+	}
+
+	hostAttrs, err := config.icinga.ListObjects("Host", []string{"zone"})
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]bool)
+
+	for _, is := range icingaServices {
+		if is.Name != CONFIG_CHECK_NAME || !config.matches(is.Vars, "config-check", "", "", "") {
+			continue
+		}
+
+		ce, ok := config.configErrors[is.HostName]
+		if !ok {
+			debugLog("Removing configuration check from "+is.HostName, 1)
+			err := config.icinga.DeleteService(is.HostName + "!" + is.Name)
+			if err != nil {
+				fmt.Printf("ERROR: could not delete service %s!%s: %s\n", is.HostName, is.Name, err)
+			} else {
+				config.registerChange("delete", is.HostName+"!"+is.Name, "service", icinga2.Vars{}, is)
+			}
+			continue
+		}
+
+		found[is.HostName] = true
+
+		vars := configCheckVars(ce)
+		if varsNeedUpdate(vars, is.Vars) || is.CheckCommand != config.configCheckCommand {
+			debugLog("Updating configuration check on "+is.HostName, 1)
+			is.Vars = vars
+			is.CheckCommand = config.configCheckCommand
+			err := config.icinga.UpdateService(is)
+			if err != nil {
+				fmt.Printf("ERROR: could not update service %s!%s: %s\n", is.HostName, is.Name, err)
+			} else {
+				config.registerChange("update", is.Name, "service", is.Vars, is)
+			}
+		}
+	}
+
+	hostnames := make([]string, 0, len(config.configErrors))
+	for hostname := range config.configErrors {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	for _, hostname := range hostnames {
+		if found[hostname] {
+			continue
+		}
+
+		vars := configCheckVars(config.configErrors[hostname])
+
+		debugLog("Creating configuration check on "+hostname, 1)
+		// in the zone of the host, if it has one
+		zone, _ := hostAttrs[hostname]["zone"].(string)
+		is := icinga2.Service{
+			Name:         CONFIG_CHECK_NAME,
+			HostName:     hostname,
+			CheckCommand: config.configCheckCommand,
+			Vars:         vars,
+			Zone:         zone}
+		err := createService(config, is, nil, nil)
+		if err != nil {
+			fmt.Printf("ERROR: could not create service %s!%s: %s\n", hostname, CONFIG_CHECK_NAME, err)
+		} else {
+			config.registerChange("create", hostname+"!"+CONFIG_CHECK_NAME, "service", vars, is)
+		}
+	}
+
+	return nil
+}
+
+// The vars of a configuration check, with the state and text for the "dummy" check command.
+func configCheckVars(ce *configErrors) icinga2.Vars {
+	return mergeVars(ce.vars, icinga2.Vars{
+		"dummy_state": 1,
+		"dummy_text":  strings.Join(ce.messages, "\n")})
+}
@@ -0,0 +1,429 @@
+// Renders the objects of the configuration backend as Icinga2 DSL and writes them to a directory or uploads them
+// as a config package stage.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// Where the configuration is written to.
+type configOutput interface {
+	// The content of a file written before, or nil if it does not exist.
+	readFile(path string) ([]byte, error)
+	// Writes the files and removes the files that are not written anymore.
+	writeFiles(files map[string]string, removed []string) error
+}
+
+// Writes the files to a directory like /etc/icinga2 and reloads Icinga2 through the API, if it is configured.
+type configDirOutput struct {
+	dir string
+	api IcingaGenClient
+}
+
+// Uploads the files as a new stage of a config package, which Icinga2 validates and activates.
+type configPackageOutput struct {
+	icinga *IcingaWebClient
+	pkg    string
+}
+
+var identifierRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Keywords of the Icinga2 DSL, which cannot be used as identifiers.
+var dslKeywords = []string{"object", "template", "include", "include_recursive", "include_zones", "library", "null",
+	"true", "false", "const", "var", "this", "globals", "locals", "use", "ignore_on_error", "apply", "to", "where",
+	"import", "assign", "ignore", "function", "return", "break", "continue", "for", "if", "else", "while", "throw",
+	"try", "except", "in", "current_filename", "current_line", "default"}
+
+// ---------
+
+// The configuration files for the objects, by path. Objects with a zone are in zones.d, the others in conf.d.
+// Services and dependencies are in the zone of their host, groups in the global zone if there is one.
+func (c *IcingaConfigClient) render() map[string]string {
+	byZone := make(map[string]*bytes.Buffer)
+
+	for _, typ := range configObjectTypes {
+		names := make([]string, 0, len(c.objects[typ]))
+		for name := range c.objects[typ] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			attrs := c.objects[typ][name]
+
+			zone := stringAttr(attrs, "zone")
+			switch typ {
+			case "HostGroup", "ServiceGroup":
+				if zone == "" {
+					zone = c.globalZone
+				}
+			case "Service":
+				if zone == "" {
+					zone = stringAttr(c.objects["Host"][stringAttr(attrs, "host_name")], "zone")
+				}
+			case "Dependency":
+				zone = stringAttr(c.objects["Host"][stringAttr(attrs, "child_host_name")], "zone")
+			}
+
+			if byZone[zone] == nil {
+				byZone[zone] = new(bytes.Buffer)
+				fmt.Fprintf(byZone[zone], "// Generated by rancher-icinga for the Rancher installation %s, do not edit.\n",
+					c.installation)
+			}
+			byZone[zone].WriteString("\n" + renderObject(typ, name, attrs))
+		}
+	}
+
+	files := make(map[string]string)
+	for zone, buffer := range byZone {
+		path := "conf.d/rancher-icinga-" + c.installation + ".conf"
+		if zone != "" {
+			path = "zones.d/" + zone + "/rancher-icinga-" + c.installation + ".conf"
+		}
+		files[path] = buffer.String()
+	}
+
+	state, _ := json.MarshalIndent(c.objects, "", "  ")
+	files[c.stateFile()] = string(state)
+
+	return files
+}
+
+// An object in the Icinga2 DSL. The zone is given by the directory.
+func renderObject(typ, name string, attrs IcingaAttrs) string {
+	short := name[strings.LastIndex(name, "!")+1:]
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "object %s %s {\n", typ, renderString(short))
+
+	for _, t := range importsOf(name, attrs) {
+		fmt.Fprintf(&b, "  import %s\n", renderString(t))
+	}
+
+	keys := []string{}
+	for k := range attrs {
+		if k != "templates" && k != "zone" && k != "vars" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if isEmptyValue(attrs[k]) {
+			continue
+		}
+		fmt.Fprintf(&b, "  %s = %s\n", k, renderValue(attrs[k]))
+	}
+
+	vars := varsOf(attrs)
+	keys = []string{}
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if isIdentifier(k) {
+			fmt.Fprintf(&b, "  vars.%s = %s\n", k, renderValue(vars[k]))
+		} else {
+			fmt.Fprintf(&b, "  vars[%s] = %s\n", renderString(k), renderValue(vars[k]))
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func isIdentifier(s string) bool {
+	return identifierRegexp.MatchString(s) && !containsStrings(dslKeywords, []string{s})
+}
+
+// Unset attributes are left out.
+func isEmptyValue(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return x == ""
+	case []string:
+		return len(x) == 0
+	case []interface{}:
+		return len(x) == 0
+	}
+	return false
+}
+
+func renderString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// A value as Icinga2 DSL, with the keys of dictionaries sorted.
+func renderValue(v interface{}) string {
+	switch x := normalizeValue(v).(type) {
+	case nil:
+		return "null"
+	case string:
+		return renderString(x)
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", x)
+	case []string:
+		l := make([]interface{}, len(x))
+		for i, e := range x {
+			l[i] = e
+		}
+		return renderValue(l)
+	case []interface{}:
+		elements := make([]string, len(x))
+		for i, e := range x {
+			elements[i] = renderValue(e)
+		}
+		return "[ " + strings.Join(elements, ", ") + " ]"
+	case icinga2.Vars:
+		return renderValue(map[string]interface{}(x))
+	case IcingaAttrs:
+		return renderValue(map[string]interface{}(x))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		elements := make([]string, len(keys))
+		for i, k := range keys {
+			key := k
+			if !isIdentifier(k) {
+				key = renderString(k)
+			}
+			elements[i] = key + " = " + renderValue(x[k])
+		}
+		return "{ " + strings.Join(elements, ", ") + " }"
+	}
+	return renderString(fmt.Sprintf("%v", v))
+}
+
+// ---------
+
+func (o *configDirOutput) readFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(o.dir, path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// Files are written to a temporary file first, so Icinga2 never reads a partial file.
+func (o *configDirOutput) writeFiles(files map[string]string, removed []string) error {
+	for path, content := range files {
+		target := filepath.Join(o.dir, path)
+		if old, err := ioutil.ReadFile(target); err == nil && string(old) == content {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target+".tmp", []byte(content), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(target+".tmp", target); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range removed {
+		if err := os.Remove(filepath.Join(o.dir, path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if o.api != nil {
+		debugLog("Reloading Icinga2", 1)
+		return o.api.PerformAction("restart-process", IcingaAttrs{})
+	}
+	return nil
+}
+
+func (o *configPackageOutput) readFile(path string) ([]byte, error) {
+	return o.icinga.ReadPackageFile(o.pkg, path)
+}
+
+// The stage contains all files, so removed files are left out.
+func (o *configPackageOutput) writeFiles(files map[string]string, removed []string) error {
+	return o.icinga.UploadPackageStage(o.pkg, files)
+}
+
+// ---------
+
+type icingaPackage struct {
+	Name        string   `json:"name"`
+	ActiveStage string   `json:"active-stage"`
+	Stages      []string `json:"stages"`
+}
+
+type icingaPackages struct {
+	Results []icingaPackage `json:"results"`
+}
+
+type icingaStages struct {
+	Results []struct {
+		Stage string `json:"stage"`
+	} `json:"results"`
+}
+
+// The config package, or nil if it does not exist.
+func (i *IcingaWebClient) getPackage(pkg string) (*icingaPackage, error) {
+	var packages icingaPackages
+	var ierr icingaError
+
+	err := i.retry.do("list config packages", func() error {
+		resp, err := i.napping.Get(i.url+"/v1/config/packages", nil, &packages, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range packages.Results {
+		if p.Name == pkg {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// The content of a file in the active stage of a config package, or nil if there is none. Only works for
+// files with JSON content.
+func (i *IcingaWebClient) ReadPackageFile(pkg, path string) ([]byte, error) {
+	p, err := i.getPackage(pkg)
+	if err != nil || p == nil || p.ActiveStage == "" {
+		return nil, err
+	}
+	return i.readStageFile(pkg, p.ActiveStage, path)
+}
+
+// The content of a file in a stage of a config package, or nil if there is none. Only works for files with JSON
+// content.
+func (i *IcingaWebClient) readStageFile(pkg, stage, path string) ([]byte, error) {
+	var content json.RawMessage
+	var ierr icingaError
+
+	err := i.retry.do("read "+path+" of config package "+pkg, func() error {
+		resp, err := i.napping.Get(i.url+"/v1/config/files/"+url.PathEscape(pkg)+"/"+url.PathEscape(stage)+"/"+
+			path, nil, &content, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Uploads the files as a new stage of the config package, creating the package if needed, and removes the stages
+// that are not active. Icinga2 validates the stage in the background and reloads if the configuration is valid, so
+// this waits until the stage is active and returns an error if the configuration is invalid.
+func (i *IcingaWebClient) UploadPackageStage(pkg string, files map[string]string) error {
+	var ierr icingaError
+
+	p, err := i.getPackage(pkg)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		err := i.retry.do("create config package "+pkg, func() error {
+			resp, err := i.napping.Post(i.url+"/v1/config/packages/"+url.PathEscape(pkg), nil, nil, &ierr)
+			return i.checkResponse(resp, err, ierr)
+		})
+		if err != nil {
+			return fmt.Errorf("error creating config package %s: %s", pkg, err)
+		}
+		p = &icingaPackage{Name: pkg}
+	}
+
+	var stages icingaStages
+	err = i.retry.do("upload config package "+pkg, func() error {
+		resp, err := i.napping.Post(i.url+"/v1/config/stages/"+url.PathEscape(pkg),
+			map[string]interface{}{"files": files, "reload": true}, &stages, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading config package %s: %s", pkg, err)
+	}
+
+	for _, stage := range p.Stages {
+		if stage == p.ActiveStage {
+			continue
+		}
+		debugLog("Removing stage "+stage+" of config package "+pkg, 2)
+		err := i.retry.do("remove stage "+stage+" of config package "+pkg, func() error {
+			resp, err := i.napping.Delete(i.url+"/v1/config/stages/"+url.PathEscape(pkg)+"/"+url.PathEscape(stage),
+				nil, nil, &ierr)
+			return i.checkResponse(resp, err, ierr)
+		})
+		if err != nil {
+			fmt.Printf("ERROR: could not remove stage %s of config package %s: %s\n", stage, pkg, err)
+		}
+	}
+
+	if len(stages.Results) == 0 {
+		return fmt.Errorf("error uploading config package %s: no stage was created", pkg)
+	}
+	return i.waitForStage(pkg, stages.Results[0].Stage)
+}
+
+// How long to wait for Icinga2 to validate and activate an uploaded stage, and how often to check it.
+var (
+	stageTimeout      = 2 * time.Minute
+	stagePollInterval = 2 * time.Second
+)
+
+// Waits until a stage of the config package is active. Icinga2 writes the exit code of the validation to the status
+// file of the stage, and the output to its startup.log.
+func (i *IcingaWebClient) waitForStage(pkg, stage string) error {
+	deadline := time.Now().Add(stageTimeout)
+	for {
+		p, err := i.getPackage(pkg)
+		if err != nil {
+			return fmt.Errorf("error checking stage %s of config package %s: %s", stage, pkg, err)
+		}
+		if p != nil && p.ActiveStage == stage {
+			return nil
+		}
+
+		status, err := i.readStageFile(pkg, stage, "status")
+		if err != nil {
+			return fmt.Errorf("error checking stage %s of config package %s: %s", stage, pkg, err)
+		}
+		if status != nil && strings.TrimSpace(string(status)) != "0" {
+			return fmt.Errorf("the configuration in stage %s of config package %s is invalid, see %s/%s/startup.log",
+				stage, pkg, pkg, stage)
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("stage %s of config package %s was not activated within %s", stage, pkg, stageTimeout)
+		}
+		if !i.retry.sleep(stagePollInterval) {
+			return fmt.Errorf("stopped waiting for stage %s of config package %s", stage, pkg)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Signals for the loop in REFRESH_INTERVAL mode. SIGTERM and SIGINT stop a running sync after the current object, the
+// writes for the objects synced so far are still made, and then exit. SIGHUP reloads the configuration, with the
+// variables in CONFIG_FILE, and SIGUSR1 starts a sync immediately.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// The environment rancher-icinga was started with. The variables in CONFIG_FILE are set on top of it.
+var startEnvironment = os.Environ()
+
+// Whether the sync is stopping. The current object is finished, the other objects are skipped.
+func (config *RancherIcingaConfig) canceled() bool {
+	return config.ctx != nil && config.ctx.Err() != nil
+}
+
+// Handles the signals until the program exits. A reload or sync requested while a sync is running is made after it.
+func handleSignals(cancel context.CancelFunc) (reload, trigger <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+
+	reloads := make(chan struct{}, 1)
+	triggers := make(chan struct{}, 1)
+
+	go func() {
+		for s := range signals {
+			switch s {
+			case syscall.SIGHUP:
+				fmt.Println("Reloading the configuration")
+				notify(reloads)
+			case syscall.SIGUSR1:
+				fmt.Println("Starting a sync")
+				notify(triggers)
+			default:
+				fmt.Printf("Received %s, stopping\n", s)
+				cancel()
+			}
+		}
+	}()
+
+	return reloads, triggers
+}
+
+// Sends to a channel unless a send is pending already.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Creates the configuration again from the environment and CONFIG_FILE, or keeps the old configuration if that fails. The state kept
+// between syncs is taken over.
+func reloadConfig(ctx context.Context, old *RancherIcingaConfig) *RancherIcingaConfig {
+	config, err := NewConfig(ctx)
+	if err != nil {
+		fmt.Printf("ERROR: could not reload the configuration, keeping the old one: %s\n", err)
+		return old
+	}
+
+	config.downtimesSeen = old.downtimesSeen
+
+	// a new lock with the same settings would compete with the old one
+	if config.leaderSettings() == old.leaderSettings() {
+		config.leaderLock = old.leaderLock
+	} else if old.leaderLock != nil {
+		if err := old.leaderLock.release(); err != nil {
+			fmt.Printf("ERROR: could not release the leader lock: %s\n", err)
+		}
+	}
+	return config
+}
+
+// Sets the variables in CONFIG_FILE, if it is set, a file with lines like RANCHER_URL=http://rancher:8080 like a
+// Docker env file. They override the environment, variables removed from the file get their value from the
+// environment again.
+func loadConfigFile() error {
+	os.Clearenv()
+	for _, e := range startEnvironment {
+		if i := strings.Index(e, "="); i > 0 {
+			os.Setenv(e[:i], e[i+1:])
+		}
+	}
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading CONFIG_FILE: %s", err)
+	}
+
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return fmt.Errorf("error parsing CONFIG_FILE line %d: %q is not like NAME=value", n+1, line)
+		}
+		os.Setenv(line[:i], line[i+1:])
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Icinga2 dependencies mirroring where Rancher runs the containers of a stack, so an agent going down does
+// not cause notifications for every stack and service on it.
+//
+// Services depend on their host implicitly in Icinga2, so only the stack hosts need dependencies: a stack
+// host depends on the rancher-agent service of every agent host running one of its containers. These
+// dependencies form a redundancy group, so a stack is only unreachable if all of its agents are down.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// The attributes of dependencies managed by rancher-icinga.
+var dependencyAttrs = []string{"parent_host_name", "parent_service_name", "child_host_name", "redundancy_group",
+	"disable_checks", "disable_notifications", "vars"}
+
+// Generates the vars for a dependency of a stack host
+func varsForDependency(config *RancherIcingaConfig, environment, stack, host string) icinga2.Vars {
+	return icinga2.Vars{
+		RANCHER_INSTALLATION: config.rancherInstallation,
+		RANCHER_OBJECT_TYPE:  "dependency",
+		RANCHER_ENVIRONMENT:  environment,
+		RANCHER_STACK:        stack,
+		RANCHER_HOST:         host}
+}
+
+// The vars of an object from ListObjects.
+func varsOf(attrs IcingaAttrs) icinga2.Vars {
+	switch v := attrs["vars"].(type) {
+	case icinga2.Vars:
+		return v
+	case map[string]interface{}:
+		return icinga2.Vars(v)
+	}
+	return icinga2.Vars{}
+}
+
+// The dependencies there should be, by name.
+func rancherDependencies(config *RancherIcingaConfig) (map[string]IcingaAttrs, error) {
+	dependencies := make(map[string]IcingaAttrs)
+
+	rancherHosts, err := config.rancher.Hosts()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher hosts: %s", err)
+	}
+
+	rancherStacks, err := config.rancher.Stacks()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher stacks: %s", err)
+	}
+
+	for _, s := range rancherStacks.Data {
+		isolateStack(config, s, func() {
+			if !filterStack(config.rancher, s, config.filterStacks) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
+				return
+			}
+
+			environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+			stackHostname := execTemplate(config.stackNameTemplate, "", environmentName, s.Name, "")
+
+			instances := make(map[string]bool)
+			for _, id := range s.ServiceIds {
+				for _, i := range config.rancher.GetService(id).InstanceIds {
+					instances[i] = true
+				}
+			}
+
+			for _, rh := range rancherHosts.Data {
+				if rh.AccountId != s.AccountId ||
+					!filterHost(config.rancher, rh, config.filterHosts) {
+					continue
+				}
+
+				runsStack := false
+				for _, i := range rh.InstanceIds {
+					if instances[i] {
+						runsStack = true
+					}
+				}
+				if !runsStack {
+					continue
+				}
+
+				dependencies[stackHostname+"!rancher-agent-"+rh.Hostname] = IcingaAttrs{
+					"parent_host_name":      rh.Hostname,
+					"parent_service_name":   "rancher-agent",
+					"child_host_name":       stackHostname,
+					"redundancy_group":      "rancher-agents",
+					"disable_checks":        false,
+					"disable_notifications": true,
+					"vars":                  varsForDependency(config, environmentName, s.Name, rh.Hostname)}
+			}
+		})
+	}
+
+	return dependencies, nil
+}
+
+// Creates, updates and removes the dependencies of the stack hosts. When a stack is moved to other agents, the
+// dependencies for the old agents are removed and new ones created. If dependencies are disabled, existing
+// ones are removed.
+func syncDependencies(config *RancherIcingaConfig) error {
+	dependencies := make(map[string]IcingaAttrs)
+	if config.dependencies {
+		var err error
+		if dependencies, err = rancherDependencies(config); err != nil {
+			return err
+		}
+	}
+
+	icingaDependencies, err := config.icinga.ListObjects("Dependency", dependencyAttrs)
+	if err != nil {
+		return fmt.Errorf("error listing icinga dependencies: %s", err)
+	}
+
+	for name, attrs := range icingaDependencies {
+		if !config.matches(varsOf(attrs), "dependency", "", "", "") {
+			continue
+		}
+		if _, ok := dependencies[name]; ok || config.objectsFailed() {
+			continue
+		}
+
+		debugLog("Deleting dependency "+name, 1)
+		err := config.icinga.DeleteObject("Dependency", name)
+		if err != nil {
+			fmt.Printf("ERROR: could not delete dependency %s: %s\n", name, err)
+		} else {
+			config.registerChange("delete", name, "dependency", icinga2.Vars{}, attrs)
+		}
+	}
+
+	for name, attrs := range dependencies {
+		if live, ok := icingaDependencies[name]; ok {
+			updateDependency(config, name, live, attrs)
+			continue
+		}
+
+		debugLog("Creating dependency "+name, 1)
+		err := config.icinga.CreateObject("Dependency", name, nil, attrs)
+		if err != nil {
+			fmt.Printf("ERROR: could not create dependency %s: %s\n", name, err)
+		} else {
+			config.registerChange("create", name, "dependency", varsOf(attrs), attrs)
+		}
+	}
+
+	return nil
+}
+
+// Writes the attributes of a dependency that differ from the listed ones. Icinga2 cannot change the hosts, services
+// and flags of a dependency, so it is deleted and created again if they changed, only changed vars are updated.
+func updateDependency(config *RancherIcingaConfig, name string, live, attrs IcingaAttrs) {
+	recreate := false
+	for k, v := range attrs {
+		if lv, ok := live[k]; ok && k != "vars" && !reflect.DeepEqual(normalizeJSON(v), normalizeJSON(lv)) {
+			recreate = true
+		}
+	}
+
+	if !recreate {
+		if covers(normalizeJSON(attrs["vars"]), normalizeJSON(live["vars"])) {
+			return
+		}
+		debugLog("Updating dependency "+name, 1)
+		err := config.icinga.UpdateObject("Dependency", name, IcingaAttrs{"vars": attrs["vars"]})
+		if err != nil {
+			fmt.Printf("ERROR: could not update dependency %s: %s\n", name, err)
+		} else {
+			config.registerChange("update", name, "dependency", varsOf(attrs), attrs)
+		}
+		return
+	}
+
+	debugLog("Recreating dependency "+name, 1)
+	if err := config.icinga.DeleteObject("Dependency", name); err != nil {
+		fmt.Printf("ERROR: could not delete dependency %s: %s\n", name, err)
+		return
+	}
+	config.registerChange("delete", name, "dependency", icinga2.Vars{}, live)
+
+	if err := config.icinga.CreateObject("Dependency", name, nil, attrs); err != nil {
+		fmt.Printf("ERROR: could not create dependency %s: %s\n", name, err)
+	} else {
+		config.registerChange("create", name, "dependency", varsOf(attrs), attrs)
+	}
+}
@@ -0,0 +1,516 @@
+// An Icinga2 backend for installations managed by Icinga Director: the hosts, services, groups and dependencies
+// are created through the Director REST API, so they show up in Director next to the objects managed there, and
+// Director deploys them at the end of every sync that changed something. Imports are Director templates. Actions
+// and objects Director does not manage, like downtimes, check results, users and endpoints, use the Icinga2 API if
+// it is configured.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+// The Director object types and the names of their REST endpoints.
+var directorTypes = map[string]string{
+	"HostGroup":    "hostgroup",
+	"ServiceGroup": "servicegroup",
+	"Host":         "host",
+	"Service":      "service",
+	"Dependency":   "dependency",
+}
+
+// Director property names that differ from the Icinga2 attribute names.
+var directorProperties = map[string]string{
+	"host_name":           "host",
+	"parent_host_name":    "parent_host",
+	"parent_service_name": "parent_service",
+	"child_host_name":     "child_host",
+	"child_service_name":  "child_service",
+}
+
+// Director returns boolean properties as "y" and "n".
+var directorBooleans = []string{"enable_active_checks", "enable_passive_checks", "enable_notifications",
+	"enable_event_handler", "enable_flapping", "enable_perfdata", "volatile", "disable_checks",
+	"disable_notifications", "ignore_soft_states"}
+
+type IcingaDirectorClient struct {
+	url     string
+	napping napping.Session
+	retry   *retrier
+	api     IcingaGenClient // for everything else, can be nil
+
+	// 1 if objects were changed since the last deployment, set by concurrent writes
+	changed int32
+
+	// the hosts and services created since the last deployment, like "Host!agent1", which do not exist in
+	// Icinga2 yet
+	undeployed map[string]bool
+	lock       gosync.Mutex
+}
+
+type directorObjects struct {
+	Objects []map[string]interface{} `json:"objects"`
+}
+
+type directorError struct {
+	Error string `json:"error"`
+}
+
+func NewIcingaDirectorClient(directorURL, username, password string, api IcingaGenClient, debug, insecureTLS bool) *IcingaDirectorClient {
+	d := new(IcingaDirectorClient)
+	d.url = strings.TrimSuffix(directorURL, "/")
+	d.api = api
+	d.retry = &retrier{api: "director", retries: 3, backoff: time.Second}
+	d.undeployed = make(map[string]bool)
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureTLS},
+	}
+
+	d.napping = napping.Session{
+		Client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		Log:      debug,
+		Userinfo: url.UserPassword(username, password),
+		Header:   &http.Header{"Accept": []string{"application/json"}},
+	}
+	return d
+}
+
+// The URL of an object. Services are identified by their host and name, dependencies by their Director name.
+func (d *IcingaDirectorClient) objectURL(typ, name string) string {
+	params := url.Values{}
+	switch typ {
+	case "Service":
+		n := strings.Index(name, "!")
+		params.Set("host", name[:n])
+		params.Set("name", name[n+1:])
+	case "Dependency":
+		params.Set("name", directorDependencyName(name))
+	default:
+		params.Set("name", name)
+	}
+	return d.url + "/director/" + directorTypes[typ] + "?" + params.Encode()
+}
+
+// Director dependency names are not scoped by the child host like in Icinga2, so the host is part of the name.
+func directorDependencyName(name string) string {
+	return strings.Replace(name, "!", "-", 1)
+}
+
+// The Director properties for the Icinga2 attributes of an object.
+func directorObject(typ, name string, templates []string, attrs IcingaAttrs) map[string]interface{} {
+	o := map[string]interface{}{"object_type": "object"}
+
+	for k, v := range attrs {
+		if k == "templates" {
+			continue
+		}
+		if p, ok := directorProperties[k]; ok {
+			k = p
+		}
+		o[k] = v
+	}
+
+	switch typ {
+	case "Service":
+		o["object_name"] = name[strings.LastIndex(name, "!")+1:]
+	case "Dependency":
+		o["object_name"] = directorDependencyName(name)
+	default:
+		o["object_name"] = name
+	}
+
+	if len(templates) > 0 {
+		o["imports"] = templates
+	}
+
+	return o
+}
+
+// The name and Icinga2 attributes of a Director object. Like in Icinga2, the templates include the object's
+// own name.
+func icingaObject(typ string, o map[string]interface{}) (string, IcingaAttrs) {
+	attrs := IcingaAttrs{}
+	name, _ := o["object_name"].(string)
+
+	for k, v := range o {
+		if v == nil || k == "object_name" || k == "object_type" || k == "imports" {
+			continue
+		}
+		for a, p := range directorProperties {
+			if k == p {
+				k = a
+			}
+		}
+		if s, ok := v.(string); ok && containsStrings(directorBooleans, []string{k}) {
+			v = s == "y"
+		}
+		attrs[k] = v
+	}
+
+	switch typ {
+	case "Service":
+		name = stringAttr(attrs, "host_name") + "!" + name
+	case "Dependency":
+		host := stringAttr(attrs, "child_host_name")
+		name = host + "!" + strings.TrimPrefix(name, host+"-")
+	}
+
+	templates := []interface{}{}
+	if imports, ok := o["imports"].([]interface{}); ok {
+		templates = append(templates, imports...)
+	}
+	attrs["templates"] = append(templates, name[strings.LastIndex(name, "!")+1:])
+
+	return name, attrs
+}
+
+// Deploys the configuration if objects were changed since the last deployment.
+func (d *IcingaDirectorClient) Commit() error {
+	if atomic.LoadInt32(&d.changed) == 0 {
+		return nil
+	}
+
+	debugLog("Deploying the Icinga Director configuration", 1)
+
+	var derr directorError
+	err := d.retry.do("deploy the icinga director configuration", func() error {
+		resp, err := d.napping.Post(d.url+"/director/config/deploy", nil, nil, &derr)
+		return d.checkResponse(resp, err, derr)
+	})
+	if err != nil {
+		return fmt.Errorf("error deploying icinga director configuration: %s", err)
+	}
+	atomic.StoreInt32(&d.changed, 0)
+
+	d.lock.Lock()
+	d.undeployed = make(map[string]bool)
+	d.lock.Unlock()
+
+	return nil
+}
+
+// Requests are independent, so writes can be made concurrently.
+func (d *IcingaDirectorClient) ConcurrentWrites() bool {
+	return true
+}
+
+func (d *IcingaDirectorClient) checkResponse(resp *napping.Response, err error, derr directorError) error {
+	if err != nil {
+		return err
+	}
+	if resp.HttpResponse().StatusCode >= 400 {
+		return &apiError{resp.HttpResponse().StatusCode, resp.HttpResponse().Status, derr.Error}
+	}
+	return nil
+}
+
+// ---------
+
+func (d *IcingaDirectorClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	if _, ok := directorTypes[typ]; !ok {
+		if d.api == nil {
+			return fmt.Errorf("creating %s objects needs the Icinga2 API", typ)
+		}
+		return d.api.CreateObject(typ, name, templates, attrs)
+	}
+
+	var derr directorError
+	err := d.retry.do("create director "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := d.napping.Post(d.url+"/director/"+directorTypes[typ], directorObject(typ, name, templates, attrs),
+			nil, &derr)
+		return d.checkResponse(resp, err, derr)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&d.changed, 1)
+
+	if typ == "Host" || typ == "Service" {
+		d.lock.Lock()
+		d.undeployed[typ+"!"+name] = true
+		d.lock.Unlock()
+	}
+
+	return nil
+}
+
+// Only objects are listed, not templates.
+func (d *IcingaDirectorClient) ListObjects(typ string, attrs []string) (map[string]IcingaAttrs, error) {
+	if _, ok := directorTypes[typ]; !ok {
+		if d.api == nil {
+			return map[string]IcingaAttrs{}, nil
+		}
+		return d.api.ListObjects(typ, attrs)
+	}
+
+	var results directorObjects
+	var derr directorError
+	err := d.retry.do("list director "+icingaPath(directorTypes[typ]), func() error {
+		resp, err := d.napping.Get(d.url+"/director/"+icingaPath(directorTypes[typ]), nil, &results, &derr)
+		return d.checkResponse(resp, err, derr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]IcingaAttrs, len(results.Objects))
+	for _, o := range results.Objects {
+		if o["object_type"] != "object" {
+			continue
+		}
+		name, a := icingaObject(typ, o)
+		objects[name] = a.only(attrs)
+	}
+	return objects, nil
+}
+
+// Director objects are filtered by rancher-icinga.
+func (d *IcingaDirectorClient) ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error) {
+	if _, ok := directorTypes[typ]; !ok && d.api != nil {
+		return d.api.ListOwnedObjects(typ, installation, attrs)
+	}
+
+	objects, err := d.ListObjects(typ, append([]string{"vars"}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	return filterOwned(objects, installation, attrs), nil
+}
+
+func (d *IcingaDirectorClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	if _, ok := directorTypes[typ]; !ok {
+		if d.api == nil {
+			return fmt.Errorf("updating %s objects needs the Icinga2 API", typ)
+		}
+		return d.api.UpdateObject(typ, name, attrs)
+	}
+
+	properties := directorObject(typ, name, nil, attrs)
+	delete(properties, "object_type")
+	delete(properties, "object_name")
+
+	var derr directorError
+	err := d.retry.do("update director "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := d.napping.Post(d.objectURL(typ, name), properties, nil, &derr)
+		return d.checkResponse(resp, err, derr)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&d.changed, 1)
+
+	return nil
+}
+
+// Like a cascading delete in Icinga2, deleting a host also deletes its services and the dependencies on it, and
+// deleting a service the dependencies on it.
+func (d *IcingaDirectorClient) DeleteObject(typ, name string) error {
+	if _, ok := directorTypes[typ]; !ok {
+		if d.api == nil {
+			return fmt.Errorf("deleting %s objects needs the Icinga2 API", typ)
+		}
+		return d.api.DeleteObject(typ, name)
+	}
+
+	if typ == "Host" || typ == "Service" {
+		dependencies, err := d.ListObjects("Dependency", dependencyAttrs)
+		if err != nil {
+			return err
+		}
+		for dn, attrs := range dependencies {
+			if typ == "Host" && (attrs["child_host_name"] == name || attrs["parent_host_name"] == name) ||
+				typ == "Service" && stringAttr(attrs, "parent_host_name")+"!"+stringAttr(attrs, "parent_service_name") == name {
+				if err := d.DeleteObject("Dependency", dn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if typ == "Host" {
+		services, err := d.ListObjects("Service", []string{})
+		if err != nil {
+			return err
+		}
+		for s := range services {
+			if strings.HasPrefix(s, name+"!") {
+				if err := d.DeleteObject("Service", s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	var derr directorError
+	err := d.retry.do("delete director "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := d.napping.Delete(d.objectURL(typ, name), nil, nil, &derr)
+		return d.checkResponse(resp, err, derr)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&d.changed, 1)
+
+	return nil
+}
+
+// Actions for hosts and services created since the last deployment are skipped, they only exist in Icinga2 once
+// the deployment is active, and are made in the next sync.
+func (d *IcingaDirectorClient) PerformAction(action string, params IcingaAttrs) error {
+	if d.api == nil {
+		return fmt.Errorf("%s needs the Icinga2 API", action)
+	}
+
+	object := ""
+	if s := stringAttr(params, "service"); s != "" {
+		object = "Service!" + s
+	} else if h := stringAttr(params, "host"); h != "" {
+		object = "Host!" + h
+	}
+	d.lock.Lock()
+	undeployed := d.undeployed[object] || d.undeployed["Host!"+hostOfName(stringAttr(params, "service"))]
+	d.lock.Unlock()
+	if undeployed {
+		debugLog(fmt.Sprintf("Skipping %s for %s until it is deployed", action, object), 1)
+		return nil
+	}
+
+	return d.api.PerformAction(action, params)
+}
+
+// ---------
+
+func (d *IcingaDirectorClient) getObject(typ, name string) (IcingaAttrs, error) {
+	var o map[string]interface{}
+	var derr directorError
+	err := d.retry.do("get director "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := d.napping.Get(d.objectURL(typ, name), nil, &o, &derr)
+		return d.checkResponse(resp, err, derr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, attrs := icingaObject(typ, o)
+	return attrs, nil
+}
+
+func (d *IcingaDirectorClient) GetHost(name string) (icinga2.Host, error) {
+	attrs, err := d.getObject("Host", name)
+	if err != nil {
+		return icinga2.Host{}, err
+	}
+	return hostOfAttrs(name, attrs), nil
+}
+
+func (d *IcingaDirectorClient) CreateHost(h icinga2.Host) error {
+	return d.CreateObject("Host", h.Name, nil, attrsForHost(h))
+}
+
+func (d *IcingaDirectorClient) ListHosts() ([]icinga2.Host, error) {
+	objects, err := d.ListObjects("Host", []string{"address", "check_command", "notes_url", "groups", "vars", "zone"})
+	if err != nil {
+		return nil, err
+	}
+	hosts := []icinga2.Host{}
+	for name, attrs := range objects {
+		hosts = append(hosts, hostOfAttrs(name, attrs))
+	}
+	return hosts, nil
+}
+
+func (d *IcingaDirectorClient) DeleteHost(name string) error {
+	return d.DeleteObject("Host", name)
+}
+
+// Zones cannot be changed.
+func (d *IcingaDirectorClient) UpdateHost(h icinga2.Host) error {
+	return d.UpdateObject("Host", h.Name, IcingaAttrs{
+		"address":       h.Address,
+		"check_command": h.CheckCommand,
+		"notes_url":     h.NotesURL,
+		"groups":        h.Groups,
+		"vars":          h.Vars})
+}
+
+func (d *IcingaDirectorClient) GetHostGroup(name string) (icinga2.HostGroup, error) {
+	attrs, err := d.getObject("HostGroup", name)
+	if err != nil {
+		return icinga2.HostGroup{}, err
+	}
+	return hostGroupOfAttrs(name, attrs), nil
+}
+
+func (d *IcingaDirectorClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	attrs := IcingaAttrs{"vars": hg.Vars}
+	if hg.DisplayName != "" {
+		attrs["display_name"] = hg.DisplayName
+	}
+	return d.CreateObject("HostGroup", hg.Name, nil, attrs)
+}
+
+func (d *IcingaDirectorClient) ListHostGroups() ([]icinga2.HostGroup, error) {
+	objects, err := d.ListObjects("HostGroup", []string{"display_name", "vars", "zone"})
+	if err != nil {
+		return nil, err
+	}
+	hostGroups := []icinga2.HostGroup{}
+	for name, attrs := range objects {
+		hostGroups = append(hostGroups, hostGroupOfAttrs(name, attrs))
+	}
+	return hostGroups, nil
+}
+
+func (d *IcingaDirectorClient) DeleteHostGroup(name string) error {
+	return d.DeleteObject("HostGroup", name)
+}
+
+func (d *IcingaDirectorClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	return d.UpdateObject("HostGroup", hg.Name, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars})
+}
+
+func (d *IcingaDirectorClient) GetService(name string) (icinga2.Service, error) {
+	attrs, err := d.getObject("Service", name)
+	if err != nil {
+		return icinga2.Service{}, err
+	}
+	return serviceOfAttrs(name, attrs), nil
+}
+
+func (d *IcingaDirectorClient) CreateService(s icinga2.Service) error {
+	return d.CreateObject("Service", s.HostName+"!"+s.Name, nil, attrsForService(s))
+}
+
+func (d *IcingaDirectorClient) ListServices() ([]icinga2.Service, error) {
+	objects, err := d.ListObjects("Service", []string{"host_name", "check_command", "notes_url", "vars", "zone"})
+	if err != nil {
+		return nil, err
+	}
+	services := []icinga2.Service{}
+	for name, attrs := range objects {
+		services = append(services, serviceOfAttrs(name, attrs))
+	}
+	return services, nil
+}
+
+func (d *IcingaDirectorClient) DeleteService(name string) error {
+	return d.DeleteObject("Service", name)
+}
+
+// Zones cannot be changed.
+func (d *IcingaDirectorClient) UpdateService(s icinga2.Service) error {
+	return d.UpdateObject("Service", s.HostName+"!"+s.Name, IcingaAttrs{
+		"check_command": s.CheckCommand,
+		"notes_url":     s.NotesURL,
+		"vars":          s.Vars})
+}
@@ -0,0 +1,239 @@
+// Icinga2 downtimes for Rancher services that are being upgraded or restarted and for hosts in maintenance,
+// so expected outages do not cause notifications.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// A Rancher object in a state that needs a downtime.
+type downtimeTarget struct {
+	typ     string   // "Host" or "Service"
+	objects []string // the Icinga2 hosts or services
+	comment string
+}
+
+// Downtimes are tagged with the key of the Rancher object in their comment, like
+// "[Default.mystack!web] Rancher service is upgrading". Icinga2 copies the comment to the downtimes
+// it creates for the services and children of a host.
+var downtimeKeyRegexp = regexp.MustCompile(`^\[([^\]]+)\] `)
+
+// The author of the downtimes created by this installation.
+func downtimeAuthor(config *RancherIcingaConfig) string {
+	return "rancher-icinga/" + config.rancherInstallation
+}
+
+// The Rancher objects that should be in downtime, by key.
+func rancherDowntimes(config *RancherIcingaConfig, icingaServices []icinga2.Service) (map[string]downtimeTarget, error) {
+	targets := make(map[string]downtimeTarget)
+
+	rancherHosts, err := config.rancher.Hosts()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher hosts: %s", err)
+	}
+
+	for _, rh := range rancherHosts.Data {
+		isolateHost(config, rh, func() {
+			if !containsStrings(config.downtimeHostStates, []string{rh.State}) ||
+				!filterHost(config.rancher, rh, config.filterHosts) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) {
+				return
+			}
+
+			targets[rh.Hostname] = downtimeTarget{
+				typ:     "Host",
+				objects: []string{rh.Hostname},
+				comment: fmt.Sprintf("[%s] Rancher host is %s", rh.Hostname, rh.State)}
+		})
+	}
+
+	rancherServices, err := config.rancher.Services()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher services: %s", err)
+	}
+
+	for _, rs := range rancherServices.Data {
+		isolateService(config, rs, func() {
+			if !containsStrings(config.downtimeServiceStates, []string{rs.State}) ||
+				!filterService(config.rancher, rs, config.filterServices) ||
+				!filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) {
+				return
+			}
+
+			environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
+			stackName := config.rancher.GetStack(rs.StackId).Name
+			stackHostname := execTemplate(config.stackNameTemplate, "", environmentName, stackName, rs.Name)
+			key := stackHostname + "!" + rs.Name
+
+			// the service and its custom checks
+			objects := []string{}
+			for _, is := range icingaServices {
+				if is.HostName == stackHostname &&
+					config.matches(is.Vars, "service/custom-check", environmentName, stackName, rs.Name) {
+					objects = append(objects, is.HostName+"!"+is.Name)
+				}
+			}
+			sort.Strings(objects)
+
+			targets[key] = downtimeTarget{
+				typ:     "Service",
+				objects: objects,
+				comment: fmt.Sprintf("[%s] Rancher service is %s", key, rs.State)}
+		})
+	}
+
+	return targets, nil
+}
+
+// Schedules downtimes for Rancher objects in one of the configured states and removes them when the object
+// is back in another state. A downtime ends after the maximum duration at the latest, counted from when the
+// state was first seen, and is not scheduled again while the object stays in that state. When the state was first
+// seen is taken from the start of the existing downtimes, so it survives a restart, and kept in STATE_FILE if set,
+// so it is also known once the downtimes ended.
+func syncDowntimes(config *RancherIcingaConfig) error {
+	if config.downtimeMaxDuration <= 0 {
+		return nil
+	}
+
+	icingaServices, err := config.icinga.ListServices()
+	if err != nil {
+		return fmt.Errorf("error fetching icinga services: %s", err)
+	}
+
+	targets, err := rancherDowntimes(config, icingaServices)
+	if err != nil {
+		return err
+	}
+
+	icingaDowntimes, err := config.icinga.ListObjects("Downtime",
+		[]string{"author", "comment", "host_name", "service_name", "start_time"})
+	if err != nil {
+		return fmt.Errorf("error listing icinga downtimes: %s", err)
+	}
+
+	// the objects that already have a downtime and the start of the first one, by key
+	scheduled := make(map[string]map[string]bool)
+	started := make(map[string]time.Time)
+
+	for name, attrs := range icingaDowntimes {
+		if attrs["author"] != downtimeAuthor(config) {
+			continue
+		}
+		comment, _ := attrs["comment"].(string)
+		m := downtimeKeyRegexp.FindStringSubmatch(comment)
+		if m == nil {
+			continue
+		}
+		key := m[1]
+
+		if _, ok := targets[key]; ok || config.objectsFailed() {
+			object, _ := attrs["host_name"].(string)
+			if service, _ := attrs["service_name"].(string); service != "" {
+				object += "!" + service
+			}
+			if scheduled[key] == nil {
+				scheduled[key] = make(map[string]bool)
+			}
+			scheduled[key][object] = true
+			if start, ok := unixTime(attrs["start_time"]); ok && (started[key].IsZero() || start.Before(started[key])) {
+				started[key] = start
+			}
+			continue
+		}
+
+		debugLog("Removing downtime "+name, 1)
+		err := config.icinga.PerformAction("remove-downtime", IcingaAttrs{"type": "Downtime", "downtime": name})
+		if err != nil {
+			fmt.Printf("ERROR: could not remove downtime %s: %s\n", name, err)
+		} else {
+			config.registerChange("delete", name, "downtime", icinga2.Vars{}, attrs)
+		}
+	}
+
+	now := time.Now()
+
+	seen := config.downtimesSeen
+	if config.state != nil {
+		if config.state.Downtimes == nil {
+			config.state.Downtimes = make(map[string]time.Time)
+		}
+		seen = config.state.Downtimes
+	}
+
+	for key := range seen {
+		if _, ok := targets[key]; !ok {
+			delete(seen, key)
+		}
+	}
+
+	for key, target := range targets {
+		if start := started[key]; !start.IsZero() && (seen[key].IsZero() || start.Before(seen[key])) {
+			seen[key] = start
+		} else if _, ok := seen[key]; !ok {
+			seen[key] = now
+		}
+		end := seen[key].Add(config.downtimeMaxDuration)
+		if !end.After(now) {
+			continue
+		}
+
+		for _, object := range target.objects {
+			if scheduled[key][object] {
+				continue
+			}
+
+			params := IcingaAttrs{
+				"type":       target.typ,
+				"author":     downtimeAuthor(config),
+				"comment":    target.comment,
+				"start_time": now.Unix(),
+				"end_time":   end.Unix(),
+				"fixed":      true}
+			params[strings.ToLower(target.typ)] = object
+			if target.typ == "Host" {
+				params["all_services"] = true
+				params["child_options"] = "DowntimeTriggeredChildren"
+			}
+
+			debugLog("Scheduling downtime for "+object, 1)
+			err := config.icinga.PerformAction("schedule-downtime", params)
+			if err != nil {
+				fmt.Printf("ERROR: could not schedule downtime for %s: %s\n", object, err)
+			} else {
+				config.registerChange("create", object, "downtime", icinga2.Vars{}, params)
+			}
+		}
+	}
+
+	return nil
+}
+
+// A time in Unix seconds as listed by Icinga2 or a client.
+func unixTime(v interface{}) (time.Time, bool) {
+	var seconds int64
+	switch t := v.(type) {
+	case float64:
+		seconds = int64(t)
+	case int64:
+		seconds = t
+	case int:
+		seconds = int64(t)
+	case json.Number:
+		var err error
+		if seconds, err = t.Int64(); err != nil {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
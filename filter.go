@@ -9,6 +9,18 @@ import (
 	"github.com/rancher/go-rancher/v2"
 )
 
+var filterRuleRegexp = regexp.MustCompile("^([+-]?)([a-zA-Z0-9\\.=\\_*%\\(\\)-]*)(!L)?$")
+
+// Checks the syntax of the rules of a filter, which filterSomething expects to be valid.
+func validateFilter(filter string) error {
+	for _, r := range strings.Split(filter, ",") {
+		if !filterRuleRegexp.MatchString(r) {
+			return fmt.Errorf("invalid rule %q", r)
+		}
+	}
+	return nil
+}
+
 func filterEnvironment(rancher RancherGenClient, env client.Project, filter string) bool {
 	return filterSomething(rancher, env, filter1Environment, filter)
 }
@@ -31,9 +43,8 @@ func filterSomething(rancher RancherGenClient,
 	filter string) (match bool) {
 
 	match = false
-	re := regexp.MustCompile("^([+-]?)([a-zA-Z0-9\\.=\\_*%\\(\\)-]*)(!L)?$")
 	for _, r := range strings.Split(filter, ",") {
-		ruleParts := re.FindStringSubmatch(r)
+		ruleParts := filterRuleRegexp.FindStringSubmatch(r)
 		if ruleParts == nil {
 			panic("failed to match " + r)
 		}
@@ -115,6 +126,13 @@ func filter1Stack(rancher RancherGenClient, obj interface{}, rule string) bool {
 				}
 			}
 		}
+	} else if m := regexp.MustCompile("^([a-zA-Z0-9\\.\\*_-]+)=([a-zA-Z0-9\\.\\*_-]+)$").FindStringSubmatch(rule); m != nil {
+		sc, _ := stackConfigOf(rancher, stack)
+		for l, v := range sc.Labels {
+			if glob.MustCompile(rule).Match(fmt.Sprintf("%s=%s", l, v)) {
+				return true
+			}
+		}
 	} else if glob.MustCompile(rule).Match(stack.Name) {
 		return true
 	}
@@ -68,6 +68,27 @@ func TestFilterStack(t *testing.T) {
 
 	assert.True(filterStack(rancher, stack2, "%SYSTEM"))
 	assert.False(filterStack(rancher, stack2, "-%SYSTEM"))
+
+	stack3 := client.Stack{Name: "configured", AccountId: "1a5", RancherCompose: `.icinga:
+  labels:
+    team: payments
+`}
+
+	assert.True(filterStack(rancher, stack3, "team=payments"))
+	assert.True(filterStack(rancher, stack3, "team=*"))
+	assert.False(filterStack(rancher, stack3, "team=search"))
+	assert.False(filterStack(rancher, stack1, "team=payments"))
+
+	stack4 := client.Stack{Name: "numbered", AccountId: "1a5", RancherCompose: `.icinga:
+  labels:
+    team: payments-2
+    tier: web_1
+`}
+
+	assert.True(filterStack(rancher, stack4, "team=payments-2"))
+	assert.True(filterStack(rancher, stack4, "tier=web_1"))
+	assert.False(filterStack(rancher, stack4, "tier=web_2"))
+	assert.Nil(validateFilter("team=payments-2,tier=web_1"))
 }
 
 func TestFilterService(t *testing.T) {
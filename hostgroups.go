@@ -0,0 +1,275 @@
+// Host groups in addition to the one per environment: agent hosts grouped by a host label, stack hosts grouped
+// by a service label or by stack name patterns, and a host group for the installation that contains the
+// environment host groups. Each kind of host group is enabled by its configuration.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"github.com/gobwas/glob"
+	"github.com/rancher/go-rancher/v2"
+)
+
+// Stack hosts whose stack name matches the pattern are put into the host group.
+type hostGroupPattern struct {
+	name    string
+	pattern glob.Glob
+}
+
+// Reads the host group configuration from the environment.
+func makeHostGroupConfig(cc *RancherIcingaConfig) (err error) {
+	for env, t := range map[string]**template.Template{
+		"INSTALLATION_HOSTGROUP_TEMPLATE": &cc.installationHostGroupTemplate,
+		"HOST_HOSTGROUP_TEMPLATE":         &cc.hostHostGroupTemplate,
+		"STACK_HOSTGROUP_TEMPLATE":        &cc.stackHostGroupTemplate,
+	} {
+		if c := os.Getenv(env); c != "" {
+			if *t, err = template.New(env).Parse(c); err != nil {
+				return fmt.Errorf("Failed to parse %s: %q", env, err.Error())
+			}
+		}
+	}
+
+	cc.hostHostGroupLabel = os.Getenv("HOST_HOSTGROUP_LABEL")
+	if cc.hostHostGroupLabel != "" && cc.hostHostGroupTemplate == nil {
+		cc.hostHostGroupTemplate = template.Must(template.New("hosthostgroup").Parse("{{.Value}}"))
+	}
+	cc.stackHostGroupLabel = os.Getenv("STACK_HOSTGROUP_LABEL")
+	if cc.stackHostGroupLabel != "" && cc.stackHostGroupTemplate == nil {
+		cc.stackHostGroupTemplate = template.Must(template.New("stackhostgroup").Parse("{{.Value}}"))
+	}
+
+	// like "databases=*-db,web=web-*"
+	if c := os.Getenv("STACK_HOSTGROUP_PATTERNS"); c != "" {
+		for _, p := range strings.Split(c, ",") {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return fmt.Errorf("error parsing STACK_HOSTGROUP_PATTERNS: %q is not GROUP=PATTERN", p)
+			}
+			g, err := glob.Compile(kv[1])
+			if err != nil {
+				return fmt.Errorf("error parsing STACK_HOSTGROUP_PATTERNS: %s", err)
+			}
+			cc.stackHostGroupPatterns = append(cc.stackHostGroupPatterns, hostGroupPattern{kv[0], g})
+		}
+	}
+
+	return nil
+}
+
+// Generates the vars for a host group that does not represent an environment
+func varsForHostGroup(config *RancherIcingaConfig) icinga2.Vars {
+	return mergeVars(config.hostgroupDefaultIcingaVars, icinga2.Vars{
+		RANCHER_INSTALLATION: config.rancherInstallation,
+		RANCHER_OBJECT_TYPE:  "hostgroup"})
+}
+
+// The name of the host group for the installation, or "" if there is none.
+func installationHostGroup(config *RancherIcingaConfig) string {
+	if config.installationHostGroupTemplate == nil {
+		return ""
+	}
+	return expandGroupTemplate(config.installationHostGroupTemplate, GroupParameters{
+		RancherInstallation: config.rancherInstallation})
+}
+
+// The sorted host groups of an agent host, including the environment.
+func hostGroupsOfHost(config *RancherIcingaConfig, host client.Host, environment string) []string {
+	groups := []string{environment}
+
+	if config.hostHostGroupLabel != "" {
+		if v, ok := host.Labels[config.hostHostGroupLabel].(string); ok && v != "" {
+			groups = addGroup(groups, expandGroupTemplate(config.hostHostGroupTemplate, GroupParameters{
+				RancherCheckParameters: RancherCheckParameters{Hostname: host.Hostname, RancherEnvironment: environment},
+				RancherInstallation:    config.rancherInstallation,
+				Label:                  config.hostHostGroupLabel,
+				Value:                  v}))
+		}
+	}
+
+	sort.Strings(groups)
+	return groups
+}
+
+// The sorted host groups of a stack host, including the environment. The label can be set on any service of
+// the stack or in the stack configuration.
+func hostGroupsOfStack(config *RancherIcingaConfig, stack client.Stack, environment string) []string {
+	groups := []string{environment}
+
+	if config.stackHostGroupLabel != "" {
+		values := []string{}
+		for _, id := range stack.ServiceIds {
+			s := config.rancher.GetService(id)
+			if s.LaunchConfig == nil {
+				continue
+			}
+			if v, ok := s.LaunchConfig.Labels[config.stackHostGroupLabel].(string); ok && v != "" {
+				values = append(values, v)
+			}
+		}
+		sc, _ := stackConfigOf(config.rancher, stack)
+		if v := sc.Labels[config.stackHostGroupLabel]; v != "" {
+			values = append(values, v)
+		}
+
+		for _, v := range values {
+			groups = addGroup(groups, expandGroupTemplate(config.stackHostGroupTemplate, GroupParameters{
+				RancherCheckParameters: RancherCheckParameters{RancherEnvironment: environment, RancherStack: stack.Name},
+				RancherInstallation:    config.rancherInstallation,
+				Label:                  config.stackHostGroupLabel,
+				Value:                  v}))
+		}
+	}
+
+	for _, p := range config.stackHostGroupPatterns {
+		if p.pattern.Match(stack.Name) {
+			groups = addGroup(groups, p.name)
+		}
+	}
+
+	sort.Strings(groups)
+	return groups
+}
+
+func addGroup(groups []string, group string) []string {
+	if group == "" || containsStrings(groups, []string{group}) {
+		return groups
+	}
+	return append(groups, group)
+}
+
+// The host groups there should be besides the environment host groups, sorted.
+func rancherHostGroups(config *RancherIcingaConfig) ([]string, error) {
+	found := make(map[string]bool)
+
+	if g := installationHostGroup(config); g != "" {
+		found[g] = true
+	}
+
+	rancherHosts, err := config.rancher.Hosts()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher hosts: %s", err)
+	}
+
+	for _, rh := range rancherHosts.Data {
+		isolateHost(config, rh, func() {
+			if !filterHost(config.rancher, rh, config.filterHosts) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) {
+				return
+			}
+			environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
+			for _, g := range hostGroupsOfHost(config, rh, environmentName) {
+				if g != environmentName {
+					found[g] = true
+				}
+			}
+		})
+	}
+
+	rancherStacks, err := config.rancher.Stacks()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher stacks: %s", err)
+	}
+
+	for _, s := range rancherStacks.Data {
+		isolateStack(config, s, func() {
+			if !filterStack(config.rancher, s, config.filterStacks) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
+				return
+			}
+			environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+			for _, g := range hostGroupsOfStack(config, s, environmentName) {
+				if g != environmentName {
+					found[g] = true
+				}
+			}
+		})
+	}
+
+	groups := make([]string, 0, len(found))
+	for g := range found {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+// Creates the host groups needed besides the environment host groups. This runs before the environments
+// are synced, so the installation host group exists when the environment host groups are added to it.
+func syncRancherHostGroups(config *RancherIcingaConfig) error {
+	groups, err := rancherHostGroups(config)
+	if err != nil {
+		return err
+	}
+
+	hostGroups, err := config.icinga.ListHostGroups()
+	if err != nil {
+		return fmt.Errorf("error fetching icinga hostgroups: %s", err)
+	}
+
+	groupAttrs, err := config.icinga.ListObjects("HostGroup", []string{"templates"})
+	if err != nil {
+		return fmt.Errorf("error fetching icinga hostgroup attributes: %s", err)
+	}
+
+	for _, name := range groups {
+		found, listed := false, false
+		for _, hg := range hostGroups {
+			if hg.Name != name {
+				continue
+			}
+			listed = true
+			if config.matches(hg.Vars, "hostgroup", "", "", "") &&
+				recreateForImports(config, "HostGroup", name, groupAttrs[name], config.hostgroupImports) {
+				continue
+			}
+			found = true
+		}
+		// only the host groups of the installation are listed, there may be one managed by someone else
+		if existing, ok := listObjectsOnce(config, "HostGroup"); ok && !listed {
+			_, found = existing[name]
+		}
+		if found {
+			continue
+		}
+
+		vars := varsForHostGroup(config)
+		hg := icinga2.HostGroup{Name: name, Vars: vars}
+		debugLog("Creating host group "+name, 1)
+		err := createHostGroup(config, hg, config.hostgroupImports)
+		if err != nil {
+			fmt.Printf("ERROR: could not create hostgroup %s: %s\n", name, err)
+		} else {
+			config.registerChange("create", name, "hostgroup", vars, hg)
+		}
+	}
+
+	return nil
+}
+
+// Puts an environment host group into the installation host group.
+func syncEnvironmentHostGroupParent(config *RancherIcingaConfig, groupAttrs map[string]IcingaAttrs, name string) {
+	parents := []string{}
+	if g := installationHostGroup(config); g != "" {
+		parents = append(parents, g)
+	}
+
+	if equalStrings(stringList(groupAttrs[name]["groups"]), parents) {
+		return
+	}
+
+	debugLog("Updating host group "+name+" with groups", 1)
+	err := config.icinga.UpdateObject("HostGroup", name, IcingaAttrs{"groups": parents})
+	if err != nil {
+		fmt.Printf("ERROR: could not update hostgroup %s: %s\n", name, err)
+	} else {
+		config.registerChange("update", name, "hostgroup", icinga2.Vars{}, parents)
+	}
+}
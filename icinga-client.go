@@ -0,0 +1,638 @@
+// Wraps the icinga2 GO API client for object types and attributes it does not support and for easier testing.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"gopkg.in/jmcvetta/napping.v3"
+)
+
+// Attributes of an Icinga2 object, as used by the Icinga2 API.
+type IcingaAttrs map[string]interface{}
+
+type IcingaGenClient interface {
+	icinga2.Client
+	CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error
+	ListObjects(typ string, attrs []string) (map[string]IcingaAttrs, error)
+	// Lists the objects with the vars of a Rancher installation, filtered by the server if possible.
+	ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error)
+	UpdateObject(typ, name string, attrs IcingaAttrs) error
+	DeleteObject(typ, name string) error
+	PerformAction(action string, params IcingaAttrs) error
+	// Called at the end of every sync, for backends that do not apply changes immediately.
+	Commit() error
+}
+
+type IcingaWebClient struct {
+	icinga2.Client
+	url     string
+	napping napping.Session
+	retry   *retrier
+}
+
+type IcingaMockClient struct {
+	icinga2.Client
+	objects   map[string]map[string]IcingaAttrs
+	downtimes int
+
+	// the last check result submitted for each host and service
+	checkResults map[string]IcingaAttrs
+}
+
+type icingaResult struct {
+	Name  string      `json:"name"`
+	Attrs IcingaAttrs `json:"attrs"`
+}
+
+type icingaResults struct {
+	Results []icingaResult `json:"results"`
+}
+
+type icingaError struct {
+	Error  float64 `json:"error"`
+	Status string  `json:"status"`
+}
+
+// An error response of the Icinga2 or Director API.
+type apiError struct {
+	statusCode int
+	status     string
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.message)
+}
+
+func NewIcingaWebClient(icinga icinga2.Client, icingaURL, username, password string, debug, insecureTLS bool) *IcingaWebClient {
+	i := new(IcingaWebClient)
+	i.Client = icinga
+	i.url = strings.TrimSuffix(icingaURL, "/")
+	i.retry = &retrier{api: "icinga", retries: 3, backoff: time.Second}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureTLS},
+	}
+
+	i.napping = napping.Session{
+		Client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		Log:      debug,
+		Userinfo: url.UserPassword(username, password),
+		Header:   &http.Header{"Accept": []string{"application/json"}},
+	}
+	return i
+}
+
+func NewIcingaMockClient() *IcingaMockClient {
+	i := new(IcingaMockClient)
+	i.Client = icinga2.NewMockClient()
+	i.objects = make(map[string]map[string]IcingaAttrs)
+	return i
+}
+
+// The URL path for an object type, like "services" for "Service".
+func icingaPath(typ string) string {
+	if strings.HasSuffix(typ, "y") {
+		return strings.ToLower(strings.TrimSuffix(typ, "y")) + "ies"
+	}
+	return strings.ToLower(typ) + "s"
+}
+
+// The imported templates from an object's "templates" attribute, which also contains the object's own name.
+func importsOf(name string, attrs IcingaAttrs) []string {
+	res := []string{}
+	short := name[strings.LastIndex(name, "!")+1:]
+
+	if templates, ok := attrs["templates"].([]interface{}); ok {
+		for _, t := range templates {
+			if s, ok := t.(string); ok && s != short {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// The API attributes of the properties an icinga2.Service has.
+func attrsForService(s icinga2.Service) IcingaAttrs {
+	attrs := IcingaAttrs{
+		"host_name":     s.HostName,
+		"check_command": s.CheckCommand,
+		"vars":          s.Vars}
+	if s.NotesURL != "" {
+		attrs["notes_url"] = s.NotesURL
+	}
+	if s.Zone != "" {
+		attrs["zone"] = s.Zone
+	}
+	return attrs
+}
+
+// The sorted names of the attributes.
+func (a IcingaAttrs) names() []string {
+	names := make([]string, 0, len(a))
+	for k := range a {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A copy of the attributes containing only the given names.
+func (a IcingaAttrs) only(names []string) IcingaAttrs {
+	res := make(IcingaAttrs)
+	for _, n := range names {
+		if v, ok := a[n]; ok {
+			res[n] = v
+		}
+	}
+	return res
+}
+
+func mergeAttrs(a IcingaAttrs, b IcingaAttrs) (r IcingaAttrs) {
+	r = make(IcingaAttrs)
+	for k, v := range a {
+		r[k] = v
+	}
+	for k, v := range b {
+		r[k] = v
+	}
+	return
+}
+
+// ---------
+
+func (i *IcingaWebClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	var ierr icingaError
+	payload := map[string]interface{}{"attrs": attrs}
+	if len(templates) > 0 {
+		payload["templates"] = templates
+	}
+
+	return i.retry.do("create "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := i.napping.Put(i.url+"/v1/objects/"+icingaPath(typ)+"/"+url.PathEscape(name), payload, nil, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+}
+
+func (i *IcingaWebClient) ListObjects(typ string, attrs []string) (map[string]IcingaAttrs, error) {
+	var results icingaResults
+	var ierr icingaError
+	params := url.Values{}
+	for _, a := range attrs {
+		params.Add("attrs", a)
+	}
+
+	err := i.retry.do("list "+icingaPath(typ), func() error {
+		resp, err := i.napping.Get(i.url+"/v1/objects/"+icingaPath(typ), &params, &results, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]IcingaAttrs, len(results.Results))
+	for _, r := range results.Results {
+		objects[r.Name] = r.Attrs
+	}
+	return objects, nil
+}
+
+// Uses a POST overridden to GET, so the filter is sent in the body.
+func (i *IcingaWebClient) ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error) {
+	var results icingaResults
+	var ierr icingaError
+	payload := map[string]interface{}{
+		"attrs":       attrs,
+		"filter":      strings.ToLower(typ) + ".vars." + RANCHER_INSTALLATION + " == installation",
+		"filter_vars": map[string]interface{}{"installation": installation}}
+
+	err := i.retry.do("list "+icingaPath(typ), func() error {
+		resp, err := i.napping.Send(&napping.Request{
+			Url:     i.url + "/v1/objects/" + icingaPath(typ),
+			Method:  "POST",
+			Header:  &http.Header{"X-HTTP-Method-Override": []string{"GET"}},
+			Payload: payload,
+			Result:  &results,
+			Error:   &ierr})
+		return i.checkResponse(resp, err, ierr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]IcingaAttrs, len(results.Results))
+	for _, r := range results.Results {
+		objects[r.Name] = r.Attrs
+	}
+	return objects, nil
+}
+
+// Returns nil if the object does not exist.
+func (i *IcingaWebClient) GetObject(typ, name string, attrs []string) (IcingaAttrs, error) {
+	var results icingaResults
+	var ierr icingaError
+	params := url.Values{}
+	for _, a := range attrs {
+		params.Add("attrs", a)
+	}
+
+	err := i.retry.do("get "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := i.napping.Get(i.url+"/v1/objects/"+icingaPath(typ)+"/"+url.PathEscape(name), &params, &results, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil || len(results.Results) == 0 {
+		return nil, err
+	}
+	return results.Results[0].Attrs, nil
+}
+
+func (i *IcingaWebClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	var ierr icingaError
+
+	return i.retry.do("update "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := i.napping.Post(i.url+"/v1/objects/"+icingaPath(typ)+"/"+url.PathEscape(name),
+			map[string]interface{}{"attrs": attrs}, nil, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+}
+
+func (i *IcingaWebClient) DeleteObject(typ, name string) error {
+	var ierr icingaError
+
+	return i.retry.do("delete "+strings.ToLower(typ)+" "+name, func() error {
+		resp, err := i.napping.Delete(i.url+"/v1/objects/"+icingaPath(typ)+"/"+url.PathEscape(name),
+			&url.Values{"cascade": []string{"1"}}, nil, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+}
+
+func (i *IcingaWebClient) PerformAction(action string, params IcingaAttrs) error {
+	var ierr icingaError
+
+	return i.retry.do("perform "+action, func() error {
+		resp, err := i.napping.Post(i.url+"/v1/actions/"+action, params, nil, &ierr)
+		return i.checkResponse(resp, err, ierr)
+	})
+}
+
+// The hosts, services and host groups are listed and written like other objects, so errors can be told apart by
+// status and the requests are retried.
+
+func (i *IcingaWebClient) ListHosts() ([]icinga2.Host, error) {
+	objects, err := i.ListObjects("Host", ownedAttrs["Host"])
+	if err != nil {
+		return nil, err
+	}
+	hosts := []icinga2.Host{}
+	for name, attrs := range objects {
+		hosts = append(hosts, hostOfAttrs(name, attrs))
+	}
+	return hosts, nil
+}
+
+func (i *IcingaWebClient) CreateHost(h icinga2.Host) error {
+	return i.CreateObject("Host", h.Name, nil, attrsForHost(h))
+}
+
+func (i *IcingaWebClient) DeleteHost(name string) error {
+	return i.DeleteObject("Host", name)
+}
+
+func (i *IcingaWebClient) UpdateHost(h icinga2.Host) error {
+	return i.UpdateObject("Host", h.Name, IcingaAttrs{
+		"address":       h.Address,
+		"check_command": h.CheckCommand,
+		"notes_url":     h.NotesURL,
+		"groups":        h.Groups,
+		"vars":          h.Vars})
+}
+
+func (i *IcingaWebClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	attrs := IcingaAttrs{"vars": hg.Vars}
+	if hg.DisplayName != "" {
+		attrs["display_name"] = hg.DisplayName
+	}
+	return i.CreateObject("HostGroup", hg.Name, nil, attrs)
+}
+
+func (i *IcingaWebClient) ListHostGroups() ([]icinga2.HostGroup, error) {
+	objects, err := i.ListObjects("HostGroup", ownedAttrs["HostGroup"])
+	if err != nil {
+		return nil, err
+	}
+	hostGroups := []icinga2.HostGroup{}
+	for name, attrs := range objects {
+		hostGroups = append(hostGroups, hostGroupOfAttrs(name, attrs))
+	}
+	return hostGroups, nil
+}
+
+func (i *IcingaWebClient) DeleteHostGroup(name string) error {
+	return i.DeleteObject("HostGroup", name)
+}
+
+func (i *IcingaWebClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	return i.UpdateObject("HostGroup", hg.Name, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars})
+}
+
+func (i *IcingaWebClient) CreateService(s icinga2.Service) error {
+	return i.CreateObject("Service", s.HostName+"!"+s.Name, nil, attrsForService(s))
+}
+
+func (i *IcingaWebClient) ListServices() ([]icinga2.Service, error) {
+	objects, err := i.ListObjects("Service", ownedAttrs["Service"])
+	if err != nil {
+		return nil, err
+	}
+	services := []icinga2.Service{}
+	for name, attrs := range objects {
+		services = append(services, serviceOfAttrs(name, attrs))
+	}
+	return services, nil
+}
+
+func (i *IcingaWebClient) DeleteService(name string) error {
+	return i.DeleteObject("Service", name)
+}
+
+func (i *IcingaWebClient) UpdateService(s icinga2.Service) error {
+	return i.UpdateObject("Service", s.HostName+"!"+s.Name, IcingaAttrs{
+		"check_command": s.CheckCommand,
+		"notes_url":     s.NotesURL,
+		"vars":          s.Vars})
+}
+
+// Requests are independent, so writes can be made concurrently.
+func (i *IcingaWebClient) ConcurrentWrites() bool {
+	return true
+}
+
+// Objects are created by the API immediately.
+func (i *IcingaWebClient) Commit() error {
+	return nil
+}
+
+func (i *IcingaWebClient) checkResponse(resp *napping.Response, err error, ierr icingaError) error {
+	if err != nil {
+		return err
+	}
+	if resp.HttpResponse().StatusCode >= 400 {
+		return &apiError{resp.HttpResponse().StatusCode, resp.HttpResponse().Status, ierr.Status}
+	}
+	return nil
+}
+
+// ---------
+
+// Hosts, services and host groups are also created in the wrapped mock client so they show up in ListHosts,
+// ListServices and ListHostGroups.
+func (i *IcingaMockClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	if _, ok := i.objects[typ][name]; ok {
+		return fmt.Errorf("object %s %s already exists", typ, name)
+	}
+
+	switch typ {
+	case "Service":
+		s := icinga2.Service{Name: name[strings.LastIndex(name, "!")+1:]}
+		s.HostName, _ = attrs["host_name"].(string)
+		s.CheckCommand, _ = attrs["check_command"].(string)
+		s.NotesURL, _ = attrs["notes_url"].(string)
+		s.Zone, _ = attrs["zone"].(string)
+		s.Vars, _ = attrs["vars"].(icinga2.Vars)
+		if err := i.Client.CreateService(s); err != nil {
+			return err
+		}
+	case "Host":
+		h := icinga2.Host{Name: name}
+		h.Address, _ = attrs["address"].(string)
+		h.CheckCommand, _ = attrs["check_command"].(string)
+		h.NotesURL, _ = attrs["notes_url"].(string)
+		h.Groups, _ = attrs["groups"].([]string)
+		h.Zone, _ = attrs["zone"].(string)
+		h.Vars, _ = attrs["vars"].(icinga2.Vars)
+		if err := i.Client.CreateHost(h); err != nil {
+			return err
+		}
+	case "HostGroup":
+		hg := icinga2.HostGroup{Name: name}
+		hg.Vars, _ = attrs["vars"].(icinga2.Vars)
+		if err := i.Client.CreateHostGroup(hg); err != nil {
+			return err
+		}
+	}
+
+	if i.objects[typ] == nil {
+		i.objects[typ] = make(map[string]IcingaAttrs)
+	}
+
+	stored := make(IcingaAttrs)
+	for k, v := range attrs {
+		stored[k] = v
+	}
+	short := name[strings.LastIndex(name, "!")+1:]
+	stored["templates"] = []interface{}{short}
+	for _, t := range templates {
+		stored["templates"] = append(stored["templates"].([]interface{}), t)
+	}
+	i.objects[typ][name] = stored
+
+	return nil
+}
+
+func (i *IcingaMockClient) ListObjects(typ string, attrs []string) (map[string]IcingaAttrs, error) {
+	objects := make(map[string]IcingaAttrs)
+	for name, o := range i.objects[typ] {
+		objects[name] = make(IcingaAttrs)
+		for _, a := range attrs {
+			if v, ok := o[a]; ok {
+				objects[name][a] = v
+			}
+		}
+	}
+	return objects, nil
+}
+
+// Lists the hosts, services and host groups created with CreateObject and the ones created with CreateHost,
+// CreateService and CreateHostGroup.
+func (i *IcingaMockClient) ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error) {
+	objects := make(map[string]IcingaAttrs)
+
+	switch typ {
+	case "Host":
+		hosts, _ := i.Client.ListHosts()
+		for _, h := range hosts {
+			objects[h.Name] = attrsForHost(h)
+		}
+	case "Service":
+		services, _ := i.Client.ListServices()
+		for _, s := range services {
+			objects[s.HostName+"!"+s.Name] = attrsForService(s)
+		}
+	case "HostGroup":
+		hostGroups, _ := i.Client.ListHostGroups()
+		for _, hg := range hostGroups {
+			objects[hg.Name] = IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars}
+		}
+	}
+	for name, o := range i.objects[typ] {
+		objects[name] = mergeAttrs(objects[name], o)
+	}
+
+	return filterOwned(objects, installation, attrs), nil
+}
+
+func (i *IcingaMockClient) GetObject(typ, name string, attrs []string) (IcingaAttrs, error) {
+	o, ok := i.objects[typ][name]
+	if !ok {
+		return nil, nil
+	}
+	return o.only(attrs), nil
+}
+
+func (i *IcingaMockClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	o, ok := i.objects[typ][name]
+	if !ok {
+		if typ != "Host" && typ != "Service" && typ != "HostGroup" {
+			return fmt.Errorf("object %s %s does not exist", typ, name)
+		}
+		// a host, service or host group created with CreateHost, CreateService or CreateHostGroup
+		o = IcingaAttrs{"templates": []interface{}{name[strings.LastIndex(name, "!")+1:]}}
+		if i.objects[typ] == nil {
+			i.objects[typ] = make(map[string]IcingaAttrs)
+		}
+		i.objects[typ][name] = o
+	}
+	for k, v := range attrs {
+		o[k] = v
+	}
+	return nil
+}
+
+func (i *IcingaMockClient) DeleteObject(typ, name string) error {
+	delete(i.objects[typ], name)
+	switch typ {
+	case "Service":
+		return i.DeleteService(name)
+	case "Host":
+		return i.DeleteHost(name)
+	case "HostGroup":
+		return i.DeleteHostGroup(name)
+	}
+	return nil
+}
+
+// The updates are also made to the attributes of objects created with CreateObject.
+func (i *IcingaMockClient) UpdateHost(h icinga2.Host) error {
+	if o, ok := i.objects["Host"][h.Name]; ok {
+		for k, v := range attrsForHost(h) {
+			o[k] = v
+		}
+	}
+	return i.Client.UpdateHost(h)
+}
+
+func (i *IcingaMockClient) UpdateService(s icinga2.Service) error {
+	if o, ok := i.objects["Service"][s.HostName+"!"+s.Name]; ok {
+		for k, v := range attrsForService(s) {
+			o[k] = v
+		}
+	}
+	return i.Client.UpdateService(s)
+}
+
+func (i *IcingaMockClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	if o, ok := i.objects["HostGroup"][hg.Name]; ok {
+		o["display_name"], o["vars"] = hg.DisplayName, hg.Vars
+	}
+	return i.Client.UpdateHostGroup(hg)
+}
+
+func (i *IcingaMockClient) DeleteHostGroup(name string) error {
+	delete(i.objects["HostGroup"], name)
+	return i.Client.DeleteHostGroup(name)
+}
+
+func (i *IcingaMockClient) DeleteService(name string) error {
+	delete(i.objects["Service"], name)
+	return i.Client.DeleteService(name)
+}
+
+// Only supports scheduling downtimes for a single host or service (without all_services or child_options),
+// removing downtimes by name and submitting check results, which are kept in checkResults.
+func (i *IcingaMockClient) PerformAction(action string, params IcingaAttrs) error {
+	switch action {
+	case "schedule-downtime":
+		object, _ := params["host"].(string)
+		if params["type"] == "Service" {
+			object, _ = params["service"].(string)
+		}
+		if object == "" {
+			return fmt.Errorf("no object for %s", action)
+		}
+
+		i.downtimes++
+		name := fmt.Sprintf("%s!rancher-icinga-%d", object, i.downtimes)
+		attrs := IcingaAttrs{"host_name": object, "service_name": ""}
+		if n := strings.Index(object, "!"); n >= 0 {
+			attrs["host_name"], attrs["service_name"] = object[:n], object[n+1:]
+		}
+		for _, a := range []string{"author", "comment", "start_time", "end_time", "fixed", "child_options"} {
+			attrs[a] = params[a]
+		}
+		return i.CreateObject("Downtime", name, nil, attrs)
+
+	case "process-check-result":
+		object, _ := params["host"].(string)
+		if params["type"] == "Service" {
+			object, _ = params["service"].(string)
+		}
+		if object == "" {
+			return fmt.Errorf("no object for %s", action)
+		}
+
+		if i.checkResults == nil {
+			i.checkResults = make(map[string]IcingaAttrs)
+		}
+		i.checkResults[object] = params
+		return nil
+
+	case "remove-downtime":
+		name, _ := params["downtime"].(string)
+		if _, ok := i.objects["Downtime"][name]; !ok {
+			return fmt.Errorf("downtime %s does not exist", name)
+		}
+		return i.DeleteObject("Downtime", name)
+	}
+
+	return fmt.Errorf("action %s is not supported by the mock client", action)
+}
+
+func (i *IcingaMockClient) Commit() error {
+	return nil
+}
+
+// Like a cascading delete in Icinga2, this also removes the services and dependencies of the host and the
+// dependencies on it.
+func (i *IcingaMockClient) DeleteHost(name string) error {
+	delete(i.objects["Host"], name)
+	for _, objects := range i.objects {
+		for o, attrs := range objects {
+			if strings.HasPrefix(o, name+"!") || attrs["parent_host_name"] == name {
+				delete(objects, o)
+			}
+		}
+	}
+	return i.Client.DeleteHost(name)
+}
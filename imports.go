@@ -0,0 +1,140 @@
+// Icinga2 templates imported by the generated host groups, hosts and services, so settings like intervals
+// and notifications can be set in templates instead of apply rules.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+const TEMPLATES_LABEL = "icinga.templates"
+
+// Reads the templates for each object type from the environment, like HOST_TEMPLATES=generic-host,rancher-host.
+func makeImportsConfig(cc *RancherIcingaConfig) {
+	for env, imports := range map[string]*[]string{
+		"HOSTGROUP_TEMPLATES":     &cc.hostgroupImports,
+		"HOST_TEMPLATES":          &cc.hostImports,
+		"STACK_TEMPLATES":         &cc.stackImports,
+		"SERVICE_TEMPLATES":       &cc.serviceImports,
+		"AGENT_SERVICE_TEMPLATES": &cc.agentServiceImports,
+	} {
+		*imports = templateList(os.Getenv(env))
+	}
+}
+
+// Parses a comma separated list of templates.
+func templateList(s string) []string {
+	templates := []string{}
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			templates = append(templates, t)
+		}
+	}
+	return templates
+}
+
+// The templates for an object: the ones configured for its type, followed by the ones from its labels.
+func importsFor(global []string, labels map[string]interface{}) []string {
+	imports := append([]string{}, global...)
+	if l, ok := labels[TEMPLATES_LABEL].(string); ok {
+		for _, t := range templateList(l) {
+			if !containsStrings(imports, []string{t}) {
+				imports = append(imports, t)
+			}
+		}
+	}
+	return imports
+}
+
+// Icinga2 cannot change the imports of an object, so an object with other imports than configured is
+// deleted and then created again. Returns true if the object was deleted.
+func recreateForImports(config *RancherIcingaConfig, typ, name string, attrs IcingaAttrs, imports []string) bool {
+	if importsMatch(name, attrs, imports) {
+		return false
+	}
+
+	debugLog("Recreating "+typ+" "+name+" with templates "+strings.Join(imports, ","), 1)
+	err := config.icinga.DeleteObject(typ, name)
+	if err != nil {
+		fmt.Printf("ERROR: could not delete %s %s: %s\n", strings.ToLower(typ), name, err)
+		return false
+	}
+	config.registerChange("delete", name, strings.ToLower(typ), icinga2.Vars{}, attrs)
+
+	return true
+}
+
+// Whether an object imports the templates, in order. Icinga2 lists the templates the imported ones import after
+// them, so other templates are only allowed after the first import: a template imported before it or by an object
+// that should import none was removed from the configuration.
+func importsMatch(name string, attrs IcingaAttrs, imports []string) bool {
+	listed := importsOf(name, attrs)
+	if len(imports) == 0 || len(listed) == 0 || listed[0] != imports[0] {
+		return len(imports) == 0 && len(listed) == 0
+	}
+
+	i := 0
+	for _, t := range listed {
+		if i < len(imports) && t == imports[i] {
+			i++
+		}
+	}
+	return i == len(imports)
+}
+
+// The API attributes of the properties an icinga2.Host has.
+func attrsForHost(h icinga2.Host) IcingaAttrs {
+	attrs := IcingaAttrs{
+		"check_command": h.CheckCommand,
+		"groups":        h.Groups,
+		"vars":          h.Vars}
+	if h.Address != "" {
+		attrs["address"] = h.Address
+	}
+	if h.NotesURL != "" {
+		attrs["notes_url"] = h.NotesURL
+	}
+	if h.Zone != "" {
+		attrs["zone"] = h.Zone
+	}
+	return attrs
+}
+
+// Creates a host, with templates and a zone if there are any.
+func createHost(config *RancherIcingaConfig, h icinga2.Host, imports []string) error {
+	if len(imports) == 0 && h.Zone == "" {
+		return config.icinga.CreateHost(h)
+	}
+	return config.icinga.CreateObject("Host", h.Name, imports, attrsForHost(h))
+}
+
+// Creates a service, with templates, a zone and other attributes like groups if there are any.
+func createService(config *RancherIcingaConfig, s icinga2.Service, imports []string, extra IcingaAttrs) error {
+	if len(imports) == 0 && len(extra) == 0 && s.Zone == "" {
+		return config.icinga.CreateService(s)
+	}
+	return config.icinga.CreateObject("Service", s.HostName+"!"+s.Name, imports, mergeAttrs(attrsForService(s), extra))
+}
+
+// Creates a host group, with templates if there are any.
+func createHostGroup(config *RancherIcingaConfig, hg icinga2.HostGroup, imports []string) error {
+	if len(imports) == 0 {
+		return config.icinga.CreateHostGroup(hg)
+	}
+	return config.icinga.CreateObject("HostGroup", hg.Name, imports, IcingaAttrs{"vars": hg.Vars})
+}
+
+// The services without the ones on a host, after the host was deleted.
+func servicesNotOn(services []icinga2.Service, hostname string) []icinga2.Service {
+	res := []icinga2.Service{}
+	for _, s := range services {
+		if s.HostName != hostname {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+// A panic while syncing a single Rancher or Icinga2 object, like a name template failing for it or malformed Rancher
+// data, only skips that object, the others are still synced. A panic anywhere else ends the sync, but not the loop in
+// REFRESH_INTERVAL mode.
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"github.com/rancher/go-rancher/v2"
+)
+
+// Syncs an object, like "stack Default/web", and recovers from a panic. The first panic of an object in a sync is
+// logged and reported by the configuration check of the Icinga2 host returned by configCheck, if there is one.
+// Returns false if the sync panicked.
+func isolate(config *RancherIcingaConfig, object string, configCheck func() (string, icinga2.Vars), sync func()) (ok bool) {
+	// a stopped sync skips the remaining objects
+	if config.canceled() {
+		return false
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		ok = false
+
+		if config.failedObjects[object] {
+			return
+		}
+		if config.failedObjects == nil {
+			config.failedObjects = make(map[string]bool)
+		}
+		config.failedObjects[object] = true
+
+		message := fmt.Sprintf("could not sync %s: %v", object, r)
+		fmt.Printf("ERROR: %s\n", message)
+		debugLog(string(debug.Stack()), 1)
+
+		if configCheck != nil {
+			reportPanic(config, configCheck, message)
+		}
+	}()
+
+	sync()
+	return true
+}
+
+// Reports a panic by the configuration check. Finding the Icinga2 host can panic for the same reason.
+func reportPanic(config *RancherIcingaConfig, configCheck func() (string, icinga2.Vars), message string) {
+	defer func() { recover() }()
+
+	if hostname, vars := configCheck(); hostname != "" {
+		config.recordConfigError(hostname, vars, message)
+	}
+}
+
+func isolateEnvironment(config *RancherIcingaConfig, env client.Project, sync func()) bool {
+	return isolate(config, "environment "+env.Name, nil, sync)
+}
+
+func isolateHost(config *RancherIcingaConfig, rh client.Host, sync func()) bool {
+	return isolate(config, "host "+rh.Hostname, func() (string, icinga2.Vars) {
+		environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
+		return rh.Hostname, varsForConfigCheck(config, environmentName, "", rh.Hostname)
+	}, sync)
+}
+
+func isolateStack(config *RancherIcingaConfig, s client.Stack, sync func()) bool {
+	environmentName := lookupName(s.AccountId, func() string { return config.rancher.GetEnvironment(s.AccountId).Name })
+	return isolate(config, "stack "+environmentName+"/"+s.Name, func() (string, icinga2.Vars) {
+		environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+		return execTemplate(config.stackNameTemplate, "", environmentName, s.Name, ""),
+			varsForConfigCheck(config, environmentName, s.Name, "")
+	}, sync)
+}
+
+func isolateService(config *RancherIcingaConfig, rs client.Service, sync func()) bool {
+	environmentName := lookupName(rs.AccountId, func() string { return config.rancher.GetEnvironment(rs.AccountId).Name })
+	stackName := lookupName(rs.StackId, func() string { return config.rancher.GetStack(rs.StackId).Name })
+	return isolate(config, "service "+environmentName+"/"+stackName+"/"+rs.Name, func() (string, icinga2.Vars) {
+		environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
+		stackName := config.rancher.GetStack(rs.StackId).Name
+		return execTemplate(config.stackNameTemplate, "", environmentName, stackName, rs.Name),
+			varsForConfigCheck(config, environmentName, stackName, "")
+	}, sync)
+}
+
+// The name of an environment or stack for the logs, or its ID if looking it up panics. The sync of the object
+// usually panics for the same reason then, which isolate recovers from.
+func lookupName(id string, lookup func() string) (name string) {
+	defer func() {
+		if recover() != nil {
+			name = id
+		}
+	}()
+	return lookup()
+}
+
+// Whether the sync of an object panicked or was skipped because the sync is stopping. Host groups, service groups,
+// dependencies and downtimes are not removed then, they may belong to the failed objects.
+func (config *RancherIcingaConfig) objectsFailed() bool {
+	return len(config.failedObjects) > 0 || config.canceled()
+}
+
+// For the phases removing Icinga2 objects. An object whose sync panicked is kept.
+func isolateIcingaObject(config *RancherIcingaConfig, typ, name string, sync func()) bool {
+	return isolate(config, "icinga "+typ+" "+name, nil, sync)
+}
+
+// Runs a sync, recovering from a panic.
+func syncIsolated(config *RancherIcingaConfig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			debugLog(string(debug.Stack()), 1)
+			err = fmt.Errorf("sync failed: %v", r)
+		}
+	}()
+
+	return sync(config)
+}
@@ -0,0 +1,116 @@
+// Checks for the port rules of Rancher load balancers, so a broken route to a backend shows up as its own
+// Icinga2 service.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/go-rancher/v2"
+)
+
+const LOAD_BALANCER_KIND = "loadBalancerService"
+
+// Generates a check for every published port rule of a load balancer, against the source port on the address of a
+// host running the balancer. HTTP and HTTPS rules get an http check with the rule's hostname and path, TCP rules a
+// tcp check. Rules with a selector instead of a target service, UDP rules and rules whose source port is not
+// published are not checked. Like auto checks, the checks are expanded as custom check templates. The notes URL
+// links to the target service in Rancher.
+func loadBalancerChecksOf(rancher RancherGenClient, service client.Service) ([]CustomCheck, error) {
+	checks := []CustomCheck{}
+
+	lb, err := rancher.GetLoadBalancer(service.Id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the port rules of load balancer %s: %s", service.Name, err)
+	}
+	if lb.LbConfig == nil {
+		return checks, nil
+	}
+
+	published := make(map[int64]bool)
+	if service.LaunchConfig != nil {
+		for _, p := range service.LaunchConfig.Ports {
+			if port, err := parsePort(p); err == nil && port.PublicPort != 0 {
+				published[int64(port.PublicPort)] = true
+			}
+		}
+	}
+
+	for _, rule := range lb.LbConfig.PortRules {
+		if rule.ServiceId == "" || !published[rule.SourcePort] {
+			continue
+		}
+
+		target := rancher.GetService(rule.ServiceId)
+		targetStack := rancher.GetStack(target.StackId).Name
+
+		check := CustomCheck{
+			Name:        loadBalancerCheckName(service.Name, rule),
+			DisplayName: fmt.Sprintf("%s %s -> %s/%s", service.Name, loadBalancerRuleString(rule), targetStack, target.Name),
+			NotesURL:    rancherServiceURL(target),
+			Vars: map[string]interface{}{
+				"lb_target_stack":   targetStack,
+				"lb_target_service": target.Name}}
+
+		switch rule.Protocol {
+		case "http", "https", "sni":
+			check.Command = "http"
+			check.Vars["http_address"] = "{{.HostAddress}}"
+			check.Vars["http_port"] = strconv.FormatInt(rule.SourcePort, 10)
+			check.Vars["http_uri"] = "/"
+			if rule.Path != "" {
+				check.Vars["http_uri"] = rule.Path
+			}
+			if rule.Hostname != "" && !strings.Contains(rule.Hostname, "*") {
+				check.Vars["http_vhost"] = rule.Hostname
+			}
+			if rule.Protocol != "http" {
+				check.Vars["http_ssl"] = "true"
+			}
+		case "tcp", "tls":
+			check.Command = "tcp"
+			check.Vars["tcp_address"] = "{{.HostAddress}}"
+			check.Vars["tcp_port"] = strconv.FormatInt(rule.SourcePort, 10)
+		default:
+			continue
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// The name of the check for a port rule, like "lb-http-80-www.example.com-api".
+func loadBalancerCheckName(lb string, rule client.PortRule) string {
+	name := fmt.Sprintf("%s-%s-%d", lb, rule.Protocol, rule.SourcePort)
+	if rule.Hostname != "" {
+		name += "-" + strings.Replace(rule.Hostname, "*", "any", -1)
+	}
+	if path := strings.Trim(rule.Path, "/"); path != "" {
+		name += "-" + strings.Replace(path, "/", "-", -1)
+	}
+	return name
+}
+
+// A port rule as in the Rancher UI, like "www.example.com:80/api".
+func loadBalancerRuleString(rule client.PortRule) string {
+	return fmt.Sprintf("%s:%d%s", rule.Hostname, rule.SourcePort, rule.Path)
+}
+
+// The API version at the end of RANCHER_URL, like /v2-beta or /v2-beta/projects/1a5.
+var rancherAPIPathRegexp = regexp.MustCompile("/v[0-9][a-z0-9-]*(/.*)?$")
+
+// The page of a service in the Rancher UI, like http://rancher:8080/env/1a5/apps/stacks/1st5/services/1s10, or
+// "" without RANCHER_URL.
+func rancherServiceURL(service client.Service) string {
+	base := rancherAPIPathRegexp.ReplaceAllString(strings.TrimSuffix(os.Getenv("RANCHER_URL"), "/"), "")
+	if base == "" || service.Id == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/env/%s/apps/stacks/%s/services/%s", base, service.AccountId, service.StackId, service.Id)
+}
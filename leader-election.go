@@ -0,0 +1,263 @@
+// Leader election, so rancher-icinga can run with several replicas for the same RANCHER_INSTALLATION. Only the
+// instance holding the leader lock syncs, the others stand by and take over once the lock is free.
+//
+// With LEADER_ELECTION=icinga the lock is an Icinga2 host with the leader and the end of its lease in its vars. The
+// leader renews the lease before every sync and after every phase of it, a standby takes over when the lease has
+// expired. A leader that could not renew its lease abandons the sync without making its writes. The Icinga2 API cannot
+// update an object conditionally, so an instance taking over an expired lock waits and reads the lock again: of
+// several instances taking it over at the same time only the one that wrote last becomes the leader. The clocks of
+// the instances must be synchronized.
+//
+// With LEADER_ELECTION=file the lock is a lock on LEADER_LOCK_FILE, for instances on the same host or sharing a
+// volume supporting locks. It is held until the leader exits, a standby takes over immediately then.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// The vars of the Icinga2 host used as a leader lock.
+const (
+	LEADER_ID          = "rancher_leader"
+	LEADER_LEASE_UNTIL = "rancher_leader_until"
+)
+
+type leaderLock interface {
+	// Takes or renews the lock. Returns false if another instance holds it.
+	acquire() (bool, error)
+	// Frees the lock for another instance if it is held.
+	release() error
+}
+
+// The Icinga2 objects used by a lock in Icinga2.
+type lockStore interface {
+	GetObject(typ, name string, attrs []string) (IcingaAttrs, error)
+	CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error
+	UpdateObject(typ, name string, attrs IcingaAttrs) error
+}
+
+type icingaLock struct {
+	api          lockStore
+	host         string
+	id           string
+	installation string
+	lease        time.Duration
+	settle       time.Duration // between taking over the lock and reading it again
+}
+
+type fileLock struct {
+	path string
+	id   string
+	file *os.File // while the lock is held
+}
+
+// Reads the leader election settings from the environment. The lock itself is created by newLeaderLock.
+func makeLeaderConfig(cc *RancherIcingaConfig) (err error) {
+	cc.leaderElection = os.Getenv("LEADER_ELECTION")
+	switch cc.leaderElection {
+	case "", "icinga":
+	case "file":
+		if cc.leaderLockFile = os.Getenv("LEADER_LOCK_FILE"); cc.leaderLockFile == "" {
+			return fmt.Errorf("LEADER_LOCK_FILE must be set for LEADER_ELECTION=file")
+		}
+	default:
+		return fmt.Errorf("error parsing LEADER_ELECTION: %q is neither icinga nor file", cc.leaderElection)
+	}
+
+	// long enough for a sync and the wait before the next one
+	cc.leaderLease = 3 * time.Duration(cc.refreshInterval) * time.Second
+	if cc.leaderLease < time.Minute {
+		cc.leaderLease = time.Minute
+	}
+	if c := os.Getenv("LEADER_LEASE"); c != "" {
+		if cc.leaderLease, err = time.ParseDuration(c); err != nil {
+			return fmt.Errorf("error parsing LEADER_LEASE: %s", err)
+		}
+	}
+
+	if cc.leaderID = os.Getenv("LEADER_ID"); cc.leaderID == "" {
+		// the container ID in Docker
+		if cc.leaderID, err = os.Hostname(); err != nil {
+			return fmt.Errorf("error getting the hostname for LEADER_ID: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// The lock for the leader election settings, or nil if leader election is disabled. The lock in Icinga2 needs the
+// Icinga2 API, also with the other backends, as objects in the Director or in configuration files are not
+// applied immediately.
+func newLeaderLock(cc *RancherIcingaConfig, api lockStore) (leaderLock, error) {
+	switch cc.leaderElection {
+	case "icinga":
+		if api == nil {
+			return nil, fmt.Errorf("ICINGA_URL must be set for LEADER_ELECTION=icinga")
+		}
+		return &icingaLock{
+			api:          api,
+			host:         "rancher-icinga-leader-" + cc.rancherInstallation,
+			id:           cc.leaderID,
+			installation: cc.rancherInstallation,
+			lease:        cc.leaderLease,
+			settle:       2 * time.Second}, nil
+	case "file":
+		return &fileLock{path: cc.leaderLockFile, id: cc.leaderID}, nil
+	}
+	return nil, nil
+}
+
+// The settings the leader lock was created with. A reloaded configuration keeps the lock if they did not change.
+func (config *RancherIcingaConfig) leaderSettings() string {
+	return fmt.Sprintf("%s %s %s %s", config.leaderElection, config.leaderLockFile, config.leaderLease, config.leaderID)
+}
+
+// Syncs if this instance is the leader, or if leader election is disabled.
+func syncAsLeader(config *RancherIcingaConfig) error {
+	if config.leaderLock == nil {
+		return syncIsolated(config)
+	}
+
+	leader, err := config.leaderLock.acquire()
+	if err != nil {
+		return fmt.Errorf("could not acquire the leader lock, not syncing: %s", err)
+	}
+	if !leader {
+		fmt.Println("Another instance is the leader, standing by")
+		return nil
+	}
+
+	return syncIsolated(config)
+}
+
+// Renews the leader lock during a sync. Returns an error if this instance may not be the leader anymore.
+func (config *RancherIcingaConfig) renewLeaderLock() error {
+	if config.leaderLock == nil {
+		return nil
+	}
+
+	leader, err := config.leaderLock.acquire()
+	if err != nil {
+		return fmt.Errorf("could not renew the leader lock, abandoning the sync: %s", err)
+	}
+	if !leader {
+		return fmt.Errorf("another instance became the leader, abandoning the sync")
+	}
+	return nil
+}
+
+func (l *icingaLock) acquire() (bool, error) {
+	attrs, err := l.api.GetObject("Host", l.host, []string{"vars"})
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if attrs == nil {
+		debugLog("Creating leader lock "+l.host, 1)
+		err = l.api.CreateObject("Host", l.host, nil, IcingaAttrs{
+			"check_command": "dummy",
+			"vars":          l.vars(now.Add(l.lease))})
+	} else {
+		holder, until := lockHolder(varsOf(attrs))
+		if holder != l.id && now.Before(until) {
+			debugLog(fmt.Sprintf("Leader lock held by %s until %s", holder, until), 1)
+			return false, nil
+		}
+
+		err = l.api.UpdateObject("Host", l.host, IcingaAttrs{"vars": l.vars(now.Add(l.lease))})
+		// no other instance can take over a lease that did not expire
+		if holder == l.id && now.Before(until) {
+			return err == nil, err
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	time.Sleep(l.settle)
+
+	attrs, err = l.api.GetObject("Host", l.host, []string{"vars"})
+	if err != nil {
+		return false, err
+	}
+	holder, _ := lockHolder(varsOf(attrs))
+	if holder == l.id {
+		fmt.Printf("Became the leader for installation %s\n", l.installation)
+	}
+	return holder == l.id, nil
+}
+
+func (l *icingaLock) release() error {
+	attrs, err := l.api.GetObject("Host", l.host, []string{"vars"})
+	if err != nil || attrs == nil {
+		return err
+	}
+	if holder, _ := lockHolder(varsOf(attrs)); holder != l.id {
+		return nil
+	}
+
+	return l.api.UpdateObject("Host", l.host, IcingaAttrs{"vars": l.vars(time.Unix(0, 0))})
+}
+
+// The vars of the lock held by this instance until the given time.
+func (l *icingaLock) vars(until time.Time) icinga2.Vars {
+	return icinga2.Vars{
+		RANCHER_INSTALLATION: l.installation,
+		RANCHER_OBJECT_TYPE:  "leader-lock",
+		LEADER_ID:            l.id,
+		LEADER_LEASE_UNTIL:   until.Unix(),
+		"dummy_text":         fmt.Sprintf("%s is the leader until %s", l.id, until.Format(time.RFC3339))}
+}
+
+// The leader and the end of its lease in the vars of the lock.
+func lockHolder(vars icinga2.Vars) (holder string, until time.Time) {
+	holder, _ = vars[LEADER_ID].(string)
+	if until, ok := unixTime(vars[LEADER_LEASE_UNTIL]); ok {
+		return holder, until
+	}
+	return holder, time.Unix(0, 0)
+}
+
+func (l *fileLock) acquire() (bool, error) {
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// for information only, the lock is what counts
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(l.id+"\n"), 0)
+	}
+
+	l.file = file
+	fmt.Printf("Became the leader with lock file %s\n", l.path)
+	return true, nil
+}
+
+func (l *fileLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
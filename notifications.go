@@ -0,0 +1,79 @@
+// The users and user groups to notify for a Rancher object, declared with labels and passed to the Icinga2
+// notification apply rules in vars.notification.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+const (
+	NOTIFY_USERS_LABEL  = "icinga.notify_users"
+	NOTIFY_GROUPS_LABEL = "icinga.notify_groups"
+)
+
+// The vars for the notification labels, like {"notification": {"mail": {"users": ["alice"]}}}, or nil if none
+// are set. This is the structure the notification apply rules of the Icinga2 sample configuration use.
+func notificationVars(config *RancherIcingaConfig, labels map[string]interface{}) icinga2.Vars {
+	users := notificationLabel(labels, NOTIFY_USERS_LABEL)
+	groups := notificationLabel(labels, NOTIFY_GROUPS_LABEL)
+
+	if len(users) == 0 && len(groups) == 0 {
+		return nil
+	}
+
+	notification := make(map[string]interface{})
+	if len(users) > 0 {
+		notification["users"] = users
+	}
+	if len(groups) > 0 {
+		notification["groups"] = groups
+	}
+
+	return icinga2.Vars{"notification": map[string]interface{}{config.notificationType: notification}}
+}
+
+// The comma separated list in a notification label.
+func notificationLabel(labels map[string]interface{}, label string) []string {
+	l, _ := labels[label].(string)
+	return templateList(l)
+}
+
+// The labels of a stack configuration, which are strings.
+func stackLabels(sc StackConfig) map[string]interface{} {
+	labels := make(map[string]interface{}, len(sc.Labels))
+	for k, v := range sc.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Checks that the users and user groups in the notification labels exist in Icinga2.
+func validateNotifications(config *RancherIcingaConfig, labels map[string]interface{}) []string {
+	problems := []string{}
+
+	for _, n := range []struct{ label, typ, what string }{
+		{NOTIFY_USERS_LABEL, "User", "user"},
+		{NOTIFY_GROUPS_LABEL, "UserGroup", "user group"},
+	} {
+		names := notificationLabel(labels, n.label)
+		if len(names) == 0 {
+			continue
+		}
+		existing, ok := listObjectsOnce(config, n.typ)
+		if !ok {
+			continue
+		}
+		for _, name := range names {
+			if _, ok := existing[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s %s in %s does not exist", n.what, name, n.label))
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,344 @@
+// The hosts, services and host groups of the Rancher installation are listed once per sync, filtered by the
+// Icinga2 API, and shared by all phases of the sync. With many objects in Icinga2, listing all of them in every
+// phase only to discard most of them is slow.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// The attributes listed for the object types shared in a sync, which are all the attributes the sync uses.
+var ownedAttrs = map[string][]string{
+	"Host": {"address", "check_command", "notes_url", "groups", "vars", "zone", "templates", "enable_active_checks",
+		"check_interval"},
+	"Service": append([]string{"host_name", "check_command", "notes_url", "vars", "templates",
+		"enable_active_checks"}, customCheckAttrs...),
+	"HostGroup": {"display_name", "groups", "vars", "zone", "templates"},
+}
+
+// Wraps the Icinga2 client for a sync. The hosts, services and host groups are listed the first time they are
+// needed, and the changes made in the sync are applied to the listing, so it is not listed again. ListHosts,
+// ListServices, ListHostGroups and ListObjects only return the objects of the installation, except ListObjects
+// without attributes, which lists the names of all objects like listObjectsOnce expects.
+type IcingaSyncClient struct {
+	IcingaGenClient
+	installation string
+	listed       map[string]map[string]IcingaAttrs
+	state        *syncState // compared with the listings if set
+
+	// the types whose objects are neither created nor deleted in the sync, see syncState.emptyListing
+	empty map[string]bool
+	held  bool // whether the last write was held back
+}
+
+func NewIcingaSyncClient(icinga IcingaGenClient, installation string) *IcingaSyncClient {
+	return &IcingaSyncClient{
+		IcingaGenClient: icinga,
+		installation:    installation,
+		listed:          make(map[string]map[string]IcingaAttrs),
+		empty:           make(map[string]bool)}
+}
+
+// The objects with the vars of the installation, with only the given attributes. For clients that cannot filter
+// on the server.
+func filterOwned(objects map[string]IcingaAttrs, installation string, attrs []string) map[string]IcingaAttrs {
+	owned := make(map[string]IcingaAttrs)
+	for name, o := range objects {
+		if varsOf(o)[RANCHER_INSTALLATION] == installation {
+			owned[name] = o.only(attrs)
+		}
+	}
+	return owned
+}
+
+// The shared listing of a type, listed if needed.
+func (c *IcingaSyncClient) owned(typ string) (map[string]IcingaAttrs, error) {
+	if objects, ok := c.listed[typ]; ok {
+		return objects, nil
+	}
+
+	objects, err := c.IcingaGenClient.ListOwnedObjects(typ, c.installation, ownedAttrs[typ])
+	if err != nil {
+		return nil, err
+	}
+	c.listed[typ] = objects
+	if c.state.emptyListing(typ, objects) {
+		c.empty[typ] = true
+		return objects, nil
+	}
+
+	for name, attrs := range c.state.drifted(typ, objects) {
+		debugLog("Reverting "+strings.ToLower(typ)+" "+name, 1)
+		if err := c.UpdateObject(typ, name, attrs); err != nil {
+			fmt.Printf("ERROR: could not revert %s %s: %s\n", strings.ToLower(typ), name, err)
+		}
+	}
+
+	return objects, nil
+}
+
+// Adds a created object to the listing. Icinga2 lists the object's own name as the first template.
+func (c *IcingaSyncClient) created(typ, name string, templates []string, attrs IcingaAttrs) {
+	objects, ok := c.listed[typ]
+	if !ok || varsOf(attrs)[RANCHER_INSTALLATION] != c.installation {
+		return
+	}
+
+	o := mergeAttrs(attrs, nil)
+	imports := []interface{}{name[strings.LastIndex(name, "!")+1:]}
+	for _, t := range templates {
+		imports = append(imports, t)
+	}
+	o["templates"] = imports
+	objects[name] = o
+}
+
+func (c *IcingaSyncClient) updated(typ, name string, attrs IcingaAttrs) {
+	if o, ok := c.listed[typ][name]; ok {
+		for k, v := range attrs {
+			o[k] = v
+		}
+	}
+}
+
+// Removes a deleted object from the listing. Deleting a host also deletes its services.
+func (c *IcingaSyncClient) deleted(typ, name string) {
+	delete(c.listed[typ], name)
+	if typ == "Host" {
+		for s := range c.listed["Service"] {
+			if strings.HasPrefix(s, name+"!") {
+				delete(c.listed["Service"], s)
+			}
+		}
+	}
+}
+
+// Whether a write creating or deleting an object is held back because its type is listed empty.
+func (c *IcingaSyncClient) hold(typ, name string) bool {
+	c.held = c.empty[typ]
+	if c.held {
+		debugLog("Not writing "+strings.ToLower(typ)+" "+name+" while icinga2 lists none", 2)
+	}
+	return c.held
+}
+
+// The listing includes the queued writes, the callbacks learn whether they were made. The callbacks of a write
+// that was held back are dropped.
+func (c *IcingaSyncClient) afterWrite(ok, failed func()) {
+	if c.held {
+		return
+	}
+	if q, isQueue := c.IcingaGenClient.(writeQueue); isQueue {
+		q.afterWrite(ok, failed)
+	} else {
+		ok()
+	}
+}
+
+// ---------
+
+func (c *IcingaSyncClient) ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error) {
+	if _, ok := ownedAttrs[typ]; !ok || installation != c.installation || !containsStrings(ownedAttrs[typ], attrs) {
+		return c.IcingaGenClient.ListOwnedObjects(typ, installation, attrs)
+	}
+
+	objects, err := c.owned(typ)
+	if err != nil {
+		return nil, err
+	}
+	return filterOwned(objects, installation, attrs), nil
+}
+
+func (c *IcingaSyncClient) ListObjects(typ string, attrs []string) (map[string]IcingaAttrs, error) {
+	if _, ok := ownedAttrs[typ]; !ok || len(attrs) == 0 || !containsStrings(ownedAttrs[typ], attrs) {
+		return c.IcingaGenClient.ListObjects(typ, attrs)
+	}
+
+	objects, err := c.owned(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]IcingaAttrs, len(objects))
+	for name, o := range objects {
+		res[name] = o.only(attrs)
+	}
+	return res, nil
+}
+
+func (c *IcingaSyncClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	if c.hold(typ, name) {
+		return nil
+	}
+	err := c.IcingaGenClient.CreateObject(typ, name, templates, attrs)
+	if err == nil {
+		c.created(typ, name, templates, attrs)
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	c.held = false
+	err := c.IcingaGenClient.UpdateObject(typ, name, attrs)
+	if err == nil {
+		c.updated(typ, name, attrs)
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) DeleteObject(typ, name string) error {
+	if c.hold(typ, name) {
+		return nil
+	}
+	err := c.IcingaGenClient.DeleteObject(typ, name)
+	if err == nil {
+		c.deleted(typ, name)
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) PerformAction(action string, params IcingaAttrs) error {
+	c.held = false
+	return c.IcingaGenClient.PerformAction(action, params)
+}
+
+func (c *IcingaSyncClient) ListHosts() ([]icinga2.Host, error) {
+	objects, err := c.owned("Host")
+	if err != nil {
+		return nil, err
+	}
+	hosts := []icinga2.Host{}
+	for name, attrs := range objects {
+		hosts = append(hosts, hostOfAttrs(name, attrs))
+	}
+	return hosts, nil
+}
+
+func (c *IcingaSyncClient) CreateHost(h icinga2.Host) error {
+	if c.hold("Host", h.Name) {
+		return nil
+	}
+	err := c.IcingaGenClient.CreateHost(h)
+	if err == nil {
+		c.created("Host", h.Name, nil, attrsForHost(h))
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) DeleteHost(name string) error {
+	if c.hold("Host", name) {
+		return nil
+	}
+	err := c.IcingaGenClient.DeleteHost(name)
+	if err == nil {
+		c.deleted("Host", name)
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) UpdateHost(h icinga2.Host) error {
+	c.held = false
+	err := c.IcingaGenClient.UpdateHost(h)
+	if err == nil {
+		c.updated("Host", h.Name, IcingaAttrs{
+			"address":       h.Address,
+			"check_command": h.CheckCommand,
+			"notes_url":     h.NotesURL,
+			"groups":        h.Groups,
+			"vars":          h.Vars})
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) ListHostGroups() ([]icinga2.HostGroup, error) {
+	objects, err := c.owned("HostGroup")
+	if err != nil {
+		return nil, err
+	}
+	hostGroups := []icinga2.HostGroup{}
+	for name, attrs := range objects {
+		hostGroups = append(hostGroups, hostGroupOfAttrs(name, attrs))
+	}
+	return hostGroups, nil
+}
+
+func (c *IcingaSyncClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	if c.hold("HostGroup", hg.Name) {
+		return nil
+	}
+	err := c.IcingaGenClient.CreateHostGroup(hg)
+	if err == nil {
+		c.created("HostGroup", hg.Name, nil, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars})
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) DeleteHostGroup(name string) error {
+	if c.hold("HostGroup", name) {
+		return nil
+	}
+	err := c.IcingaGenClient.DeleteHostGroup(name)
+	if err == nil {
+		c.deleted("HostGroup", name)
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	c.held = false
+	err := c.IcingaGenClient.UpdateHostGroup(hg)
+	if err == nil {
+		c.updated("HostGroup", hg.Name, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars})
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) ListServices() ([]icinga2.Service, error) {
+	objects, err := c.owned("Service")
+	if err != nil {
+		return nil, err
+	}
+	services := []icinga2.Service{}
+	for name, attrs := range objects {
+		services = append(services, serviceOfAttrs(name, attrs))
+	}
+	return services, nil
+}
+
+func (c *IcingaSyncClient) CreateService(s icinga2.Service) error {
+	if c.hold("Service", s.HostName+"!"+s.Name) {
+		return nil
+	}
+	err := c.IcingaGenClient.CreateService(s)
+	if err == nil {
+		c.created("Service", s.HostName+"!"+s.Name, nil, attrsForService(s))
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) DeleteService(name string) error {
+	if c.hold("Service", name) {
+		return nil
+	}
+	err := c.IcingaGenClient.DeleteService(name)
+	if err == nil {
+		c.deleted("Service", name)
+	}
+	return err
+}
+
+func (c *IcingaSyncClient) UpdateService(s icinga2.Service) error {
+	c.held = false
+	err := c.IcingaGenClient.UpdateService(s)
+	if err == nil {
+		c.updated("Service", s.HostName+"!"+s.Name, IcingaAttrs{
+			"check_command": s.CheckCommand,
+			"notes_url":     s.NotesURL,
+			"vars":          s.Vars})
+	}
+	return err
+}
@@ -0,0 +1,356 @@
+// Passive checks: instead of Icinga2 running a check command for every stack and service, which each query the
+// Rancher API, rancher-icinga submits their state as check results in every sync. Icinga2 runs the passive check
+// command when no result arrived within the freshness threshold, so it notices when rancher-icinga stops.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"github.com/rancher/go-rancher/v2"
+)
+
+// Icinga2 plugin exit codes.
+const (
+	STATE_OK       = 0
+	STATE_WARNING  = 1
+	STATE_CRITICAL = 2
+)
+
+// The exit codes Icinga2 accepts in host check results, see hostExitStatus.
+const (
+	HOST_UP   = 0
+	HOST_DOWN = 1
+)
+
+// The attributes of the objects with passive checks.
+var passiveAttrs = []string{"check_command", "enable_active_checks", "check_interval"}
+
+// Rancher service states in which a service is expected to be degraded.
+var transitionalServiceStates = []string{"activating", "upgrading", "upgraded", "rolling-back", "restarting",
+	"finishing-upgrade", "updating-active"}
+
+// A check result for a host or service.
+type checkResult struct {
+	exitStatus int
+	output     string
+	perfData   []string
+}
+
+// Reads the passive check configuration from the environment. In passive mode, the stack, service and agent
+// service checks default to the passive check command.
+func makePassiveConfig(cc *RancherIcingaConfig) (err error) {
+	cc.passiveChecks = os.Getenv("PASSIVE_CHECKS") == "1"
+
+	if c := os.Getenv("PASSIVE_CHECK_COMMAND"); c != "" {
+		cc.passiveCheckCommand = c
+	} else {
+		cc.passiveCheckCommand = "passive"
+	}
+
+	cc.passiveFreshness = 3 * time.Duration(cc.refreshInterval) * time.Second
+	if cc.passiveFreshness < 5*time.Minute {
+		cc.passiveFreshness = 5 * time.Minute
+	}
+	if c := os.Getenv("PASSIVE_FRESHNESS"); c != "" {
+		if cc.passiveFreshness, err = time.ParseDuration(c); err != nil {
+			return fmt.Errorf("error parsing PASSIVE_FRESHNESS: %s", err)
+		}
+	}
+
+	if cc.passiveChecks {
+		for env, command := range map[string]*string{
+			"STACK_CHECK_COMMAND":         &cc.stackCheckCommand,
+			"SERVICE_CHECK_COMMAND":       &cc.serviceCheckCommand,
+			"AGENT_SERVICE_CHECK_COMMAND": &cc.agentServiceCheckCommand,
+		} {
+			if os.Getenv(env) == "" {
+				*command = cc.passiveCheckCommand
+			}
+		}
+	}
+
+	return nil
+}
+
+// Services without a health check have no health state, services that run once are "started-once".
+func isHealthy(healthState string) bool {
+	return healthState == "" || healthState == "healthy" || healthState == "started-once"
+}
+
+// The result for a Rancher service and its containers.
+func serviceCheckResult(service client.Service, containers []client.Container) checkResult {
+	running, healthy := 0, 0
+	for _, c := range containers {
+		if !containsStrings(c.ServiceIds, []string{service.Id}) || c.State != "running" {
+			continue
+		}
+		running++
+		if isHealthy(c.HealthState) {
+			healthy++
+		}
+	}
+
+	r := checkResult{}
+	switch {
+	case containsStrings(transitionalServiceStates, []string{service.State}):
+		r.exitStatus = STATE_WARNING
+	case service.State != "active" || service.HealthState == "unhealthy":
+		r.exitStatus = STATE_CRITICAL
+	case isHealthy(service.HealthState):
+		r.exitStatus = STATE_OK
+	default:
+		// degraded or initializing
+		r.exitStatus = STATE_WARNING
+	}
+
+	r.output = fmt.Sprintf("service %s is %s", service.Name, service.State)
+	if service.HealthState != "" {
+		r.output += " and " + service.HealthState
+	}
+	r.output += fmt.Sprintf(", %d of %d containers running and healthy", healthy, service.Scale)
+	r.perfData = []string{
+		fmt.Sprintf("scale=%d;;;0", service.Scale),
+		fmt.Sprintf("running=%d;;;0", running),
+		fmt.Sprintf("healthy=%d;;;0", healthy)}
+
+	return r
+}
+
+// The result for a stack host.
+func stackCheckResult(stack client.Stack, services []client.Service) checkResult {
+	healthy := 0
+	for _, s := range services {
+		if isHealthy(s.HealthState) {
+			healthy++
+		}
+	}
+
+	r := checkResult{}
+	switch {
+	case stack.State != "active" || stack.HealthState == "unhealthy":
+		r.exitStatus = STATE_CRITICAL
+	case isHealthy(stack.HealthState):
+		r.exitStatus = STATE_OK
+	default:
+		r.exitStatus = STATE_WARNING
+	}
+
+	r.output = fmt.Sprintf("stack %s is %s", stack.Name, stack.State)
+	if stack.HealthState != "" {
+		r.output += " and " + stack.HealthState
+	}
+	r.output += fmt.Sprintf(", %d of %d services healthy", healthy, len(services))
+	r.perfData = []string{
+		fmt.Sprintf("services=%d;;;0", len(services)),
+		fmt.Sprintf("healthy_services=%d;;;0", healthy)}
+
+	return r
+}
+
+// The result for the rancher-agent service of a host.
+func agentCheckResult(host client.Host) checkResult {
+	r := checkResult{}
+	switch {
+	case host.AgentState != "" && host.AgentState != "active":
+		// disconnected or reconnecting
+		r.exitStatus = STATE_CRITICAL
+	case host.State == "active":
+		r.exitStatus = STATE_OK
+	default:
+		// inactive or in maintenance, see DOWNTIME_HOST_STATES
+		r.exitStatus = STATE_WARNING
+	}
+
+	r.output = fmt.Sprintf("host %s is %s", host.Hostname, host.State)
+	if host.AgentState != "" {
+		r.output += ", agent is " + host.AgentState
+	}
+	r.perfData = []string{fmt.Sprintf("containers=%d;;;0", len(host.InstanceIds))}
+
+	return r
+}
+
+// The check results there should be for the stack hosts, services and agent services, by Icinga2 object.
+func rancherCheckResults(config *RancherIcingaConfig) (hosts, services map[string]checkResult, err error) {
+	hosts = make(map[string]checkResult)
+	services = make(map[string]checkResult)
+
+	rancherHosts, err := config.rancher.Hosts()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching rancher hosts: %s", err)
+	}
+
+	for _, rh := range rancherHosts.Data {
+		isolateHost(config, rh, func() {
+			if !filterHost(config.rancher, rh, config.filterHosts) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) {
+				return
+			}
+			services[rh.Hostname+"!rancher-agent"] = agentCheckResult(rh)
+		})
+	}
+
+	rancherStacks, err := config.rancher.Stacks()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching rancher stacks: %s", err)
+	}
+
+	containers, err := config.rancher.Containers()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching rancher containers: %s", err)
+	}
+
+	for _, s := range rancherStacks.Data {
+		isolateStack(config, s, func() {
+			if !filterStack(config.rancher, s, config.filterStacks) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
+				return
+			}
+
+			environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+			stackHostname := execTemplate(config.stackNameTemplate, "", environmentName, s.Name, "")
+
+			stackServices := []client.Service{}
+			for _, id := range s.ServiceIds {
+				rs := config.rancher.GetService(id)
+				stackServices = append(stackServices, rs)
+				if filterService(config.rancher, rs, config.filterServices) {
+					services[stackHostname+"!"+rs.Name] = serviceCheckResult(rs, containers.Data)
+				}
+			}
+
+			hosts[stackHostname] = stackCheckResult(s, stackServices)
+		})
+	}
+
+	return hosts, services, nil
+}
+
+// Switches the checks of an object between active and passive. Active checks stay enabled with passive checks,
+// Icinga2 only runs the check command for an object without a fresh result then. Switching back to active checks
+// restores the check command, but not the check interval.
+func syncPassiveAttrs(config *RancherIcingaConfig, typ, name string, current IcingaAttrs, command string) {
+	desired := IcingaAttrs{"check_command": command, "enable_active_checks": true}
+	if config.passiveChecks {
+		desired["check_interval"] = config.passiveFreshness.Seconds()
+	}
+
+	if !varsNeedUpdate(icinga2.Vars(desired), icinga2.Vars(current.only(desired.names()))) {
+		return
+	}
+
+	debugLog("Updating "+typ+" "+name+" for passive checks", 1)
+	err := config.icinga.UpdateObject(typ, name, desired)
+	if err != nil {
+		fmt.Printf("ERROR: could not update %s %s: %s\n", typ, name, err)
+	} else {
+		config.registerChange("update", name, strings.ToLower(typ), icinga2.Vars{}, desired)
+	}
+}
+
+// Sets up the passive checks of the stack hosts, services and agent services and submits their results.
+func syncPassiveChecks(config *RancherIcingaConfig) error {
+	icingaHosts, err := config.icinga.ListHosts()
+	if err != nil {
+		return fmt.Errorf("error fetching icinga hosts: %s", err)
+	}
+
+	icingaServices, err := config.icinga.ListServices()
+	if err != nil {
+		return fmt.Errorf("error fetching icinga services: %s", err)
+	}
+
+	hostAttrs, err := config.icinga.ListObjects("Host", passiveAttrs)
+	if err != nil {
+		return fmt.Errorf("error fetching icinga host attributes: %s", err)
+	}
+
+	serviceAttrs, err := config.icinga.ListObjects("Service", passiveAttrs)
+	if err != nil {
+		return fmt.Errorf("error fetching icinga service attributes: %s", err)
+	}
+
+	passiveHosts := []string{}
+	for _, ih := range icingaHosts {
+		if config.matches(ih.Vars, "stack", "", "", "") {
+			syncPassiveAttrs(config, "Host", ih.Name, hostAttrs[ih.Name], config.stackCheckCommand)
+			passiveHosts = append(passiveHosts, ih.Name)
+		}
+	}
+
+	passiveServices := []string{}
+	for _, is := range icingaServices {
+		name := is.HostName + "!" + is.Name
+		switch {
+		case config.matches(is.Vars, "service", "", "", ""):
+			syncPassiveAttrs(config, "Service", name, serviceAttrs[name], config.serviceCheckCommand)
+		case config.matches(is.Vars, "rancher-agent", "", "", ""):
+			syncPassiveAttrs(config, "Service", name, serviceAttrs[name], config.agentServiceCheckCommand)
+		default:
+			continue
+		}
+		passiveServices = append(passiveServices, name)
+	}
+
+	if !config.passiveChecks {
+		return nil
+	}
+
+	hostResults, serviceResults, err := rancherCheckResults(config)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range passiveHosts {
+		if r, ok := hostResults[name]; ok {
+			processCheckResult(config, "Host", name, r)
+		}
+	}
+	for _, name := range passiveServices {
+		if r, ok := serviceResults[name]; ok {
+			processCheckResult(config, "Service", name, r)
+		}
+	}
+
+	return nil
+}
+
+// The exit code of a host check result: OK and WARNING mean UP, CRITICAL means DOWN. Icinga2 rejects other codes
+// for hosts.
+func hostExitStatus(state int) int {
+	if state == STATE_CRITICAL {
+		return HOST_DOWN
+	}
+	return HOST_UP
+}
+
+// Submits a check result.
+func processCheckResult(config *RancherIcingaConfig, typ, name string, r checkResult) {
+	exitStatus := r.exitStatus
+	if typ == "Host" {
+		exitStatus = hostExitStatus(r.exitStatus)
+	}
+
+	params := IcingaAttrs{
+		"type":             typ,
+		"exit_status":      exitStatus,
+		"plugin_output":    r.output,
+		"performance_data": r.perfData,
+		"check_source":     "rancher-icinga"}
+	if typ == "Host" {
+		params["host"] = name
+	} else {
+		params["service"] = name
+	}
+
+	debugLog(fmt.Sprintf("Submitting check result %d for %s", exitStatus, name), 2)
+	err := config.icinga.PerformAction("process-check-result", params)
+	if err != nil {
+		fmt.Printf("ERROR: could not submit check result for %s: %s\n", name, err)
+	}
+}
@@ -4,6 +4,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/rancher/go-rancher/v2"
 )
@@ -25,14 +27,20 @@ type RancherGenClient interface {
 	Services() (*client.ServiceCollection, error)
 	GetService(string) client.Service
 	DeleteService(string) error
+	AddLoadBalancer(client.LoadBalancerService)
+	GetLoadBalancer(string) (client.LoadBalancerService, error)
+	AddContainer(client.Container)
+	Containers() (*client.ContainerCollection, error)
 }
 
 type RancherWebClient struct {
 	rancher      *client.RancherClient
+	retry        *retrier
 	environments map[string]client.Project
 	hosts        map[string]client.Host
 	stacks       map[string]client.Stack
 	services     map[string]client.Service
+	containers   map[string]client.Container
 }
 
 type RancherMockClient struct {
@@ -40,15 +48,19 @@ type RancherMockClient struct {
 	hosts        map[string]client.Host
 	stacks       map[string]client.Stack
 	services     map[string]client.Service
+	lbs          map[string]client.LoadBalancerService
+	containers   map[string]client.Container
 }
 
-func NewRancherWebClient(rancher *client.RancherClient) *RancherWebClient {
+func NewRancherWebClient(rancher *client.RancherClient, retry *retrier) *RancherWebClient {
 	r := new(RancherWebClient)
 	r.rancher = rancher
+	r.retry = retry
 	r.environments = make(map[string]client.Project)
 	r.stacks = make(map[string]client.Stack)
 	r.services = make(map[string]client.Service)
 	r.hosts = make(map[string]client.Host)
+	r.containers = make(map[string]client.Container)
 	return r
 }
 
@@ -58,6 +70,8 @@ func NewRancherMockClient() *RancherMockClient {
 	r.stacks = make(map[string]client.Stack)
 	r.services = make(map[string]client.Service)
 	r.hosts = make(map[string]client.Host)
+	r.lbs = make(map[string]client.LoadBalancerService)
+	r.containers = make(map[string]client.Container)
 	return r
 }
 
@@ -79,44 +93,62 @@ func (r *RancherWebClient) AddHost(host client.Host) {
 	r.hosts[host.Id] = host
 }
 
-func (r *RancherWebClient) Environments() (environments *client.ProjectCollection, err error) {
-	envList, err := r.rancher.Project.List(nil)
+func (r *RancherWebClient) Environments() (*client.ProjectCollection, error) {
+	var envList *client.ProjectCollection
+	err := r.retry.do("list rancher environments", func() (err error) {
+		envList, err = r.rancher.Project.List(nil)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
 	envArr := envList.Data
 
 	for envList.Pagination != nil && envList.Pagination.Partial {
-		envList, err = envList.Next()
-		if err != nil {
+		var next *client.ProjectCollection
+		err = r.retry.do("list rancher environments", func() (err error) {
+			next, err = envList.Next()
 			return
+		})
+		if err != nil {
+			return nil, err
 		}
+		envList = next
 
 		envArr = append(envArr, envList.Data...)
 	}
 
-	if err != nil {
-		return
-	}
 	for _, env := range envArr {
 		r.AddEnvironment(env)
 	}
 	return &client.ProjectCollection{Data: envArr}, nil
 }
 
-func (r *RancherWebClient) Hosts() (hosts *client.HostCollection, err error) {
-	hostList, err := r.rancher.Host.List(nil)
+func (r *RancherWebClient) Hosts() (*client.HostCollection, error) {
+	var hostList *client.HostCollection
+	err := r.retry.do("list rancher hosts", func() (err error) {
+		hostList, err = r.rancher.Host.List(nil)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
 	hostArr := hostList.Data
 
 	for hostList.Pagination != nil && hostList.Pagination.Partial {
-		hostList, err = hostList.Next()
-		if err != nil {
+		var next *client.HostCollection
+		err = r.retry.do("list rancher hosts", func() (err error) {
+			next, err = hostList.Next()
 			return
+		})
+		if err != nil {
+			return nil, err
 		}
+		hostList = next
 
 		hostArr = append(hostArr, hostList.Data...)
 	}
 
-	if err != nil {
-		return
-	}
 	for _, env := range hostArr {
 		r.AddHost(env)
 	}
@@ -125,7 +157,14 @@ func (r *RancherWebClient) Hosts() (hosts *client.HostCollection, err error) {
 
 func (r *RancherWebClient) GetEnvironment(id string) client.Project {
 	if _, ok := r.environments[id]; !ok {
-		x, _ := r.rancher.Project.ById(id)
+		var x *client.Project
+		err := r.retry.do("get rancher environment "+id, func() (err error) {
+			x, err = r.rancher.Project.ById(id)
+			return
+		})
+		if err != nil || x == nil {
+			return client.Project{}
+		}
 		r.environments[id] = *x
 	}
 	return r.environments[id]
@@ -133,29 +172,45 @@ func (r *RancherWebClient) GetEnvironment(id string) client.Project {
 
 func (r *RancherWebClient) GetHost(id string) client.Host {
 	if _, ok := r.hosts[id]; !ok {
-		x, _ := r.rancher.Host.ById(id)
+		var x *client.Host
+		err := r.retry.do("get rancher host "+id, func() (err error) {
+			x, err = r.rancher.Host.ById(id)
+			return
+		})
+		if err != nil || x == nil {
+			return client.Host{}
+		}
 		r.hosts[id] = *x
 	}
 
 	return r.hosts[id]
 }
 
-func (r *RancherWebClient) Stacks() (stacks *client.StackCollection, err error) {
-	stackList, err := r.rancher.Stack.List(nil)
+func (r *RancherWebClient) Stacks() (*client.StackCollection, error) {
+	var stackList *client.StackCollection
+	err := r.retry.do("list rancher stacks", func() (err error) {
+		stackList, err = r.rancher.Stack.List(nil)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
 	stackArr := stackList.Data
 
 	for stackList.Pagination != nil && stackList.Pagination.Partial {
-		stackList, err = stackList.Next()
-		if err != nil {
+		var next *client.StackCollection
+		err = r.retry.do("list rancher stacks", func() (err error) {
+			next, err = stackList.Next()
 			return
+		})
+		if err != nil {
+			return nil, err
 		}
+		stackList = next
 
 		stackArr = append(stackArr, stackList.Data...)
 	}
 
-	if err != nil {
-		return
-	}
 	for _, env := range stackArr {
 		r.AddStack(env)
 	}
@@ -164,28 +219,44 @@ func (r *RancherWebClient) Stacks() (stacks *client.StackCollection, err error)
 
 func (r *RancherWebClient) GetStack(id string) client.Stack {
 	if _, ok := r.stacks[id]; !ok {
-		x, _ := r.rancher.Stack.ById(id)
+		var x *client.Stack
+		err := r.retry.do("get rancher stack "+id, func() (err error) {
+			x, err = r.rancher.Stack.ById(id)
+			return
+		})
+		if err != nil || x == nil {
+			return client.Stack{}
+		}
 		r.stacks[id] = *x
 	}
 	return r.stacks[id]
 }
 
-func (r *RancherWebClient) Services() (services *client.ServiceCollection, err error) {
-	serviceList, err := r.rancher.Service.List(nil)
+func (r *RancherWebClient) Services() (*client.ServiceCollection, error) {
+	var serviceList *client.ServiceCollection
+	err := r.retry.do("list rancher services", func() (err error) {
+		serviceList, err = r.rancher.Service.List(nil)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
 	serviceArr := serviceList.Data
 
 	for serviceList.Pagination != nil && serviceList.Pagination.Partial {
-		serviceList, err = serviceList.Next()
-		if err != nil {
+		var next *client.ServiceCollection
+		err = r.retry.do("list rancher services", func() (err error) {
+			next, err = serviceList.Next()
 			return
+		})
+		if err != nil {
+			return nil, err
 		}
+		serviceList = next
 
 		serviceArr = append(serviceArr, serviceList.Data...)
 	}
 
-	if err != nil {
-		return
-	}
 	for _, env := range serviceArr {
 		r.AddService(env)
 	}
@@ -194,12 +265,75 @@ func (r *RancherWebClient) Services() (services *client.ServiceCollection, err e
 
 func (r *RancherWebClient) GetService(id string) client.Service {
 	if _, ok := r.services[id]; !ok {
-		x, _ := r.rancher.Service.ById(id)
+		var x *client.Service
+		err := r.retry.do("get rancher service "+id, func() (err error) {
+			x, err = r.rancher.Service.ById(id)
+			return
+		})
+		if err != nil || x == nil {
+			return client.Service{}
+		}
 		r.services[id] = *x
 	}
 	return r.services[id]
 }
 
+// Load balancers are not cached, their port rules change, see GetLoadBalancer.
+func (r *RancherWebClient) AddLoadBalancer(lb client.LoadBalancerService) {
+}
+
+// Load balancers are also listed as services, but only this has their port rules. They are fetched again in every
+// sync, see RancherSyncClient.
+func (r *RancherWebClient) GetLoadBalancer(id string) (client.LoadBalancerService, error) {
+	var x *client.LoadBalancerService
+	err := r.retry.do("get rancher load balancer "+id, func() (err error) {
+		x, err = r.rancher.LoadBalancerService.ById(id)
+		return
+	})
+	if err != nil {
+		return client.LoadBalancerService{}, err
+	}
+	if x == nil {
+		return client.LoadBalancerService{}, fmt.Errorf("load balancer %s not found", id)
+	}
+	return *x, nil
+}
+
+func (r *RancherWebClient) AddContainer(container client.Container) {
+	r.containers[container.Id] = container
+}
+
+func (r *RancherWebClient) Containers() (*client.ContainerCollection, error) {
+	var containerList *client.ContainerCollection
+	err := r.retry.do("list rancher containers", func() (err error) {
+		containerList, err = r.rancher.Container.List(nil)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	containerArr := containerList.Data
+
+	for containerList.Pagination != nil && containerList.Pagination.Partial {
+		var next *client.ContainerCollection
+		err = r.retry.do("list rancher containers", func() (err error) {
+			next, err = containerList.Next()
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		containerList = next
+
+		containerArr = append(containerArr, containerList.Data...)
+	}
+
+	for _, c := range containerArr {
+		r.AddContainer(c)
+	}
+	return &client.ContainerCollection{Data: containerArr}, nil
+}
+
 func (r *RancherWebClient) DeleteService(id string) error {
 	return errors.New("deleting objects not supported in Rancher web client")
 }
@@ -250,6 +384,20 @@ func (r *RancherMockClient) GetService(id string) client.Service {
 	return r.services[id]
 }
 
+func (r *RancherMockClient) AddContainer(container client.Container) {
+	r.containers[container.Id] = container
+}
+
+func (r *RancherMockClient) Containers() (*client.ContainerCollection, error) {
+	coll := make([]client.Container, 0, len(r.containers))
+
+	for _, e := range r.containers {
+		coll = append(coll, e)
+	}
+
+	return &client.ContainerCollection{Data: coll}, nil
+}
+
 func (r *RancherMockClient) Environments() (*client.ProjectCollection, error) {
 	coll := make([]client.Project, 0, len(r.environments))
 
@@ -290,6 +438,14 @@ func (r *RancherMockClient) Services() (*client.ServiceCollection, error) {
 	return &client.ServiceCollection{Data: coll}, nil
 }
 
+func (r *RancherMockClient) AddLoadBalancer(lb client.LoadBalancerService) {
+	r.lbs[lb.Id] = lb
+}
+
+func (r *RancherMockClient) GetLoadBalancer(id string) (client.LoadBalancerService, error) {
+	return r.lbs[id], nil
+}
+
 func (r *RancherMockClient) DeleteService(id string) error {
 	delete(r.services, id)
 	return nil
@@ -309,3 +465,100 @@ func (r *RancherMockClient) DeleteEnvironment(id string) error {
 	delete(r.environments, id)
 	return nil
 }
+
+// ---------
+
+// Wraps the Rancher client for a sync. The configuration of each stack is collected once per sync, it needs the
+// stack's services and is used in several phases. Load balancers are fetched once per sync, and the hosts of the
+// containers are listed once.
+type RancherSyncClient struct {
+	RancherGenClient
+	stackConfigs    map[string]cachedStackConfig
+	lbs             map[string]client.LoadBalancerService
+	hostsByInstance map[string]client.Host
+}
+
+type cachedStackConfig struct {
+	config   StackConfig
+	warnings []string
+}
+
+func NewRancherSyncClient(rancher RancherGenClient) *RancherSyncClient {
+	return &RancherSyncClient{
+		RancherGenClient: rancher,
+		stackConfigs:     make(map[string]cachedStackConfig),
+		lbs:              make(map[string]client.LoadBalancerService)}
+}
+
+func (r *RancherSyncClient) GetLoadBalancer(id string) (client.LoadBalancerService, error) {
+	if lb, ok := r.lbs[id]; ok {
+		return lb, nil
+	}
+	lb, err := r.RancherGenClient.GetLoadBalancer(id)
+	if err != nil {
+		return lb, err
+	}
+	r.lbs[id] = lb
+	return lb, nil
+}
+
+func (r *RancherSyncClient) stackConfig(stack client.Stack) (StackConfig, []string) {
+	if c, ok := r.stackConfigs[stack.Id]; ok && stack.Id != "" {
+		return c.config, c.warnings
+	}
+	sc, warnings := collectStackConfig(r, stack)
+	r.stackConfigs[stack.Id] = cachedStackConfig{sc, warnings}
+	return sc, warnings
+}
+
+func (r *RancherSyncClient) instanceHosts() (map[string]client.Host, error) {
+	if r.hostsByInstance != nil {
+		return r.hostsByInstance, nil
+	}
+	hosts, err := listInstanceHosts(r.RancherGenClient)
+	if err != nil {
+		return nil, err
+	}
+	r.hostsByInstance = hosts
+	return hosts, nil
+}
+
+// The hosts by the IDs of the containers they run.
+func listInstanceHosts(rancher RancherGenClient) (map[string]client.Host, error) {
+	hosts, err := rancher.Hosts()
+	if err != nil {
+		return nil, err
+	}
+	byInstance := make(map[string]client.Host)
+	for _, h := range hosts.Data {
+		for _, i := range h.InstanceIds {
+			byInstance[i] = h
+		}
+	}
+	return byInstance, nil
+}
+
+// The hosts running the containers of a service, sorted by hostname.
+func serviceHostsOf(rancher RancherGenClient, service client.Service) ([]client.Host, error) {
+	var byInstance map[string]client.Host
+	var err error
+	if r, ok := rancher.(*RancherSyncClient); ok {
+		byInstance, err = r.instanceHosts()
+	} else {
+		byInstance, err = listInstanceHosts(rancher)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	hosts := []client.Host{}
+	for _, i := range service.InstanceIds {
+		if h, ok := byInstance[i]; ok && !seen[h.Id] {
+			seen[h.Id] = true
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Hostname < hosts[j].Hostname })
+	return hosts, nil
+}
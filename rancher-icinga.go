@@ -4,12 +4,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -31,6 +36,7 @@ const RANCHER_STACK = "rancher_stack"
 const RANCHER_SERVICE = "rancher_service"
 const RANCHER_HOST = "rancher_host"
 const RANCHER_OBJECT_TYPE = "rancher_object_type"
+const RANCHER_CUSTOM_ATTRS = "rancher_custom_attrs"
 
 const HOST_NOTES_URL_LABEL = "icinga.host_notes_url"
 const STACK_NOTES_URL_LABEL = "icinga.stack_notes_url"
@@ -40,6 +46,8 @@ const HOST_VARS_LABEL = "icinga.host_vars"
 const STACK_VARS_LABEL = "icinga.stack_vars"
 const SERVICE_VARS_LABEL = "icinga.service_vars"
 
+const STACK_CONFIG_LABEL = "icinga.stack_config"
+
 const CUSTOM_CHECKS_LABEL = "icinga.custom_checks"
 
 type RancherCheckParameters struct {
@@ -65,6 +73,50 @@ type RancherIcingaConfig struct {
 	stackCheckCommand        string
 	serviceCheckCommand      string
 	agentServiceCheckCommand string
+	configCheckCommand       string
+	autoChecks               []string
+	dependencies             bool
+	notificationType         string
+	icingaZone               string
+	passiveChecks            bool
+	passiveCheckCommand      string
+	passiveFreshness         time.Duration
+	zoneRules                []zoneRule
+
+	// how writes to Icinga2 are made, see write-executor.go
+	writeConcurrency int
+	writeRate        float64
+
+	// how requests to Rancher and Icinga2 are retried, see retry.go
+	rancherTimeout, icingaTimeout, retryBackoff time.Duration
+	rancherRetries, icingaRetries               int
+	metricsListen                               string
+
+	// which instance syncs when several run for the installation, see leader-election.go
+	leaderElection, leaderLockFile, leaderID string
+	leaderLease                              time.Duration
+	leaderLock                               leaderLock
+
+	// the objects written by rancher-icinga, kept in STATE_FILE, see state.go
+	state *syncState
+
+	// the Icinga2 templates imported by the generated objects
+	hostgroupImports, hostImports, stackImports, serviceImports, agentServiceImports []string
+
+	stackServiceGroupTemplate        *template.Template
+	labelServiceGroupTemplate        *template.Template
+	installationServiceGroupTemplate *template.Template
+	serviceGroupLabel                string
+
+	installationHostGroupTemplate *template.Template
+	hostHostGroupTemplate         *template.Template
+	stackHostGroupTemplate        *template.Template
+	hostHostGroupLabel            string
+	stackHostGroupLabel           string
+	stackHostGroupPatterns        []hostGroupPattern
+
+	downtimeMaxDuration                       time.Duration
+	downtimeServiceStates, downtimeHostStates []string
 
 	rancherInstallation string
 
@@ -85,17 +137,50 @@ type RancherIcingaConfig struct {
 	environmentNameTemplate *template.Template
 	stackNameTemplate       *template.Template
 
-	icinga  icinga2.Client
+	icinga  IcingaGenClient
 	rancher RancherGenClient
+
+	// canceled to stop the sync after the current object, see daemon.go
+	ctx context.Context
+
+	// problems with the configuration found during the current sync, by Icinga2 host
+	configErrors map[string]*configErrors
+	// the objects whose sync panicked in the current sync, see isolate.go
+	failedObjects map[string]bool
+
+	// when the objects in downtime were first seen in their state, by downtime key
+	downtimesSeen map[string]time.Time
+
+	// Icinga2 objects that are listed once per sync, like users and endpoints, by type
+	listedObjects map[string]map[string]IcingaAttrs
 }
 
 type CustomCheck struct {
-	Name     string                 `yaml:"name"`
-	NotesURL string                 `yaml:"notes_url,omitempty"`
-	Command  string                 `yaml:"command,omitempty"`
-	Vars     map[string]interface{} `yaml:"vars,omitempty"`
+	Name                string                 `yaml:"name"`
+	DisplayName         string                 `yaml:"display_name,omitempty"`
+	NotesURL            string                 `yaml:"notes_url,omitempty"`
+	ActionURL           string                 `yaml:"action_url,omitempty"`
+	Command             string                 `yaml:"command,omitempty"`
+	CommandEndpoint     string                 `yaml:"command_endpoint,omitempty"`
+	Zone                string                 `yaml:"zone,omitempty"`
+	CheckInterval       *Interval              `yaml:"check_interval,omitempty"`
+	RetryInterval       *Interval              `yaml:"retry_interval,omitempty"`
+	MaxCheckAttempts    *int                   `yaml:"max_check_attempts,omitempty"`
+	EnableNotifications *bool                  `yaml:"enable_notifications,omitempty"`
+	Groups              []string               `yaml:"groups,omitempty"`
+	Imports             []string               `yaml:"imports,omitempty"`
+	Vars                map[string]interface{} `yaml:"vars,omitempty"`
 }
 
+var varNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// The Icinga2 service attributes that can be set for custom checks in addition to the command, notes URL and vars.
+var customCheckAttrs = []string{"display_name", "action_url", "command_endpoint", "zone", "check_interval",
+	"retry_interval", "max_check_attempts", "enable_notifications", "groups"}
+
+// An interval in seconds. In YAML, it can also be written as a duration like "5m" or "1h30m".
+type Interval float64
+
 func NewBaseConfig() (cc *RancherIcingaConfig, err error) {
 	cc = new(RancherIcingaConfig)
 
@@ -119,7 +204,52 @@ func NewBaseConfig() (cc *RancherIcingaConfig, err error) {
 	} else {
 		cc.agentServiceCheckCommand = "check_rancher_host"
 	}
+	if c := os.Getenv("CONFIG_CHECK_COMMAND"); c != "" {
+		cc.configCheckCommand = c
+	} else {
+		cc.configCheckCommand = "dummy"
+	}
+
+	cc.dependencies = os.Getenv("ICINGA_DEPENDENCIES") == "1"
+
+	if c := os.Getenv("NOTIFICATION_TYPE"); c != "" {
+		cc.notificationType = c
+	} else {
+		cc.notificationType = "mail"
+	}
+
+	cc.downtimeMaxDuration = 2 * time.Hour
+	if c := os.Getenv("DOWNTIME_MAX_DURATION"); c != "" {
+		if cc.downtimeMaxDuration, err = time.ParseDuration(c); err != nil {
+			return nil, fmt.Errorf("error parsing DOWNTIME_MAX_DURATION: %s", err)
+		}
+	}
+	cc.downtimeServiceStates = []string{"upgrading", "upgraded", "rolling-back", "restarting"}
+	if c := os.Getenv("DOWNTIME_SERVICE_STATES"); c != "" {
+		cc.downtimeServiceStates = strings.Split(c, ",")
+	}
+	cc.downtimeHostStates = []string{"inactive", "deactivating", "evacuating", "evacuated"}
+	if c := os.Getenv("DOWNTIME_HOST_STATES"); c != "" {
+		cc.downtimeHostStates = strings.Split(c, ",")
+	}
+	cc.downtimesSeen = make(map[string]time.Time)
+	cc.ctx = context.Background()
 
+	if err = makeServiceGroupTemplates(cc); err != nil {
+		return nil, err
+	}
+	if err = makeHostGroupConfig(cc); err != nil {
+		return nil, err
+	}
+	makeImportsConfig(cc)
+	if err = makeZoneConfig(cc); err != nil {
+		return nil, err
+	}
+	if c := os.Getenv("AUTO_CHECKS"); c != "" {
+		if cc.autoChecks, err = parseAutoChecks(c); err != nil {
+			return nil, fmt.Errorf("error parsing AUTO_CHECKS: %s", err)
+		}
+	}
 	if c := os.Getenv("RANCHER_INSTALLATION"); c != "" {
 		cc.rancherInstallation = c
 	} else {
@@ -138,24 +268,38 @@ func NewBaseConfig() (cc *RancherIcingaConfig, err error) {
 	if c := os.Getenv("FILTER_SERVICES"); c != "" {
 		cc.filterServices = c
 	}
+	for env, filter := range map[string]string{"FILTER_ENVIRONMENTS": cc.filterEnvironments,
+		"FILTER_HOSTS": cc.filterHosts, "FILTER_STACKS": cc.filterStacks, "FILTER_SERVICES": cc.filterServices} {
+		if err = validateFilter(filter); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", env, err)
+		}
+	}
 
 	if c := os.Getenv("HOSTGROUP_DEFAULT_ICINGA_VARS"); c != "" {
-		cc.hostgroupDefaultIcingaVars = unpackVars(c)
+		if cc.hostgroupDefaultIcingaVars, err = unpackVars(c); err != nil {
+			return nil, fmt.Errorf("error parsing HOSTGROUP_DEFAULT_ICINGA_VARS: %s", err)
+		}
 	} else {
 		cc.hostgroupDefaultIcingaVars = make(icinga2.Vars)
 	}
 	if c := os.Getenv("HOST_DEFAULT_ICINGA_VARS"); c != "" {
-		cc.hostDefaultIcingaVars = unpackVars(c)
+		if cc.hostDefaultIcingaVars, err = unpackVars(c); err != nil {
+			return nil, fmt.Errorf("error parsing HOST_DEFAULT_ICINGA_VARS: %s", err)
+		}
 	} else {
 		cc.hostDefaultIcingaVars = make(icinga2.Vars)
 	}
 	if c := os.Getenv("STACK_DEFAULT_ICINGA_VARS"); c != "" {
-		cc.stackDefaultIcingaVars = unpackVars(c)
+		if cc.stackDefaultIcingaVars, err = unpackVars(c); err != nil {
+			return nil, fmt.Errorf("error parsing STACK_DEFAULT_ICINGA_VARS: %s", err)
+		}
 	} else {
 		cc.stackDefaultIcingaVars = make(icinga2.Vars)
 	}
 	if c := os.Getenv("SERVICE_DEFAULT_ICINGA_VARS"); c != "" {
-		cc.serviceDefaultIcingaVars = unpackVars(c)
+		if cc.serviceDefaultIcingaVars, err = unpackVars(c); err != nil {
+			return nil, fmt.Errorf("error parsing SERVICE_DEFAULT_ICINGA_VARS: %s", err)
+		}
 	} else {
 		cc.serviceDefaultIcingaVars = make(icinga2.Vars)
 	}
@@ -181,6 +325,22 @@ func NewBaseConfig() (cc *RancherIcingaConfig, err error) {
 	} else {
 		cc.refreshInterval = 0
 	}
+	if err = makePassiveConfig(cc); err != nil {
+		return nil, err
+	}
+	if err = makeWriteConfig(cc); err != nil {
+		return nil, err
+	}
+	if err = makeRetryConfig(cc); err != nil {
+		return nil, err
+	}
+	if err = makeLeaderConfig(cc); err != nil {
+		return nil, err
+	}
+	if err = makeStateConfig(cc); err != nil {
+		return nil, err
+	}
+	cc.metricsListen = os.Getenv("METRICS_LISTEN")
 
 	if os.Getenv("ICINGA_DEBUG") == "3" {
 		cc.debugMode = true
@@ -202,27 +362,33 @@ func NewBaseConfig() (cc *RancherIcingaConfig, err error) {
 	return
 }
 
-func NewConfig() (cc *RancherIcingaConfig, err error) {
+func NewConfig(ctx context.Context) (cc *RancherIcingaConfig, err error) {
+
+	if err = loadConfigFile(); err != nil {
+		return nil, err
+	}
 
 	cc, err = NewBaseConfig()
 
 	if err != nil {
 		return nil, err
 	}
+	cc.ctx = ctx
 
 	rancherClient, err := client.NewRancherClient(&client.ClientOpts{
 		Url:       os.Getenv("RANCHER_URL"),
 		AccessKey: os.Getenv("RANCHER_ACCESS_KEY"),
 		SecretKey: os.Getenv("RANCHER_SECRET_KEY"),
-		Timeout:   10 * time.Second})
+		Timeout:   cc.rancherTimeout})
 
 	if err != nil {
 		return nil, fmt.Errorf("error creating rancher client: %s", err)
 	}
 
-	cc.rancher = NewRancherWebClient(rancherClient)
+	cc.rancher = NewRancherWebClient(rancherClient,
+		&retrier{api: "rancher", retries: cc.rancherRetries, backoff: cc.retryBackoff, ctx: ctx})
 
-	cc.icinga, err = icinga2.New(icinga2.WebClient{
+	icingaClient, err := icinga2.New(icinga2.WebClient{
 		URL:         os.Getenv("ICINGA_URL"),
 		Username:    os.Getenv("ICINGA_USER"),
 		Password:    os.Getenv("ICINGA_PASSWORD"),
@@ -233,6 +399,49 @@ func NewConfig() (cc *RancherIcingaConfig, err error) {
 		return nil, fmt.Errorf("error creating icinga client: %s", err)
 	}
 
+	api := NewIcingaWebClient(icingaClient, os.Getenv("ICINGA_URL"), os.Getenv("ICINGA_USER"),
+		os.Getenv("ICINGA_PASSWORD"), cc.debugMode, cc.insecureTLS)
+	api.napping.Client.Timeout = cc.icingaTimeout
+	withContext(api.napping.Client, ctx)
+	api.retry = &retrier{api: "icinga", retries: cc.icingaRetries, backoff: cc.retryBackoff, ctx: ctx}
+	cc.icinga = api
+
+	// the API is optional for the other backends, but needed for downtimes and passive checks
+	var optionalAPI IcingaGenClient
+	if os.Getenv("ICINGA_URL") != "" {
+		optionalAPI = api
+	}
+
+	// create the objects in Icinga Director or write configuration files or a config package instead of creating
+	// them through the API
+	switch {
+	case os.Getenv("ICINGA_DIRECTOR_URL") != "":
+		director := NewIcingaDirectorClient(os.Getenv("ICINGA_DIRECTOR_URL"), os.Getenv("ICINGA_DIRECTOR_USER"),
+			os.Getenv("ICINGA_DIRECTOR_PASSWORD"), optionalAPI, cc.debugMode, cc.insecureTLS)
+		director.napping.Client.Timeout = cc.icingaTimeout
+		withContext(director.napping.Client, ctx)
+		director.retry = &retrier{api: "director", retries: cc.icingaRetries, backoff: cc.retryBackoff, ctx: ctx}
+		cc.icinga = director
+	case os.Getenv("ICINGA_CONFIG_PACKAGE") != "":
+		output := &configPackageOutput{icinga: api, pkg: os.Getenv("ICINGA_CONFIG_PACKAGE")}
+		cc.icinga, err = NewIcingaConfigClient(output, api, cc.rancherInstallation, os.Getenv("ICINGA_GLOBAL_ZONE"))
+	case os.Getenv("ICINGA_CONFIG_DIR") != "":
+		// without the API, Icinga2 must be reloaded by other means
+		output := &configDirOutput{dir: os.Getenv("ICINGA_CONFIG_DIR"), api: optionalAPI}
+		cc.icinga, err = NewIcingaConfigClient(output, optionalAPI, cc.rancherInstallation, os.Getenv("ICINGA_GLOBAL_ZONE"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating icinga configuration backend: %s", err)
+	}
+
+	var lockAPI lockStore
+	if os.Getenv("ICINGA_URL") != "" {
+		lockAPI = api
+	}
+	if cc.leaderLock, err = newLeaderLock(cc, lockAPI); err != nil {
+		return nil, err
+	}
+
 	return
 }
 
@@ -256,32 +465,45 @@ func syncRancherEnvironments(config *RancherIcingaConfig) error {
 		fmt.Errorf("error fetching icinga hostgroups: %s", err)
 	}
 
+	groupAttrs, err := config.icinga.ListObjects("HostGroup", []string{"groups", "templates"})
+	if err != nil {
+		return fmt.Errorf("error fetching icinga hostgroup attributes: %s", err)
+	}
+
 	for _, env := range environments.Data {
-		debugLog("Syncing environment "+env.Name, 2)
-		if !filterEnvironment(config.rancher, env, config.filterEnvironments) {
-			debugLog("  disabled by filter", 2)
-			continue
-		}
+		isolateEnvironment(config, env, func() {
+			debugLog("Syncing environment "+env.Name, 2)
+			if !filterEnvironment(config.rancher, env, config.filterEnvironments) {
+				debugLog("  disabled by filter", 2)
+				return
+			}
 
-		found := false
-		for _, hg := range hostGroups {
-			debugLog("  Checking hostgroup "+hg.Name, 2)
-			if config.matches(hg.Vars, "environment", env.Name, "", "") {
-				debugLog("    found", 2)
-				found = true
-				continue
+			found := false
+			for _, hg := range hostGroups {
+				debugLog("  Checking hostgroup "+hg.Name, 2)
+				if config.matches(hg.Vars, "environment", env.Name, "", "") {
+					if recreateForImports(config, "HostGroup", hg.Name, groupAttrs[hg.Name], config.hostgroupImports) {
+						continue
+					}
+					debugLog("    found", 2)
+					found = true
+					syncEnvironmentHostGroupParent(config, groupAttrs, hg.Name)
+					continue
+				}
 			}
-		}
-		if found == false {
-			name := execTemplate(config.environmentNameTemplate, "", env.Name, "", "")
-			vars := varsForEnvironment(config, env)
-			err = config.icinga.CreateHostGroup(icinga2.HostGroup{Name: name, Vars: vars})
-			if err != nil {
-				fmt.Printf("ERROR: could not create hostgroup %s: %s\n", name, err)
+			if found == false {
+				name := execTemplate(config.environmentNameTemplate, "", env.Name, "", "")
+				vars := varsForEnvironment(config, env)
+				err = createHostGroup(config, icinga2.HostGroup{Name: name, Vars: vars}, config.hostgroupImports)
+				if err != nil {
+					fmt.Printf("ERROR: could not create hostgroup %s: %s\n", name, err)
+				} else {
+					syncEnvironmentHostGroupParent(config, nil, name)
+				}
+				debugLog("Creating host group "+name+" for environment", 1)
+				config.registerChange("create", name, "hostgroup", vars, icinga2.HostGroup{Name: name, Vars: vars})
 			}
-			debugLog("Creating host group "+name+" for environment", 1)
-			registerChange("create", name, "hostgroup", vars, icinga2.HostGroup{Name: name, Vars: vars})
-		}
+		})
 	}
 
 	return nil
@@ -289,7 +511,7 @@ func syncRancherEnvironments(config *RancherIcingaConfig) error {
 
 func syncIcingaHostgroups(config *RancherIcingaConfig) error {
 
-	deleteme := []string{}
+	deleteme := []icinga2.HostGroup{}
 
 	environments, err := config.rancher.Environments()
 	if err != nil {
@@ -301,35 +523,50 @@ func syncIcingaHostgroups(config *RancherIcingaConfig) error {
 		return fmt.Errorf("error fetching icinga hostgroups: %s", err)
 	}
 
+	groups, err := rancherHostGroups(config)
+	if err != nil {
+		return err
+	}
+
 	for _, hg := range hostGroups {
-		debugLog("Syncing hostgroup "+hg.Name, 2)
-		if !config.matches(hg.Vars, "environment", "", "", "") {
-			debugLog("  skipping, was not created for our rancher installation", 2)
-			continue // not created by rancher-icinga
-		}
-		found := false
-		for _, env := range environments.Data {
-			debugLog("  Checking environment "+env.Name, 2)
-			if filterEnvironment(config.rancher, env, config.filterEnvironments) &&
-				config.matches(hg.Vars, "environment", env.Name, "", "") {
-				debugLog("    found", 2)
-				found = true
-				continue
+		isolateIcingaObject(config, "hostgroup", hg.Name, func() {
+			debugLog("Syncing hostgroup "+hg.Name, 2)
+			if config.matches(hg.Vars, "hostgroup", "", "", "") {
+				if !containsStrings(groups, []string{hg.Name}) && !config.objectsFailed() {
+					debugLog("Remove hostgroup "+hg.Name, 1)
+					deleteme = append(deleteme, hg)
+				}
+				return
 			}
-		}
-		if found == false {
-			registerChange("delete", hg.Name, "hostgroup", icinga2.Vars{}, hg)
-			debugLog("Remove hostgroup "+hg.Name+" for environment", 1)
-			deleteme = append(deleteme, hg.Name)
-			// defer config.icinga.DeleteHostGroup(hg.Name)
-		}
+			if !config.matches(hg.Vars, "environment", "", "", "") {
+				debugLog("  skipping, was not created for our rancher installation", 2)
+				return // not created by rancher-icinga
+			}
+			found := false
+			for _, env := range environments.Data {
+				debugLog("  Checking environment "+env.Name, 2)
+				if filterEnvironment(config.rancher, env, config.filterEnvironments) &&
+					config.matches(hg.Vars, "environment", env.Name, "", "") {
+					debugLog("    found", 2)
+					found = true
+					continue
+				}
+			}
+			if found == false {
+				debugLog("Remove hostgroup "+hg.Name+" for environment", 1)
+				deleteme = append(deleteme, hg)
+				// defer config.icinga.DeleteHostGroup(hg.Name)
+			}
+		})
 	}
 
-	for _, x := range deleteme {
-		err := config.icinga.DeleteHostGroup(x)
+	for _, hg := range deleteme {
+		err := config.icinga.DeleteHostGroup(hg.Name)
 
 		if err != nil {
-			fmt.Println("ERROR: could not delete icinga hostgroup %s: %s\n", x, err)
+			fmt.Println("ERROR: could not delete icinga hostgroup %s: %s\n", hg.Name, err)
+		} else {
+			config.registerChange("delete", hg.Name, "hostgroup", icinga2.Vars{}, hg)
 		}
 	}
 
@@ -352,124 +589,187 @@ func syncRancherHosts(config *RancherIcingaConfig) error {
 		return fmt.Errorf("error fetching rancher services: %s", err)
 	}
 
+	serviceAttrs, err := config.icinga.ListObjects("Service", append(customCheckAttrs, "templates"))
+	if err != nil {
+		return fmt.Errorf("error fetching icinga service attributes: %s", err)
+	}
+
+	hostAttrs, err := config.icinga.ListObjects("Host", []string{"templates", "zone"})
+	if err != nil {
+		return fmt.Errorf("error fetching icinga host attributes: %s", err)
+	}
+
 	for _, rh := range rancherHosts.Data {
-		debugLog("Syncing host "+rh.Hostname, 2)
+		isolateHost(config, rh, func() {
+			debugLog("Syncing host "+rh.Hostname, 2)
 
-		environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
+			environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
 
-		if !filterHost(config.rancher, rh, config.filterHosts) ||
-			!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) {
-			debugLog("  disabled by filter", 2)
-			continue
-		}
+			if !filterHost(config.rancher, rh, config.filterHosts) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) {
+				debugLog("  disabled by filter", 2)
+				return
+			}
+			config.state.rancherObject("Host", rh.Hostname, rh.Id)
 
-		found := false
+			found := false
 
-		var notesURL string
+			var notesURL string
 
-		if n, ok := rh.Labels[HOST_NOTES_URL_LABEL].(string); ok {
-			notesURL = n
-		}
+			if n, ok := rh.Labels[HOST_NOTES_URL_LABEL].(string); ok {
+				notesURL = n
+			}
 
-		for _, ih := range icingaHosts {
-			debugLog("  Checking icinga host "+ih.Name, 2)
-			if config.matches(ih.Vars, "host", environmentName, "", "") && rh.Hostname == ih.Name {
-				debugLog("    found", 2)
-				found = true
+			imports := importsFor(config.hostImports, rh.Labels)
+			zone := zoneOf(config, environmentName, rh.Labels)
+			endpoint := agentEndpoint(config, rh.Hostname)
+
+			for _, ih := range icingaHosts {
+				debugLog("  Checking icinga host "+ih.Name, 2)
+				if config.matches(ih.Vars, "host", environmentName, "", "") && rh.Hostname == ih.Name {
+					if recreateForImports(config, "Host", ih.Name, hostAttrs[ih.Name], imports) ||
+						recreateForZone(config, "Host", ih.Name, hostAttrs[ih.Name], zone) {
+						icingaServices = servicesNotOn(icingaServices, ih.Name)
+						continue
+					}
+					debugLog("    found", 2)
+					found = true
 
-				needUpdate := false
+					needUpdate := false
 
-				if notesURL != ih.NotesURL {
-					debugLog("Updating host "+ih.Name+" with notes_url "+notesURL, 1)
-					ih.NotesURL = notesURL
-					needUpdate = true
-				}
+					if notesURL != ih.NotesURL {
+						debugLog("Updating host "+ih.Name+" with notes_url "+notesURL, 1)
+						ih.NotesURL = notesURL
+						needUpdate = true
+					}
 
-				newVars := varsForHost(config, rh, environmentName)
+					newVars := varsForHost(config, rh, environmentName)
 
-				if varsNeedUpdate(newVars, ih.Vars) {
-					ih.Vars = newVars
-					needUpdate = true
-				}
+					if varsNeedUpdate(newVars, ih.Vars) {
+						ih.Vars = newVars
+						needUpdate = true
+					}
 
-				if needUpdate {
-					debugLog("    update "+ih.Name, 1)
-					err = config.icinga.UpdateHost(ih)
-					if err != nil {
-						fmt.Printf("ERROR: could not update host %s: %s\n", ih.Name, err)
-					} else {
-						registerChange("update", ih.Name, "host", ih.Vars, ih)
+					if groups := hostGroupsOfHost(config, rh, environmentName); !equalGroups(groups, ih.Groups) {
+						debugLog("Updating host "+ih.Name+" with groups", 1)
+						ih.Groups = groups
+						needUpdate = true
+					}
+
+					if needUpdate {
+						debugLog("    update "+ih.Name, 1)
+						err = config.icinga.UpdateHost(ih)
+						if err != nil {
+							fmt.Printf("ERROR: could not update host %s: %s\n", ih.Name, err)
+						} else {
+							config.registerChange("update", ih.Name, "host", ih.Vars, ih)
+						}
 					}
 				}
 			}
-		}
-		if found == false {
-			vars := varsForHost(config, rh, environmentName)
-			ih := icinga2.Host{
-				Name:         rh.Hostname,
-				Address:      rh.AgentIpAddress,
-				Groups:       []string{environmentName},
-				CheckCommand: config.hostCheckCommand,
-				NotesURL:     notesURL,
-				Vars:         vars}
-			err = config.icinga.CreateHost(ih)
-			if err != nil {
-				fmt.Printf("ERROR: could not create host %s: %s\n", rh.Hostname, err)
+			if found == false {
+				vars := varsForHost(config, rh, environmentName)
+				ih := icinga2.Host{
+					Name:         rh.Hostname,
+					Address:      rh.AgentIpAddress,
+					Groups:       hostGroupsOfHost(config, rh, environmentName),
+					CheckCommand: config.hostCheckCommand,
+					NotesURL:     notesURL,
+					Vars:         vars,
+					Zone:         zone}
+				err = createHost(config, ih, imports)
+				if err != nil {
+					fmt.Printf("ERROR: could not create host %s: %s\n", rh.Hostname, err)
+				}
+
+				debugLog("Creating rancher agent host "+rh.Hostname, 1)
+				config.registerChange("create", rh.Hostname, "host", vars, ih)
 			}
 
-			debugLog("Creating rancher agent host "+rh.Hostname, 1)
-			registerChange("create", rh.Hostname, "host", vars, ih)
-		}
+			// Create a rancher-agent service for each agent host
 
-		// Create a rancher-agent service for each agent host
+			found = false
 
-		found = false
+			for _, is := range icingaServices {
+				debugLog("  Checking service "+is.Name, 2)
+				if config.matches(is.Vars, "rancher-agent", environmentName, "", "") &&
+					rh.Hostname == is.HostName &&
+					is.Vars[RANCHER_HOST] == rh.Hostname {
+					current := serviceAttrs[is.HostName+"!"+is.Name]
+					if recreateForImports(config, "Service", is.HostName+"!"+is.Name, current, config.agentServiceImports) ||
+						recreateForZone(config, "Service", is.HostName+"!"+is.Name, current, zone) {
+						continue
+					}
+					debugLog("    found", 2)
+					found = true
 
-		for _, is := range icingaServices {
-			debugLog("  Checking service "+is.Name, 2)
-			if config.matches(is.Vars, "rancher-agent", environmentName, "", "") &&
-				rh.Hostname == is.HostName &&
-				is.Vars[RANCHER_HOST] == rh.Hostname {
-				debugLog("    found", 2)
-				found = true
+					needUpdate := false
 
-				needUpdate := false
+					if notesURL != is.NotesURL {
+						debugLog("Updating rancher agent service "+is.Name+" with notes_url "+notesURL, 1)
+						is.NotesURL = notesURL
+						needUpdate = true
+					}
 
-				if notesURL != is.NotesURL {
-					debugLog("Updating rancher agent service "+is.Name+" with notes_url "+notesURL, 1)
-					is.NotesURL = notesURL
-					needUpdate = true
-				}
+					if e, _ := current["command_endpoint"].(string); e != endpoint {
+						debugLog("Updating rancher agent service "+is.Name+" with command_endpoint "+endpoint, 1)
+						err = config.icinga.UpdateObject("Service", is.HostName+"!"+is.Name,
+							IcingaAttrs{"command_endpoint": endpoint})
+						if err != nil {
+							fmt.Printf("ERROR: could not update service %s: %s\n", is.Name, err)
+						} else {
+							config.registerChange("update", is.Name, "service", is.Vars, endpoint)
+						}
+					}
 
-				if needUpdate {
-					debugLog("    update "+is.Name, 1)
-					err = config.icinga.UpdateService(is)
-					if err != nil {
-						fmt.Printf("ERROR: could not update host %s: %s\n", is.Name, err)
-					} else {
-						registerChange("update", is.Name, "service", is.Vars, is)
+					if needUpdate {
+						debugLog("    update "+is.Name, 1)
+						err = config.icinga.UpdateService(is)
+						if err != nil {
+							fmt.Printf("ERROR: could not update host %s: %s\n", is.Name, err)
+						} else {
+							config.registerChange("update", is.Name, "service", is.Vars, is)
+						}
 					}
 				}
 			}
-		}
 
-		if found == false {
-			vars := varsForAgentService(config, rh.Hostname, environmentName)
+			if found == false {
+				vars := varsForAgentService(config, rh.Hostname, environmentName)
 
-			debugLog("Creating agent service check for host "+rh.Hostname, 1)
-			is := icinga2.Service{
-				Name:         "rancher-agent",
-				HostName:     rh.Hostname,
-				CheckCommand: config.agentServiceCheckCommand,
-				NotesURL:     notesURL,
-				Vars:         vars}
-			err = config.icinga.CreateService(is)
-			if err != nil {
-				fmt.Printf("ERROR: could not create service %s!rancher-agent: %s\n", rh.Hostname, err)
+				debugLog("Creating agent service check for host "+rh.Hostname, 1)
+				is := icinga2.Service{
+					Name:         "rancher-agent",
+					HostName:     rh.Hostname,
+					CheckCommand: config.agentServiceCheckCommand,
+					NotesURL:     notesURL,
+					Vars:         vars,
+					Zone:         zone}
+				extra := IcingaAttrs{}
+				if endpoint != "" {
+					extra["command_endpoint"] = endpoint
+				}
+				err = createService(config, is, config.agentServiceImports, extra)
+				if err != nil {
+					fmt.Printf("ERROR: could not create service %s!rancher-agent: %s\n", rh.Hostname, err)
+				}
+
+				config.registerChange("create", is.Name, "service", vars, is)
 			}
 
-			registerChange("create", is.Name, "service", vars, is)
-		}
+			hostChecks, problems := customChecksOf(rh.Labels, "rancher-agent")
+			problems = append(problems, validateNotifications(config, rh.Labels)...)
+			for _, p := range problems {
+				config.reportConfigError(rh.Hostname, varsForConfigCheck(config, environmentName, "", rh.Hostname),
+					"host "+rh.Hostname+": "+p)
+			}
+
+			hostChecks = checksInZone(hostChecks, zone, endpoint)
+
+			syncCustomChecks(config, icingaServices, serviceAttrs, rh.Hostname, hostChecks, func(check CustomCheck) icinga2.Vars {
+				return varsForHostCheck(config, check, rh.Hostname, environmentName)
+			}, "host-check", environmentName, "", "")
+		})
 	}
 
 	return nil
@@ -477,7 +777,7 @@ func syncRancherHosts(config *RancherIcingaConfig) error {
 
 func syncIcingaHosts(config *RancherIcingaConfig) error {
 
-	deleteme := []string{}
+	deleteme := []icinga2.Host{}
 
 	rancherHosts, err := config.rancher.Hosts()
 	if err != nil {
@@ -495,46 +795,49 @@ func syncIcingaHosts(config *RancherIcingaConfig) error {
 	}
 
 	for _, ih := range icingaHosts {
-		debugLog("Syncing icinga host "+ih.Name, 2)
-		if !config.matches(ih.Vars, "host/stack", "", "", "") {
-			debugLog("  skipping, type or installation do not match", 2)
-			continue // wrong type or not created by rancher-icinga
-		}
-		found := false
-		for _, rh := range rancherHosts.Data {
-			environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
-			if config.matches(ih.Vars, "host", environmentName, "", "") &&
-				filterHost(config.rancher, rh, config.filterHosts) &&
-				filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) &&
-				ih.Name == rh.Hostname {
-				debugLog("    found", 2)
-				found = true
+		isolateIcingaObject(config, "host", ih.Name, func() {
+			debugLog("Syncing icinga host "+ih.Name, 2)
+			if !config.matches(ih.Vars, "host/stack", "", "", "") {
+				debugLog("  skipping, type or installation do not match", 2)
+				return // wrong type or not created by rancher-icinga
+			}
+			found := false
+			for _, rh := range rancherHosts.Data {
+				environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
+				if config.matches(ih.Vars, "host", environmentName, "", "") &&
+					filterHost(config.rancher, rh, config.filterHosts) &&
+					filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) &&
+					ih.Name == rh.Hostname {
+					debugLog("    found", 2)
+					found = true
+				}
 			}
-		}
 
-		for _, s := range stacks.Data {
-			environmentName := config.rancher.GetEnvironment(s.AccountId).Name
-			debugLog("  Checking stack "+environmentName+"."+s.Name, 2)
-			if config.matches(ih.Vars, "stack", environmentName, s.Name, "") &&
-				filterStack(config.rancher, s, config.filterStacks) &&
-				filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
-				debugLog("    found", 2)
-				found = true
+			for _, s := range stacks.Data {
+				environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+				debugLog("  Checking stack "+environmentName+"."+s.Name, 2)
+				if config.matches(ih.Vars, "stack", environmentName, s.Name, "") &&
+					filterStack(config.rancher, s, config.filterStacks) &&
+					filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
+					debugLog("    found", 2)
+					found = true
+				}
 			}
-		}
 
-		if found == false {
-			registerChange("delete-cascade", ih.Name, "host", icinga2.Vars{}, ih)
-			debugLog("Removing rancher agent host "+ih.Name, 1)
-			deleteme = append(deleteme, ih.Name)
-		}
+			if found == false {
+				debugLog("Removing rancher agent host "+ih.Name, 1)
+				deleteme = append(deleteme, ih)
+			}
+		})
 	}
 
-	for _, x := range deleteme {
-		err := config.icinga.DeleteHost(x)
+	for _, ih := range deleteme {
+		err := config.icinga.DeleteHost(ih.Name)
 
 		if err != nil {
-			fmt.Println("ERROR: could not delete icinga host %s: %s\n", x, err)
+			fmt.Println("ERROR: could not delete icinga host %s: %s\n", ih.Name, err)
+		} else {
+			config.registerChange("delete-cascade", ih.Name, "host", icinga2.Vars{}, ih)
 		}
 	}
 
@@ -552,82 +855,132 @@ func syncRancherStacks(config *RancherIcingaConfig) error {
 		return fmt.Errorf("error fetching icinga hosts: %s", err)
 	}
 
-	for _, s := range stacks.Data {
-		environmentName := config.rancher.GetEnvironment(s.AccountId).Name
-		debugLog("Syncing stack ["+environmentName+"] "+s.Name, 2)
-		if !filterStack(config.rancher, s, config.filterStacks) ||
-			!filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
-			debugLog("  disabled by filter", 2)
-			continue
-		}
+	icingaServices, err := config.icinga.ListServices()
+	if err != nil {
+		return fmt.Errorf("error fetching icinga services: %s", err)
+	}
 
-		notesURL := ""
-		services, err := config.servicesOf(s)
-		if err != nil {
-			fmt.Errorf("error fetching rancher services: %s", err)
-		}
+	serviceAttrs, err := config.icinga.ListObjects("Service", append(customCheckAttrs, "templates"))
+	if err != nil {
+		return fmt.Errorf("error fetching icinga service attributes: %s", err)
+	}
+
+	hostAttrs, err := config.icinga.ListObjects("Host", []string{"templates", "zone"})
+	if err != nil {
+		return fmt.Errorf("error fetching icinga host attributes: %s", err)
+	}
 
-		for _, service := range services.Data {
-			if l, ok := service.LaunchConfig.Labels[STACK_NOTES_URL_LABEL].(string); ok {
-				notesURL = l
+	for _, s := range stacks.Data {
+		isolateStack(config, s, func() {
+			environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+			debugLog("Syncing stack ["+environmentName+"] "+s.Name, 2)
+			if !filterStack(config.rancher, s, config.filterStacks) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
+				debugLog("  disabled by filter", 2)
+				return
 			}
-		}
 
-		found := false
-		for _, ih := range icingaHosts {
-			debugLog("  Checking icinga host "+ih.Name, 2)
-			if config.matches(ih.Vars, "stack", environmentName, s.Name, "") {
-				debugLog("    found", 2)
-				found = true
+			stackHostname := execTemplate(config.stackNameTemplate, "", environmentName, s.Name, "")
+			configCheckVars := varsForConfigCheck(config, environmentName, s.Name, "")
+			config.state.rancherObject("Host", stackHostname, s.Id)
 
-				needUpdate := false
+			sc, warnings := stackConfigOf(config.rancher, s)
+			for _, w := range warnings {
+				config.reportConfigError(stackHostname, configCheckVars, "stack "+s.Name+": "+w)
+			}
+			for _, p := range validateNotifications(config, stackLabels(sc)) {
+				config.reportConfigError(stackHostname, configCheckVars, "stack "+s.Name+": "+p)
+			}
 
-				if notesURL != ih.NotesURL {
-					debugLog("Updating host "+ih.Name+" with notes_url "+notesURL+" original is "+ih.NotesURL, 1)
-					ih.NotesURL = notesURL
-					needUpdate = true
+			stackChecks := sc.CustomChecks
+			if problems := validateCustomChecks(stackChecks, stackServiceNames(config.rancher, s)...); len(problems) > 0 {
+				for _, p := range problems {
+					config.reportConfigError(stackHostname, configCheckVars, "stack "+s.Name+": "+p)
 				}
+				stackChecks = nil
+			}
 
-				newVars := varsForStack(config, s, environmentName)
+			notesURL := sc.NotesURL
 
-				if varsNeedUpdate(newVars, ih.Vars) {
-					ih.Vars = newVars
-					needUpdate = true
-				}
+			imports := append([]string{}, config.stackImports...)
+			for _, t := range sc.Templates {
+				imports = addGroup(imports, t)
+			}
 
-				if needUpdate {
-					debugLog("    update "+ih.Name, 1)
-					err = config.icinga.UpdateHost(ih)
-					if err != nil {
-						fmt.Printf("ERROR: could not update host %s: %s\n", ih.Name, err)
+			zone := zoneOf(config, environmentName, stackLabels(sc))
+
+			found := false
+			for _, ih := range icingaHosts {
+				debugLog("  Checking icinga host "+ih.Name, 2)
+				if config.matches(ih.Vars, "stack", environmentName, s.Name, "") {
+					if recreateForImports(config, "Host", ih.Name, hostAttrs[ih.Name], imports) ||
+						recreateForZone(config, "Host", ih.Name, hostAttrs[ih.Name], zone) {
+						icingaServices = servicesNotOn(icingaServices, ih.Name)
+						continue
 					}
-					registerChange("update", ih.Name, "host", ih.Vars, ih)
-				}
+					debugLog("    found", 2)
+					found = true
 
-			}
-		}
-		if found == false {
-			name := execTemplate(config.stackNameTemplate, "", environmentName, s.Name, "")
-			vars := varsForStack(config, s, environmentName)
-			ih := icinga2.Host{
-				Name:         name,
-				Groups:       []string{environmentName},
-				CheckCommand: config.stackCheckCommand,
-				NotesURL:     notesURL,
-				Vars:         vars}
-			err = config.icinga.CreateHost(ih)
-			if err != nil {
-				fmt.Printf("ERROR: could not create host %s: %s\n", name, err)
-			}
+					needUpdate := false
 
-			debugLog("Creating host "+name+" for stack "+s.Name, 1)
-			registerChange("create", name, "host", vars, ih)
-		}
+					if notesURL != ih.NotesURL {
+						debugLog("Updating host "+ih.Name+" with notes_url "+notesURL+" original is "+ih.NotesURL, 1)
+						ih.NotesURL = notesURL
+						needUpdate = true
+					}
 
-	}
+					newVars := varsForStack(config, s, environmentName)
 
-	return nil
-}
+					if varsNeedUpdate(newVars, ih.Vars) {
+						ih.Vars = newVars
+						needUpdate = true
+					}
+
+					if groups := hostGroupsOfStack(config, s, environmentName); !equalGroups(groups, ih.Groups) {
+						debugLog("Updating host "+ih.Name+" with groups", 1)
+						ih.Groups = groups
+						needUpdate = true
+					}
+
+					if needUpdate {
+						debugLog("    update "+ih.Name, 1)
+						err = config.icinga.UpdateHost(ih)
+						if err != nil {
+							fmt.Printf("ERROR: could not update host %s: %s\n", ih.Name, err)
+						}
+						config.registerChange("update", ih.Name, "host", ih.Vars, ih)
+					}
+
+				}
+			}
+			if found == false {
+				name := execTemplate(config.stackNameTemplate, "", environmentName, s.Name, "")
+				vars := varsForStack(config, s, environmentName)
+				ih := icinga2.Host{
+					Name:         name,
+					Groups:       hostGroupsOfStack(config, s, environmentName),
+					CheckCommand: config.stackCheckCommand,
+					NotesURL:     notesURL,
+					Vars:         vars,
+					Zone:         zone}
+				err = createHost(config, ih, imports)
+				if err != nil {
+					fmt.Printf("ERROR: could not create host %s: %s\n", name, err)
+				}
+
+				debugLog("Creating host "+name+" for stack "+s.Name, 1)
+				config.registerChange("create", name, "host", vars, ih)
+			}
+
+			syncCustomChecks(config, icingaServices, serviceAttrs, stackHostname,
+				checksInZone(stackChecks, zone, ""), func(check CustomCheck) icinga2.Vars {
+					return varsForStackCheck(config, check, environmentName, s.Name)
+				}, "stack-check", environmentName, s.Name, "")
+		})
+	}
+
+	return nil
+}
 
 func syncRancherServices(config *RancherIcingaConfig) error {
 	rancherServices, err := config.rancher.Services()
@@ -640,152 +993,240 @@ func syncRancherServices(config *RancherIcingaConfig) error {
 		return fmt.Errorf("error fetching icinga services: %s", err)
 	}
 
-	for _, rs := range rancherServices.Data {
-		stackName := config.rancher.GetStack(rs.StackId).Name
-		environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
-
-		debugLog("Syncing service "+environmentName+"."+stackName+"/"+rs.Name, 2)
-
-		if !filterService(config.rancher, rs, config.filterServices) {
-			debugLog("  service disabled by filter", 2)
-			continue
-		}
-
-		if !filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) {
-			debugLog("  stack disabled by filter", 2)
-			continue
-		}
-
-		if !filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) {
-			debugLog("  environment disabled by filter", 2)
-			continue
-		}
+	serviceAttrs, err := config.icinga.ListObjects("Service", append(customCheckAttrs, "templates"))
+	if err != nil {
+		return fmt.Errorf("error fetching icinga service attributes: %s", err)
+	}
 
-		customChecks, err := config.parseCustomChecks(rs)
-		if err != nil {
-			return fmt.Errorf("error parsing custom checks: %s", err)
-		}
+	for _, rs := range rancherServices.Data {
+		isolateService(config, rs, func() {
+			stackName := config.rancher.GetStack(rs.StackId).Name
+			environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
 
-		found := false
+			debugLog("Syncing service "+environmentName+"."+stackName+"/"+rs.Name, 2)
 
-		for _, is := range icingaServices {
-			debugLog("  Checking icinga service "+is.Name, 2)
-			if config.matches(is.Vars, "service", environmentName, stackName, rs.Name) {
-				debugLog("    found", 2)
-				found = true
+			if !filterService(config.rancher, rs, config.filterServices) {
+				debugLog("  service disabled by filter", 2)
+				return
+			}
 
-				needUpdate := false
+			if !filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) {
+				debugLog("  stack disabled by filter", 2)
+				return
+			}
 
-				if notesURL, ok := rs.LaunchConfig.Labels[SERVICE_NOTES_URL_LABEL].(string); ok {
-					if notesURL != is.NotesURL {
-						debugLog("Updating service "+is.Name+" with notes_url "+notesURL, 1)
-						is.NotesURL = notesURL
-						needUpdate = true
-					}
-				}
+			if !filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) {
+				debugLog("  environment disabled by filter", 2)
+				return
+			}
 
-				newVars := varsForService(config, rs, environmentName, stackName)
+			stackHostname := execTemplate(config.stackNameTemplate, "", environmentName, stackName, rs.Name)
+			config.state.rancherObject("Service", stackHostname+"!"+rs.Name, rs.Id)
 
-				if varsNeedUpdate(newVars, is.Vars) {
-					debugLog("Updating service "+is.Name+" with new vars", 1)
-					is.Vars = newVars
-					needUpdate = true
-				}
+			customChecks, problems := serviceCustomChecks(config, rs, environmentName, stackName)
+			problems = append(problems, validateNotifications(config, rs.LaunchConfig.Labels)...)
+			for _, p := range problems {
+				config.reportConfigError(stackHostname, varsForConfigCheck(config, environmentName, stackName, ""),
+					"service "+rs.Name+": "+p)
+			}
 
-				if needUpdate {
-					debugLog("    update "+is.Name, 1)
-					err = config.icinga.UpdateService(is)
-					if err != nil {
-						fmt.Printf("ERROR: could not update service %s: %s\n", is.Name, err)
-					} else {
-						registerChange("update", is.Name, "service", is.Vars, is)
+			groups := serviceGroupsOf(config, rs, environmentName, stackName)
+			for i := range customChecks {
+				for _, g := range groups {
+					if !containsStrings(customChecks[i].Groups, []string{g}) {
+						customChecks[i].Groups = append(customChecks[i].Groups, g)
 					}
 				}
 			}
-		}
-		if found == false {
-			notesURL, _ := rs.LaunchConfig.Labels[SERVICE_NOTES_URL_LABEL].(string)
-			vars := varsForService(config, rs, environmentName, stackName)
-			hostname := execTemplate(config.stackNameTemplate, "", environmentName, stackName, rs.Name)
-			is := icinga2.Service{
-				Name:         rs.Name,
-				HostName:     hostname,
-				CheckCommand: config.serviceCheckCommand,
-				NotesURL:     notesURL,
-				Vars:         vars}
-			err = config.icinga.CreateService(is)
-			if err != nil {
-				fmt.Printf("ERROR: could not create service %s!%s: %s\n", hostname, rs.Name, err)
-			}
 
-			debugLog("Creating service "+is.Name+" for service "+stackName+"/"+rs.Name, 1)
-			registerChange("create", is.Name, "service", vars, is)
-		}
+			imports := importsFor(config.serviceImports, rs.LaunchConfig.Labels)
 
-		for _, check := range customChecks {
-			debugLog("Checking custom check "+check.Name, 2)
+			sc, _ := stackConfigOf(config.rancher, config.rancher.GetStack(rs.StackId))
+			zone := zoneOf(config, environmentName, stackLabels(sc))
+			customChecks = checksInZone(customChecks, zone, "")
 
 			found := false
-			vars := varsForCustomCheck(config, check, rs, environmentName, stackName)
 
 			for _, is := range icingaServices {
 				debugLog("  Checking icinga service "+is.Name, 2)
-				if config.matches(is.Vars, "custom-check", environmentName, stackName, rs.Name) &&
-					check.Name == is.Name {
+				if config.matches(is.Vars, "service", environmentName, stackName, rs.Name) {
+					if recreateForImports(config, "Service", is.HostName+"!"+is.Name, serviceAttrs[is.HostName+"!"+is.Name], imports) ||
+						recreateForZone(config, "Service", is.HostName+"!"+is.Name, serviceAttrs[is.HostName+"!"+is.Name], zone) {
+						continue
+					}
 					debugLog("    found", 2)
 					found = true
 
+					syncServiceGroupMembership(config, serviceAttrs, is.HostName+"!"+is.Name, groups)
+
 					needUpdate := false
 
-					if check.NotesURL != is.NotesURL {
-						debugLog("Updating custom check service "+is.Name+" with notes_url "+check.NotesURL, 1)
-						is.NotesURL = check.NotesURL
-						needUpdate = true
+					if notesURL, ok := rs.LaunchConfig.Labels[SERVICE_NOTES_URL_LABEL].(string); ok {
+						if notesURL != is.NotesURL {
+							debugLog("Updating service "+is.Name+" with notes_url "+notesURL, 1)
+							is.NotesURL = notesURL
+							needUpdate = true
+						}
 					}
 
-					if varsNeedUpdate(vars, is.Vars) {
-						debugLog("Updating custom check service "+is.Name+" with new vars", 1)
-						is.Vars = vars
+					newVars := varsForService(config, rs, environmentName, stackName)
+
+					if varsNeedUpdate(newVars, is.Vars) {
+						debugLog("Updating service "+is.Name+" with new vars", 1)
+						is.Vars = newVars
 						needUpdate = true
 					}
 
 					if needUpdate {
 						debugLog("    update "+is.Name, 1)
-						config.icinga.UpdateService(is)
+						err = config.icinga.UpdateService(is)
 						if err != nil {
 							fmt.Printf("ERROR: could not update service %s: %s\n", is.Name, err)
 						} else {
-							registerChange("update", is.Name, "service", is.Vars, is)
+							config.registerChange("update", is.Name, "service", is.Vars, is)
 						}
 					}
 				}
 			}
-
 			if found == false {
-				hostname := execTemplate(config.stackNameTemplate, "", environmentName, stackName, check.Name)
+				notesURL, _ := rs.LaunchConfig.Labels[SERVICE_NOTES_URL_LABEL].(string)
+				vars := varsForService(config, rs, environmentName, stackName)
+				hostname := execTemplate(config.stackNameTemplate, "", environmentName, stackName, rs.Name)
 				is := icinga2.Service{
-					Name:         check.Name,
+					Name:         rs.Name,
 					HostName:     hostname,
-					CheckCommand: check.Command,
-					NotesURL:     check.NotesURL,
+					CheckCommand: config.serviceCheckCommand,
+					NotesURL:     notesURL,
 					Vars:         vars}
-				err = config.icinga.CreateService(is)
+				extra := IcingaAttrs{}
+				if len(groups) > 0 {
+					extra["groups"] = groups
+				}
+				is.Zone = zone
+				err = createService(config, is, imports, extra)
 				if err != nil {
-					fmt.Printf("ERROR: could not create service %s!%s: %s\n", hostname, check.Name, err)
+					fmt.Printf("ERROR: could not create service %s!%s: %s\n", hostname, rs.Name, err)
 				}
 
-				debugLog("Creating service "+check.Name+" for custom check "+stackName+"/"+check.Name, 1)
-				registerChange("create", hostname+"!"+check.Name, "service", vars, is)
+				debugLog("Creating service "+is.Name+" for service "+stackName+"/"+rs.Name, 1)
+				config.registerChange("create", is.Name, "service", vars, is)
 			}
 
-		}
+			syncCustomChecks(config, icingaServices, serviceAttrs, stackHostname,
+				customChecks, func(check CustomCheck) icinga2.Vars {
+					return varsForCustomCheck(config, check, rs, environmentName, stackName)
+				}, "custom-check", environmentName, stackName, rs.Name)
+		})
 	}
 
 	return nil
 }
 
+// Creates or updates the Icinga2 services for custom checks on the Icinga2 host hostname. The type, environment,
+// stack and service are the owner of the checks (see matches), checks that are not in the list are left alone
+// and removed by syncIcingaServices. serviceAttrs are the current customCheckAttrs of all services.
+func syncCustomChecks(config *RancherIcingaConfig, icingaServices []icinga2.Service, serviceAttrs map[string]IcingaAttrs,
+	hostname string, checks []CustomCheck, varsFor func(CustomCheck) icinga2.Vars, typ, environment, stack, service string) {
+
+	for _, check := range checks {
+		debugLog("Checking custom check "+check.Name, 2)
+
+		found := false
+		vars := varsFor(check)
+		attrs := check.attrs()
+
+		if len(attrs) > 0 {
+			vars[RANCHER_CUSTOM_ATTRS] = attrs.names()
+		}
+
+		for _, is := range icingaServices {
+			debugLog("  Checking icinga service "+is.Name, 2)
+			if config.matches(is.Vars, typ, environment, stack, service) &&
+				check.Name == is.Name &&
+				hostname == is.HostName {
+				debugLog("    found", 2)
+				found = true
+
+				current := serviceAttrs[is.HostName+"!"+is.Name]
+
+				// Icinga2 cannot change imports or zones, and there is no way to unset attributes
+				if !importsMatch(is.HostName+"!"+is.Name, current, check.Imports) ||
+					check.Zone != "" && current["zone"] != check.Zone ||
+					!containsStrings(attrs.names(), stringList(is.Vars[RANCHER_CUSTOM_ATTRS])) {
+					debugLog("Recreating custom check service "+is.HostName+"!"+is.Name, 1)
+					err := config.icinga.DeleteService(is.HostName + "!" + is.Name)
+					if err != nil {
+						fmt.Printf("ERROR: could not delete service %s!%s: %s\n", is.HostName, is.Name, err)
+						continue
+					}
+					config.registerChange("delete", is.HostName+"!"+is.Name, "service", icinga2.Vars{}, is)
+					found = false
+					continue
+				}
+
+				needUpdate := false
+
+				if check.Command != is.CheckCommand {
+					debugLog("Updating custom check service "+is.Name+" with check_command "+check.Command, 1)
+					is.CheckCommand = check.Command
+					needUpdate = true
+				}
+
+				if check.NotesURL != is.NotesURL {
+					debugLog("Updating custom check service "+is.Name+" with notes_url "+check.NotesURL, 1)
+					is.NotesURL = check.NotesURL
+					needUpdate = true
+				}
+
+				if varsNeedUpdate(vars, is.Vars) {
+					debugLog("Updating custom check service "+is.Name+" with new vars", 1)
+					is.Vars = vars
+					needUpdate = true
+				}
+
+				if needUpdate {
+					debugLog("    update "+is.Name, 1)
+					err := config.icinga.UpdateService(is)
+					if err != nil {
+						fmt.Printf("ERROR: could not update service %s: %s\n", is.Name, err)
+					} else {
+						config.registerChange("update", is.Name, "service", is.Vars, is)
+					}
+				}
+
+				if varsNeedUpdate(icinga2.Vars(attrs), icinga2.Vars(current.only(attrs.names()))) {
+					debugLog("Updating custom check service "+is.Name+" with new attributes", 1)
+					err := config.icinga.UpdateObject("Service", is.HostName+"!"+is.Name, attrs)
+					if err != nil {
+						fmt.Printf("ERROR: could not update service %s: %s\n", is.Name, err)
+					} else {
+						config.registerChange("update", is.Name, "service", is.Vars, attrs)
+					}
+				}
+			}
+		}
+
+		if found == false {
+			is := icinga2.Service{
+				Name:         check.Name,
+				HostName:     hostname,
+				CheckCommand: check.Command,
+				NotesURL:     check.NotesURL,
+				Vars:         vars}
+			err := config.icinga.CreateObject("Service", hostname+"!"+check.Name, check.Imports,
+				mergeAttrs(attrsForService(is), attrs))
+			if err != nil {
+				fmt.Printf("ERROR: could not create service %s!%s: %s\n", hostname, check.Name, err)
+			}
+
+			debugLog("Creating service "+check.Name+" for "+typ+" on "+hostname, 1)
+			config.registerChange("create", hostname+"!"+check.Name, "service", vars, is)
+		}
+	}
+}
+
 func syncIcingaServices(config *RancherIcingaConfig) error {
-	deleteme := []string{}
+	deleteme := []icinga2.Service{}
 
 	rancherServices, err := config.rancher.Services()
 	if err != nil {
@@ -802,127 +1243,301 @@ func syncIcingaServices(config *RancherIcingaConfig) error {
 		return fmt.Errorf("error fetching icinga hosts: %s", err)
 	}
 
+	stacks, err := config.rancher.Stacks()
+	if err != nil {
+		return fmt.Errorf("error fetching rancher stacks: %s", err)
+	}
+
 	for _, is := range icingaServices {
-		debugLog("Syncing icinga service "+is.Name, 2)
-		if !config.matches(is.Vars, "rancher-agent/service/custom-check", "", "", "") {
-			debugLog("  skipping, type or installation do not match", 2)
-			continue // not created by rancher-icinga
-		}
-		found := false
-		for _, rs := range rancherServices.Data {
-			stackName := config.rancher.GetStack(rs.StackId).Name
-			environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
-			debugLog("  Checking service "+environmentName+"."+stackName+"/"+rs.Name, 2)
-			if config.matches(is.Vars, "service", environmentName, stackName, rs.Name) &&
-				filterService(config.rancher, rs, config.filterServices) &&
-				filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) &&
-				filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) {
-				debugLog("    found as the service check", 2)
-				found = true
+		isolateIcingaObject(config, "service", is.HostName+"!"+is.Name, func() {
+			debugLog("Syncing icinga service "+is.Name, 2)
+			if !config.matches(is.Vars, "rancher-agent/service/custom-check/stack-check/host-check", "", "", "") {
+				debugLog("  skipping, type or installation do not match", 2)
+				return // not created by rancher-icinga
 			}
+			found := false
+			for _, rs := range rancherServices.Data {
+				stackName := config.rancher.GetStack(rs.StackId).Name
+				environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
+				debugLog("  Checking service "+environmentName+"."+stackName+"/"+rs.Name, 2)
+				if config.matches(is.Vars, "service", environmentName, stackName, rs.Name) &&
+					filterService(config.rancher, rs, config.filterServices) &&
+					filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) &&
+					filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) {
+					debugLog("    found as the service check", 2)
+					found = true
+				}
 
-			customChecks, err := config.parseCustomChecks(rs)
-			if err != nil {
-				return fmt.Errorf("error parsing custom checks: %s", err)
-			}
+				if !config.matches(is.Vars, "custom-check", environmentName, stackName, rs.Name) ||
+					!filterService(config.rancher, rs, config.filterServices) ||
+					!filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) ||
+					!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) {
+					continue
+				}
 
-			for _, check := range customChecks {
+				customChecks, problems := serviceCustomChecks(config, rs, environmentName, stackName)
+				if len(problems) > 0 {
+					debugLog("    keeping custom checks, the label is invalid", 2)
+					found = true
+				}
 
-				debugLog("  Checking custom check "+check.Name, 2)
+				for _, check := range customChecks {
 
-				if config.matches(is.Vars, "custom-check", environmentName, stackName, rs.Name) &&
-					filterService(config.rancher, rs, config.filterServices) &&
-					filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) &&
-					filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) &&
-					check.Name == is.Name {
-					debugLog("    found as the service check", 2)
+					debugLog("  Checking custom check "+check.Name, 2)
+
+					if check.Name == is.Name {
+						debugLog("    found as a custom check", 2)
+						found = true
+					}
+
+				}
+			}
+
+			for _, rh := range rancherHosts.Data {
+				environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
+				debugLog("  Checking host "+rh.Hostname, 2)
+				if config.matches(is.Vars, "rancher-agent", environmentName, "", "") &&
+					filterHost(config.rancher, rh, config.filterHosts) &&
+					filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) &&
+					is.Vars[RANCHER_HOST] == rh.Hostname &&
+					is.HostName == rh.Hostname {
+					debugLog("    found", 2)
 					found = true
 				}
 
+				if config.matches(is.Vars, "host-check", environmentName, "", "") &&
+					filterHost(config.rancher, rh, config.filterHosts) &&
+					filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) &&
+					is.Vars[RANCHER_HOST] == rh.Hostname &&
+					is.HostName == rh.Hostname {
+
+					hostChecks, problems := customChecksOf(rh.Labels, "rancher-agent")
+					if len(problems) > 0 {
+						debugLog("    keeping host checks, the label is invalid", 2)
+						found = true
+					}
+
+					for _, check := range hostChecks {
+						debugLog("  Checking host check "+check.Name, 2)
+						if check.Name == is.Name {
+							debugLog("    found as a host check", 2)
+							found = true
+						}
+					}
+				}
 			}
-		}
 
-		for _, rh := range rancherHosts.Data {
-			environmentName := config.rancher.GetEnvironment(rh.AccountId).Name
-			debugLog("  Checking host "+rh.Hostname, 2)
-			if config.matches(is.Vars, "rancher-agent", environmentName, "", "") &&
-				filterHost(config.rancher, rh, config.filterHosts) &&
-				filterEnvironment(config.rancher, config.rancher.GetEnvironment(rh.AccountId), config.filterEnvironments) &&
-				is.Vars[RANCHER_HOST] == rh.Hostname &&
-				is.HostName == rh.Hostname {
-				debugLog("    found", 2)
-				found = true
+			for _, s := range stacks.Data {
+				environmentName := config.rancher.GetEnvironment(s.AccountId).Name
+				if !config.matches(is.Vars, "stack-check", environmentName, s.Name, "") ||
+					!filterStack(config.rancher, s, config.filterStacks) ||
+					!filterEnvironment(config.rancher, config.rancher.GetEnvironment(s.AccountId), config.filterEnvironments) {
+					continue
+				}
+
+				// a configuration that could not be read completely may lack checks
+				sc, warnings := stackConfigOf(config.rancher, s)
+
+				if problems := validateCustomChecks(sc.CustomChecks, stackServiceNames(config.rancher, s)...); len(problems) > 0 ||
+					len(warnings) > 0 {
+					debugLog("    keeping stack checks, the configuration is invalid", 2)
+					found = true
+				}
+
+				for _, check := range sc.CustomChecks {
+					debugLog("  Checking stack check "+check.Name, 2)
+					if check.Name == is.Name {
+						debugLog("    found as a stack check", 2)
+						found = true
+					}
+				}
 			}
-		}
 
-		if found == false {
-			debugLog("Removing service "+is.HostName+"!"+is.Name, 1)
-			registerChange("delete", is.HostName+"!"+is.Name, "service", icinga2.Vars{}, is)
-			deleteme = append(deleteme, is.HostName+"!"+is.Name)
-		}
+			if found == false {
+				debugLog("Removing service "+is.HostName+"!"+is.Name, 1)
+				deleteme = append(deleteme, is)
+			}
+		})
 	}
 
-	for _, x := range deleteme {
-		err := config.icinga.DeleteService(x)
+	for _, is := range deleteme {
+		err := config.icinga.DeleteService(is.HostName + "!" + is.Name)
 
 		if err != nil {
-			fmt.Println("ERROR: could not delete icinga service %s: %s\n", x, err)
+			fmt.Println("ERROR: could not delete icinga service %s!%s: %s\n", is.HostName, is.Name, err)
+		} else {
+			config.registerChange("delete", is.HostName+"!"+is.Name, "service", icinga2.Vars{}, is)
 		}
 	}
 
 	return nil
 }
 
-func sync(config *RancherIcingaConfig) error {
-	if err := syncRancherEnvironments(config); err != nil {
-		return err
+// The names of the Icinga2 objects of a type that rancher-icinga does not manage, listed once per sync. Returns
+// false if they could not be listed.
+func listObjectsOnce(config *RancherIcingaConfig, typ string) (map[string]IcingaAttrs, bool) {
+	if config.listedObjects == nil {
+		config.listedObjects = make(map[string]map[string]IcingaAttrs)
 	}
 
-	if err := syncIcingaHostgroups(config); err != nil {
-		return err
+	if objects, ok := config.listedObjects[typ]; ok {
+		return objects, objects != nil
 	}
 
-	if err := syncRancherHosts(config); err != nil {
-		return err
+	objects, err := config.icinga.ListObjects(typ, []string{})
+	if err != nil {
+		fmt.Printf("ERROR: could not list icinga %s objects: %s\n", typ, err)
+		objects = nil
 	}
-	if err := syncRancherStacks(config); err != nil {
-		return err
+	config.listedObjects[typ] = objects
+
+	return objects, objects != nil
+}
+
+func sync(config *RancherIcingaConfig) error {
+	config.configErrors = make(map[string]*configErrors)
+	config.failedObjects = make(map[string]bool)
+	config.listedObjects = nil
+
+	rancher := config.rancher
+	config.rancher = NewRancherSyncClient(rancher)
+	defer func() { config.rancher = rancher }()
+
+	icinga := config.icinga
+	backend := icinga
+	if config.state != nil {
+		if err := config.state.load(); err != nil {
+			return err
+		}
+		backend = NewIcingaStateClient(icinga, config.state)
+	}
+	writes := NewIcingaBatchClient(backend, config.writeConcurrency, config.writeRate)
+	syncClient := NewIcingaSyncClient(writes, config.rancherInstallation)
+	syncClient.state = config.state
+	config.icinga = syncClient
+	defer func() { config.icinga = icinga }()
+	// the writes made are recorded, also if the sync failed
+	defer func() {
+		if err := config.state.save(); err != nil {
+			fmt.Printf("ERROR: could not save STATE_FILE: %s\n", err)
+		}
+	}()
+	// the writes queued before an error are still made, but not committed, unless the sync was abandoned because
+	// this instance is not the leader anymore
+	abandoned := false
+	defer func() {
+		if abandoned || len(writes.queue) == 0 {
+			return
+		}
+		if err := config.renewLeaderLock(); err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			return
+		}
+		writes.Flush()
+	}()
+
+	// the groups, downtimes and dependencies are only removed if no write failed, so the writes of the hosts and
+	// services are made before
+	var flushed error
+	flushWrites := func(*RancherIcingaConfig) error {
+		flushed = writes.Flush()
+		return nil
 	}
-	if err := syncRancherServices(config); err != nil {
-		return err
+
+	phases := []func(*RancherIcingaConfig) error{
+		syncRancherHostGroups,
+		syncRancherEnvironments,
+
+		syncRancherHosts,
+		syncRancherStacks,
+		syncRancherServiceGroups,
+		syncRancherServices,
+
+		syncIcingaHosts,
+		syncIcingaServices,
+		flushWrites,
+		syncIcingaServiceGroups,
+		syncIcingaHostgroups,
+
+		syncDowntimes,
+		syncDependencies,
+		syncConfigChecks,
+		syncPassiveChecks,
 	}
 
-	if err := syncIcingaHosts(config); err != nil {
-		return err
+	for _, phase := range phases {
+		// a stopped sync commits the writes for the objects synced so far
+		if config.canceled() {
+			break
+		}
+		if err := phase(config); err != nil {
+			return err
+		}
+		if err := config.renewLeaderLock(); err != nil {
+			abandoned = true
+			return err
+		}
 	}
-	if err := syncIcingaServices(config); err != nil {
+
+	if err := config.icinga.Commit(); err != nil {
 		return err
 	}
-
-	return nil
+	if config.canceled() {
+		return config.ctx.Err()
+	}
+	return flushed
 }
 
 func main() {
 
-	config, err := NewConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	reload, trigger := handleSignals(cancel)
+
+	config, err := NewConfig(ctx)
 
 	if err != nil {
 		fmt.Printf("PANIC: could not create configuration: %s", err)
 		return
 	}
 
+	// the retries and failures are served by expvar
+	if config.metricsListen != "" {
+		go func() {
+			if err := http.ListenAndServe(config.metricsListen, nil); err != nil {
+				fmt.Printf("ERROR: could not serve metrics: %s\n", err)
+			}
+		}()
+	}
+
+	defer func() {
+		if config.leaderLock != nil {
+			if err := config.leaderLock.release(); err != nil {
+				fmt.Printf("ERROR: could not release the leader lock: %s\n", err)
+			}
+		}
+	}()
+
 	for {
 		fmt.Printf("Refreshing at %s\n", time.Now().Local())
-		err := sync(config)
+		err := syncAsLeader(config)
 
-		if err != nil {
+		if err == context.Canceled {
+			fmt.Println("Stopped after the current object")
+		} else if err != nil {
 			fmt.Printf("ERROR: %s\n", err)
 		}
 
-		if config.refreshInterval <= 0 {
+		if config.refreshInterval <= 0 || ctx.Err() != nil {
 			break
-		} else {
-			time.Sleep(time.Duration(config.refreshInterval) * time.Second)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(config.refreshInterval) * time.Second):
+		case <-trigger:
+		case <-reload:
+			config = reloadConfig(ctx, config)
 		}
 	}
 
@@ -984,6 +1599,69 @@ func mergeVars(a icinga2.Vars, b icinga2.Vars) (r icinga2.Vars) {
 	return
 }
 
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Compares a sorted list of groups with the groups of an Icinga2 object, which can be in any order.
+func equalGroups(sorted, groups []string) bool {
+	g := append([]string{}, groups...)
+	sort.Strings(g)
+	return equalStrings(sorted, g)
+}
+
+// Returns true if all strings in b are also in a.
+func containsStrings(a, b []string) bool {
+	for _, x := range b {
+		found := false
+		for _, y := range a {
+			if x == y {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts a list from a var, which is a []interface{} if it was read from Icinga2, to a list of strings.
+func stringList(v interface{}) []string {
+	res := []string{}
+	switch l := v.(type) {
+	case []string:
+		res = append(res, l...)
+	case []interface{}:
+		for _, e := range l {
+			res = append(res, fmt.Sprintf("%v", e))
+		}
+	}
+	return res
+}
+
+// Registers a change once the write making it succeeded. An object whose write failed counts as failed.
+func (config *RancherIcingaConfig) registerChange(operation, name, icingatype string, vars icinga2.Vars, object interface{}) {
+	q, ok := config.icinga.(writeQueue)
+	if !ok {
+		registerChange(operation, name, icingatype, vars, object)
+		return
+	}
+	q.afterWrite(func() {
+		registerChange(operation, name, icingatype, vars, object)
+	}, func() {
+		config.failedObjects["icinga "+icingatype+" "+name] = true
+	})
+}
+
 func registerChange(operation string, name string, icingatype string, vars icinga2.Vars, object interface{}) {
 	if url := os.Getenv("REGISTER_CHANGES"); url != "" {
 		transport := &http.Transport{
@@ -1008,11 +1686,28 @@ func registerChange(operation string, name string, icingatype string, vars icing
 	}
 }
 
-// unpacks a list of icinga variables from a string (command separated key=value pairs)
-func unpackVars(input string) (res icinga2.Vars) {
+// Unpacks icinga variables from a string. This is either a YAML/JSON map or, for backwards compatibility,
+// a comma separated list of key=value pairs.
+func unpackVars(input string) (res icinga2.Vars, err error) {
+	var doc interface{}
+
+	yamlErr := yaml.Unmarshal([]byte(input), &doc)
+
+	if m, ok := normalizeValue(doc).(map[string]interface{}); yamlErr == nil && ok {
+		return icinga2.Vars(m), nil
+	}
+
+	trimmed := strings.TrimSpace(input)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") || strings.Contains(trimmed, "\n") {
+		if yamlErr != nil {
+			return nil, fmt.Errorf("could not parse vars: %s", yamlErr)
+		}
+		return nil, fmt.Errorf("could not parse vars: not a map")
+	}
+
 	res = make(icinga2.Vars)
 	for _, p := range strings.Split(input, ",") {
-		a := strings.Split(p, "=")
+		a := strings.SplitN(p, "=", 2)
 		if len(a) == 2 {
 			res[a[0]] = a[1]
 		}
@@ -1020,10 +1715,36 @@ func unpackVars(input string) (res icinga2.Vars) {
 	return
 }
 
+// Converts the maps created by the YAML parser to map[string]interface{} so they can be sent to Icinga2 as JSON.
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[fmt.Sprintf("%v", k)] = normalizeValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[k] = normalizeValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(x))
+		for i, e := range x {
+			l[i] = normalizeValue(e)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
 // Checks if the vars of an icinga object matches with the configured rancher installation, the current
 // and environment and is the correct object type.
-// If the type is "rancher-agent/service/custom-check" or "stack/host" it will match all types as those icinga
-// object types are used for different rancher object types.
+// The type can be a list separated by "/" like "rancher-agent/service/custom-check" or "stack/host", it will
+// match all of those types as those icinga object types are used for different rancher object types.
 func (config *RancherIcingaConfig) matches(vars icinga2.Vars, typ, env, stack, service string) bool {
 	var matchesInst, matchesType, matchesEnvironment, matchesStack, matchesService bool
 
@@ -1033,19 +1754,15 @@ func (config *RancherIcingaConfig) matches(vars icinga2.Vars, typ, env, stack, s
 		matchesInst = false
 	}
 
+	matchesType = false
 	if typ == "" {
 		matchesType = true
-	} else if vars[RANCHER_OBJECT_TYPE] == typ {
-		matchesType = true
-	} else if typ == "rancher-agent/service/custom-check" &&
-		(vars[RANCHER_OBJECT_TYPE] == "service" ||
-			vars[RANCHER_OBJECT_TYPE] == "rancher-agent" ||
-			vars[RANCHER_OBJECT_TYPE] == "custom-check") {
-		matchesType = true
-	} else if typ == "host/stack" && (vars[RANCHER_OBJECT_TYPE] == "host" || vars[RANCHER_OBJECT_TYPE] == "stack") {
-		matchesType = true
 	} else {
-		matchesType = false
+		for _, t := range strings.Split(typ, "/") {
+			if vars[RANCHER_OBJECT_TYPE] == t {
+				matchesType = true
+			}
+		}
 	}
 
 	if env == "" {
@@ -1078,13 +1795,13 @@ func (config *RancherIcingaConfig) matches(vars icinga2.Vars, typ, env, stack, s
 // Returns true if an icinga object's vars need updating.
 func varsNeedUpdate(newVars icinga2.Vars, vars icinga2.Vars) bool {
 	for k, v := range newVars {
-		if vars[k] != v {
+		if o, ok := vars[k]; !ok || !varEqual(o, v) {
 			return true
 		}
 	}
 
 	for k, v := range vars {
-		if newVars[k] != v {
+		if n, ok := newVars[k]; !ok || !varEqual(n, v) {
 			return true
 		}
 	}
@@ -1092,6 +1809,19 @@ func varsNeedUpdate(newVars icinga2.Vars, vars icinga2.Vars) bool {
 	return false
 }
 
+// Compares two var values. Icinga2 returns all numbers as floats, so values are compared by their JSON
+// representation: 80 and 80.0 are equal, but "80" and 80 are not.
+func varEqual(a, b interface{}) bool {
+	ja, errA := json.Marshal(normalizeValue(a))
+	jb, errB := json.Marshal(normalizeValue(b))
+
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+
+	return bytes.Equal(ja, jb)
+}
+
 // Generates the vars for a hostgroup
 func varsForEnvironment(config *RancherIcingaConfig, environment client.Project) icinga2.Vars {
 	return mergeVars(config.hostgroupDefaultIcingaVars, icinga2.Vars{
@@ -1110,10 +1840,18 @@ func varsForHost(config *RancherIcingaConfig, host client.Host, environment stri
 
 	labels := host.Labels
 
-	if labels[HOST_VARS_LABEL] != nil && labels[HOST_VARS_LABEL] != "" {
-		vars = mergeVars(vars, unpackVars(labels[HOST_VARS_LABEL].(string)))
+	if l, ok := labels[HOST_VARS_LABEL].(string); !ok && labels[HOST_VARS_LABEL] != nil {
+		fmt.Printf("ERROR: label %s on host %s is not a string\n", HOST_VARS_LABEL, host.Hostname)
+	} else if l != "" {
+		if hostVars, err := unpackVars(l); err != nil {
+			fmt.Printf("ERROR: could not parse label %s on host %s: %s\n", HOST_VARS_LABEL, host.Hostname, err)
+		} else {
+			vars = mergeVars(vars, hostVars)
+		}
 	}
 
+	vars = mergeVars(vars, notificationVars(config, labels))
+
 	return
 }
 
@@ -1139,18 +1877,10 @@ func varsForStack(config *RancherIcingaConfig, stack client.Stack, environment s
 		RANCHER_ENVIRONMENT:  environment,
 		RANCHER_STACK:        stack.Name})
 
-	services, err := config.servicesOf(stack)
-	if err != nil {
-		panic(err)
-	}
-
-	for _, service := range services.Data {
-		labels := service.LaunchConfig.Labels
+	sc, _ := stackConfigOf(config.rancher, stack)
 
-		if labels[STACK_VARS_LABEL] != nil && labels[STACK_VARS_LABEL] != "" {
-			vars = mergeVars(vars, unpackVars(labels[STACK_VARS_LABEL].(string)))
-		}
-	}
+	vars = mergeVars(vars, sc.Vars)
+	vars = mergeVars(vars, notificationVars(config, stackLabels(sc)))
 
 	return
 }
@@ -1164,10 +1894,18 @@ func varsForService(config *RancherIcingaConfig, service client.Service, environ
 
 	labels := service.LaunchConfig.Labels
 
-	if labels[SERVICE_VARS_LABEL] != nil && labels[SERVICE_VARS_LABEL] != "" {
-		vars = mergeVars(vars, unpackVars(labels[SERVICE_VARS_LABEL].(string)))
+	if l, ok := labels[SERVICE_VARS_LABEL].(string); !ok && labels[SERVICE_VARS_LABEL] != nil {
+		fmt.Printf("ERROR: label %s on service %s is not a string\n", SERVICE_VARS_LABEL, service.Name)
+	} else if l != "" {
+		if serviceVars, err := unpackVars(l); err != nil {
+			fmt.Printf("ERROR: could not parse label %s on service %s: %s\n", SERVICE_VARS_LABEL, service.Name, err)
+		} else {
+			vars = mergeVars(vars, serviceVars)
+		}
 	}
 
+	vars = mergeVars(vars, notificationVars(config, labels))
+
 	if environment != "" {
 		vars[RANCHER_ENVIRONMENT] = environment
 	}
@@ -1186,22 +1924,181 @@ func varsForCustomCheck(config *RancherIcingaConfig, check CustomCheck, service
 	return
 }
 
-// Find the services for a stack
-func (config *RancherIcingaConfig) servicesOf(stack client.Stack) (*client.ServiceCollection, error) {
-	coll := make([]client.Service, 0, len(stack.ServiceIds))
+// Generates the vars for a custom check configured for a rancher host
+func varsForHostCheck(config *RancherIcingaConfig, check CustomCheck, hostname, environment string) (vars icinga2.Vars) {
+	vars = mergeVars(check.Vars,
+		mergeVars(varsForAgentService(config, hostname, environment), icinga2.Vars{
+			RANCHER_OBJECT_TYPE: "host-check"}))
 
-	for _, id := range stack.ServiceIds {
-		coll = append(coll, config.rancher.GetService(id))
+	return
+}
+
+// Generates the vars for a custom check configured for a stack
+func varsForStackCheck(config *RancherIcingaConfig, check CustomCheck, environment, stack string) (vars icinga2.Vars) {
+	vars = mergeVars(check.Vars,
+		mergeVars(config.serviceDefaultIcingaVars, icinga2.Vars{
+			RANCHER_INSTALLATION: config.rancherInstallation,
+			RANCHER_OBJECT_TYPE:  "stack-check",
+			RANCHER_ENVIRONMENT:  environment,
+			RANCHER_STACK:        stack}))
+
+	return
+}
+
+// The Icinga2 service attributes configured for a custom check (see customCheckAttrs).
+func (check CustomCheck) attrs() IcingaAttrs {
+	attrs := make(IcingaAttrs)
+
+	if check.DisplayName != "" {
+		attrs["display_name"] = check.DisplayName
+	}
+	if check.ActionURL != "" {
+		attrs["action_url"] = check.ActionURL
+	}
+	if check.CommandEndpoint != "" {
+		attrs["command_endpoint"] = check.CommandEndpoint
+	}
+	if check.Zone != "" {
+		attrs["zone"] = check.Zone
+	}
+	if check.CheckInterval != nil {
+		attrs["check_interval"] = float64(*check.CheckInterval)
+	}
+	if check.RetryInterval != nil {
+		attrs["retry_interval"] = float64(*check.RetryInterval)
+	}
+	if check.MaxCheckAttempts != nil {
+		attrs["max_check_attempts"] = *check.MaxCheckAttempts
+	}
+	if check.EnableNotifications != nil {
+		attrs["enable_notifications"] = *check.EnableNotifications
+	}
+	if len(check.Groups) > 0 {
+		attrs["groups"] = check.Groups
+	}
+
+	return attrs
+}
+
+func (i *Interval) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds float64
+	if err := unmarshal(&seconds); err == nil {
+		*i = Interval(seconds)
+		return nil
+	}
+
+	var duration string
+	if err := unmarshal(&duration); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return fmt.Errorf("invalid interval %s: %s", duration, err)
+	}
+	*i = Interval(d.Seconds())
+	return nil
+}
+
+// Parses and validates the custom checks from the labels of a service or host. reserved are the names
+// of other services on the same Icinga2 host. If there are any problems, no checks are returned.
+func customChecksOf(labels map[string]interface{}, reserved ...string) ([]CustomCheck, []string) {
+	checks, err := parseCustomChecks(labels)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("could not parse label %s: %s", CUSTOM_CHECKS_LABEL, err)}
+	}
+
+	if problems := validateCustomChecks(checks, reserved...); len(problems) > 0 {
+		return nil, problems
+	}
+
+	return checks, nil
+}
+
+// Parses, expands and validates the custom, auto and load balancer checks of a service. A check that cannot be expanded is left out,
+// other problems leave out all checks.
+func serviceCustomChecks(config *RancherIcingaConfig, service client.Service, environment, stack string) ([]CustomCheck, []string) {
+	checks, err := parseCustomChecks(service.LaunchConfig.Labels)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("could not parse label %s: %s", CUSTOM_CHECKS_LABEL, err)}
+	}
+
+	autoChecks, err := autoChecksOf(config, service)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	checks = mergeAutoChecks(checks, autoChecks)
+
+	if service.Kind == LOAD_BALANCER_KIND {
+		// without the port rules, the existing checks are kept
+		lbChecks, err := loadBalancerChecksOf(config.rancher, service)
+		if err != nil {
+			return nil, []string{err.Error()}
+		}
+		checks = mergeAutoChecks(checks, lbChecks)
 	}
 
-	return &client.ServiceCollection{Data: coll}, nil
+	checks, problems := expandCustomChecks(config, checks, service, environment, stack)
+
+	if p := validateCustomChecks(checks, service.Name); len(p) > 0 {
+		return nil, append(problems, p...)
+	}
+
+	return checks, problems
+}
+
+// Checks custom checks for required attributes, duplicate names and invalid vars.
+func validateCustomChecks(checks []CustomCheck, reserved ...string) (problems []string) {
+	names := make(map[string]bool)
+	for _, r := range append(reserved, CONFIG_CHECK_NAME) {
+		names[r] = true
+	}
+
+	for i, check := range checks {
+		if check.Name == "" {
+			problems = append(problems, fmt.Sprintf("custom check #%d has no name", i+1))
+		} else if strings.ContainsAny(check.Name, "!") {
+			problems = append(problems, fmt.Sprintf("custom check %s: invalid name", check.Name))
+		} else if names[check.Name] {
+			problems = append(problems, fmt.Sprintf("custom check %s: the name is already used", check.Name))
+		}
+		names[check.Name] = true
+
+		if check.Command == "" {
+			problems = append(problems, fmt.Sprintf("custom check %s has no command", check.Name))
+		}
+
+		keys := make([]string, 0, len(check.Vars))
+		for k := range check.Vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if !varNameRegexp.MatchString(k) {
+				problems = append(problems, fmt.Sprintf("custom check %s: invalid var name %s", check.Name, k))
+			} else if strings.HasPrefix(k, "rancher_") {
+				problems = append(problems, fmt.Sprintf("custom check %s: var %s is reserved", check.Name, k))
+			}
+		}
+	}
+
+	return
+}
+
+// The names of the services of a stack.
+func stackServiceNames(rancher RancherGenClient, stack client.Stack) []string {
+	names := make([]string, 0, len(stack.ServiceIds))
+	for _, id := range stack.ServiceIds {
+		names = append(names, rancher.GetService(id).Name)
+	}
+	return names
 }
 
-// Parse custom check configuration from a label
-func (config *RancherIcingaConfig) parseCustomChecks(service client.Service) (checks []CustomCheck, err error) {
+// Parse custom check configuration from the labels of a service or host
+func parseCustomChecks(labels map[string]interface{}) (checks []CustomCheck, err error) {
 	var label string
 
-	if l, ok := service.LaunchConfig.Labels[CUSTOM_CHECKS_LABEL].(string); ok {
+	if l, ok := labels[CUSTOM_CHECKS_LABEL].(string); ok {
 		label = l
 	} else {
 		return []CustomCheck{}, nil
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"github.com/gobwas/glob"
 	"github.com/rancher/go-rancher/v2"
 	"github.com/stretchr/testify/assert"
 )
@@ -21,7 +33,7 @@ func initForTests() *RancherIcingaConfig {
 	config.rancher = rancher
 
 	if script := os.Getenv("ICINGA_TEST_RESET_SCRIPT"); script != "" {
-		config.icinga, _ = icinga2.New(icinga2.WebClient{
+		icingaClient, _ := icinga2.New(icinga2.WebClient{
 			URL:         os.Getenv("ICINGA_URL"),
 			Username:    os.Getenv("ICINGA_USER"),
 			Password:    os.Getenv("ICINGA_PASSWORD"),
@@ -29,6 +41,9 @@ func initForTests() *RancherIcingaConfig {
 			InsecureTLS: true,
 			Zone:        "icinga2-master"})
 
+		config.icinga = NewIcingaWebClient(icingaClient, os.Getenv("ICINGA_URL"), os.Getenv("ICINGA_USER"),
+			os.Getenv("ICINGA_PASSWORD"), false, true)
+
 		cmd := exec.Command(script)
 		output, err := cmd.CombinedOutput()
 
@@ -39,7 +54,7 @@ func initForTests() *RancherIcingaConfig {
 		}
 
 	} else {
-		config.icinga = icinga2.NewMockClient()
+		config.icinga = NewIcingaMockClient()
 	}
 	return config
 }
@@ -1428,3 +1443,2510 @@ func TestCustomCheck(t *testing.T) {
 		"we did not find all 2 expected service checks")
 
 }
+
+func TestStackCustomCheck(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"},
+		RancherCompose: `.icinga:
+  notes_url: http://docs.mysite.com/mystack.html
+  custom_checks:
+  - name: frontpage
+    command: http
+    vars:
+      http_address: www.mysite.com
+      http_port: 80`})
+	config.rancher.AddService(client.Service{
+		Name:         "service1",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	hosts, err := config.icinga.ListHosts()
+
+	assert.Nil(err, "listing the hosts should not cause an error")
+	assert.Equal(1, len(hosts), "we should have exactly one host")
+	assert.Equal("http://docs.mysite.com/mystack.html", hosts[0].NotesURL)
+
+	services, err := config.icinga.ListServices()
+
+	assert.Nil(err, "listing the services should not cause an error")
+	assert.Equal(2, len(services), "we should have the service and the stack check")
+
+	foundCheck := false
+
+	for _, service := range services {
+		if service.Name == "frontpage" {
+			foundCheck = true
+			assert.Equal("Default.mystack", service.HostName)
+			assert.Equal("http", service.CheckCommand)
+			assert.Equal("www.mysite.com", service.Vars["http_address"])
+			assert.Equal("80", service.Vars["http_port"])
+			assert.Equal("stack-check", service.Vars[RANCHER_OBJECT_TYPE])
+			assert.Equal("mystack", service.Vars[RANCHER_STACK])
+			assert.Nil(service.Vars[RANCHER_SERVICE])
+		}
+	}
+
+	assert.True(foundCheck, "we did not find the stack check")
+
+	// Syncing again must not remove the check
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, _ = config.icinga.ListServices()
+	assert.Equal(2, len(services), "we should still have the service and the stack check")
+
+	// A configuration that cannot be parsed keeps the check
+
+	config.rancher.AddStack(client.Stack{
+		Name:           "mystack",
+		AccountId:      "1a5",
+		Resource:       client.Resource{Id: "2a1"},
+		ServiceIds:     []string{"3a1"},
+		RancherCompose: ".icinga:\n  custom_checks: [\n"})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, _ = config.icinga.ListServices()
+	names := []string{}
+	for _, service := range services {
+		names = append(names, service.Name)
+	}
+	assert.Contains(names, "frontpage", "the stack check should be kept")
+
+	// Remove the check from the stack configuration
+
+	config.rancher.AddStack(client.Stack{
+		Name:           "mystack",
+		AccountId:      "1a5",
+		Resource:       client.Resource{Id: "2a1"},
+		ServiceIds:     []string{"3a1"},
+		RancherCompose: ".icinga:\n  notes_url: http://docs.mysite.com/mystack.html\n"})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, _ = config.icinga.ListServices()
+	assert.Equal(1, len(services), "the stack check should be removed")
+	assert.Equal("service1", services[0].Name)
+}
+
+func TestUnpackVars(t *testing.T) {
+	assert := assert.New(t)
+
+	vars, err := unpackVars("myvar1=something,anothervar=something_else,url=http://x/?a=b")
+	assert.Nil(err)
+	assert.Equal(icinga2.Vars{"myvar1": "something", "anothervar": "something_else", "url": "http://x/?a=b"}, vars)
+
+	vars, err = unpackVars(`{"port": 8080, "enabled": true, "urls": ["/a", "/b"], "http": {"vhost": "www"}}`)
+	assert.Nil(err)
+	assert.Equal(8080, vars["port"])
+	assert.Equal(true, vars["enabled"])
+	assert.Equal([]interface{}{"/a", "/b"}, vars["urls"])
+	assert.Equal(map[string]interface{}{"vhost": "www"}, vars["http"])
+
+	vars, err = unpackVars("port: 8080\nurls:\n  - /a\n  - /b\nhttp:\n  vhost: www\n")
+	assert.Nil(err)
+	assert.Equal(8080, vars["port"])
+	assert.Equal([]interface{}{"/a", "/b"}, vars["urls"])
+	assert.Equal(map[string]interface{}{"vhost": "www"}, vars["http"])
+
+	_, err = unpackVars("port: 8080\n  broken: [")
+	assert.NotNil(err)
+
+	_, err = unpackVars("[1, 2]")
+	assert.NotNil(err, "a list is not a valid set of vars")
+}
+
+func TestVarsNeedUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	// Icinga2 returns numbers as floats
+	assert.False(varsNeedUpdate(icinga2.Vars{"port": 8080}, icinga2.Vars{"port": 8080.0}))
+	assert.False(varsNeedUpdate(
+		icinga2.Vars{"http": map[string]interface{}{"ports": []interface{}{80, 443}}},
+		icinga2.Vars{"http": map[string]interface{}{"ports": []interface{}{80.0, 443.0}}}))
+
+	assert.True(varsNeedUpdate(icinga2.Vars{"port": "8080"}, icinga2.Vars{"port": 8080.0}))
+	assert.True(varsNeedUpdate(icinga2.Vars{"port": 8080}, icinga2.Vars{"port": 8081.0}))
+	assert.True(varsNeedUpdate(icinga2.Vars{"a": nil}, icinga2.Vars{}))
+	assert.True(varsNeedUpdate(icinga2.Vars{}, icinga2.Vars{"a": "b"}))
+}
+
+func TestServiceStructuredIcingaVars(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{Name: "mystack", AccountId: "1a5", Resource: client.Resource{Id: "2a1"}, ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:      "service1",
+		AccountId: "1a5",
+		StackId:   "2a1",
+		Resource:  client.Resource{Id: "3a1"},
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.service_vars": "http_port: 8080\nhttp_uris: [/health, /ready]"}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	services, err := config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(1, len(services))
+
+	assert.Equal(8080, services[0].Vars["http_port"])
+	assert.Equal([]interface{}{"/health", "/ready"}, services[0].Vars["http_uris"])
+}
+
+func TestHostCustomCheck(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "2a1"},
+		Labels: map[string]interface{}{"icinga.custom_checks": `- name: disk
+  command: disk
+  notes_url: http://docs.mysite.com/disk.html
+  vars:
+    disk_wfree: 20%
+- name: ntp
+  command: ntp_time`}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	services, err := config.icinga.ListServices()
+
+	assert.Nil(err, "listing the services should not cause an error")
+	assert.Equal(3, len(services), "we should have the agent service and two host checks")
+
+	var foundAgent, foundDisk, foundNtp bool
+
+	for _, service := range services {
+		assert.Equal("agent1", service.HostName)
+		assert.Equal("agent1", service.Vars[RANCHER_HOST])
+		assert.Equal("Default", service.Vars[RANCHER_ENVIRONMENT])
+		switch service.Name {
+		case "rancher-agent":
+			foundAgent = true
+		case "disk":
+			foundDisk = true
+			assert.Equal("disk", service.CheckCommand)
+			assert.Equal("http://docs.mysite.com/disk.html", service.NotesURL)
+			assert.Equal("20%", service.Vars["disk_wfree"])
+			assert.Equal("host-check", service.Vars[RANCHER_OBJECT_TYPE])
+		case "ntp":
+			foundNtp = true
+			assert.Equal("ntp_time", service.CheckCommand)
+			assert.Equal("host-check", service.Vars[RANCHER_OBJECT_TYPE])
+		default:
+			assert.Fail("Got an unexpected service name " + service.Name)
+		}
+	}
+
+	assert.True(foundAgent && foundDisk && foundNtp, "we did not find all 3 expected service checks")
+
+	// Remove one of the checks
+
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "2a1"},
+		Labels: map[string]interface{}{"icinga.custom_checks": `- name: disk
+  command: disk
+  vars:
+    disk_wfree: 10%`}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, _ = config.icinga.ListServices()
+	assert.Equal(2, len(services), "the ntp check should be removed")
+
+	for _, service := range services {
+		if service.Name == "disk" {
+			assert.Empty(service.NotesURL)
+			assert.Equal("10%", service.Vars["disk_wfree"])
+		}
+	}
+}
+
+func TestCustomCheckAttributes(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	label := `- name: check1
+  command: http
+  display_name: Health check
+  action_url: http://grafana.mysite.com/service1
+  command_endpoint: agent1
+  zone: dc1
+  check_interval: 5m
+  retry_interval: 30
+  max_check_attempts: 5
+  enable_notifications: false
+  groups: [web]
+  imports: [generic-service]`
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{Name: "mystack", AccountId: "1a5", Resource: client.Resource{Id: "2a1"}, ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:         "service1",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{"icinga.custom_checks": label}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	attrs, err := config.icinga.ListObjects("Service", append(customCheckAttrs, "templates"))
+	assert.Nil(err)
+
+	check := attrs["Default.mystack!check1"]
+
+	assert.Equal("Health check", check["display_name"])
+	assert.Equal("http://grafana.mysite.com/service1", check["action_url"])
+	assert.Equal("agent1", check["command_endpoint"])
+	assert.Equal("dc1", check["zone"])
+	assert.Equal(300.0, check["check_interval"])
+	assert.Equal(30.0, check["retry_interval"])
+	assert.Equal(5, check["max_check_attempts"])
+	assert.Equal(false, check["enable_notifications"])
+	assert.Equal([]string{"web"}, check["groups"])
+	assert.Equal([]string{"generic-service"}, importsOf("Default.mystack!check1", check))
+
+	// Change an attribute and the command
+
+	config.rancher.AddService(client.Service{
+		Name:      "service1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{"icinga.custom_checks": strings.Replace(
+			strings.Replace(label, "check_interval: 5m", "check_interval: 1m", 1), "command: http", "command: https", 1)}}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	attrs, _ = config.icinga.ListObjects("Service", append(customCheckAttrs, "templates"))
+	assert.Equal(60.0, attrs["Default.mystack!check1"]["check_interval"])
+
+	service, _ := config.icinga.GetService("Default.mystack!check1")
+	assert.Equal("https", service.CheckCommand)
+
+	// Changing the imports or removing an attribute recreates the service
+
+	config.rancher.AddService(client.Service{
+		Name:      "service1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{"icinga.custom_checks": `- name: check1
+  command: http
+  imports: [another-service]`}}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	attrs, _ = config.icinga.ListObjects("Service", append(customCheckAttrs, "templates"))
+	check = attrs["Default.mystack!check1"]
+
+	assert.Equal([]string{"another-service"}, importsOf("Default.mystack!check1", check))
+	assert.Nil(check["zone"])
+	assert.Nil(check["check_interval"])
+
+	services, _ := config.icinga.ListServices()
+	assert.Equal(2, len(services), "we should have the service and the custom check")
+}
+
+func TestInvalidCustomChecks(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1", "3a2"}})
+	config.rancher.AddService(client.Service{
+		Name:      "service1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.custom_checks": `- name: check1
+  command: http`}}})
+	config.rancher.AddService(client.Service{
+		Name:      "service2",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a2"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.custom_checks": `- name: check2
+  command: http`}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	services, err := config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(4, len(services), "we should have 2 services and 2 custom checks")
+
+	// break the label of service1: a duplicate name, a missing command and an invalid var
+
+	config.rancher.AddService(client.Service{
+		Name:      "service1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.custom_checks": `- name: check1
+  command: http
+- name: check1
+  vars:
+    rancher_service: other
+    "http-port": 80`}}})
+
+	// and add a check with a syntax error to service2
+
+	config.rancher.AddService(client.Service{
+		Name:      "service2",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a2"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.custom_checks": `- name: check2
+  command: http
+- name: [`}}})
+
+	err = sync(config)
+	assert.Nil(err, "invalid custom checks should not abort the sync")
+
+	services, err = config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(5, len(services), "the existing checks should be kept and the configuration check added")
+
+	var foundConfigCheck bool
+	for _, service := range services {
+		switch service.Name {
+		case "service1", "service2", "check1", "check2":
+		case CONFIG_CHECK_NAME:
+			foundConfigCheck = true
+			assert.Equal("Default.mystack", service.HostName)
+			assert.Equal("dummy", service.CheckCommand)
+			assert.Equal("config-check", service.Vars["rancher_object_type"])
+			assert.Equal(1, service.Vars["dummy_state"])
+			text := service.Vars["dummy_text"].(string)
+			assert.Contains(text, "service1: custom check check1: the name is already used")
+			assert.Contains(text, "service1: custom check check1 has no command")
+			assert.Contains(text, "service1: custom check check1: var rancher_service is reserved")
+			assert.Contains(text, "service1: custom check check1: invalid var name http-port")
+			assert.Contains(text, "service2: could not parse label icinga.custom_checks")
+		default:
+			assert.Fail("Got an unexpected service name " + service.Name)
+		}
+	}
+	assert.True(foundConfigCheck, "the configuration check should have been created")
+
+	// a check may not have the name of the service
+
+	assert.Equal([]string{"custom check service1: the name is already used"},
+		validateCustomChecks([]CustomCheck{{Name: "service1", Command: "http"}}, "service1"))
+
+	// fix both labels
+
+	config.rancher.AddService(client.Service{
+		Name:         "service1",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{}}})
+	config.rancher.AddService(client.Service{
+		Name:      "service2",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a2"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.custom_checks": `- name: check2
+  command: http`}}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, err = config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(3, len(services), "check1 and the configuration check should have been removed")
+	for _, service := range services {
+		assert.NotEqual(CONFIG_CHECK_NAME, service.Name)
+		assert.NotEqual("check1", service.Name)
+	}
+}
+
+func TestCustomCheckTemplates(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:      "My_Service",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		Scale:     3,
+		LaunchConfig: &client.LaunchConfig{
+			Ports: []string{"8080:80/tcp"},
+			Labels: map[string]interface{}{
+				"health_path": "/health",
+				"icinga.custom_checks": `- name: "{{.RancherService | lower}}-http"
+  command: http
+  notes_url: "http://docs.mysite.com/{{.RancherStack}}/{{.RancherService | replace \"_\" \"-\"}}.html"
+  vars:
+    http_address: "{{.FQDN}}"
+    http_port: "{{(index .Ports 0).PrivatePort}}"
+    http_uri: "{{index .Labels \"health_path\" | default \"/\"}}"
+    http_vhost: "{{index .Labels \"vhost\" | default .RancherEnvironment}}"
+    instances: "{{.Scale}}"
+- name: broken
+  command: http
+  vars:
+    http_port: "{{(index .Ports 5).PrivatePort}}"`}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	services, err := config.icinga.ListServices()
+	assert.Nil(err)
+
+	var foundCheck, foundConfigCheck bool
+	for _, service := range services {
+		switch service.Name {
+		case "My_Service":
+		case "my_service-http":
+			foundCheck = true
+			assert.Equal("http://docs.mysite.com/mystack/My-Service.html", service.NotesURL)
+			assert.Equal("My_Service.mystack.rancher.internal", service.Vars["http_address"])
+			assert.Equal("80", service.Vars["http_port"])
+			assert.Equal("/health", service.Vars["http_uri"])
+			assert.Equal("Default", service.Vars["http_vhost"])
+			assert.Equal("3", service.Vars["instances"])
+		case CONFIG_CHECK_NAME:
+			foundConfigCheck = true
+			assert.Contains(service.Vars["dummy_text"], "custom check broken")
+		default:
+			assert.Fail("Got an unexpected service name " + service.Name)
+		}
+	}
+	assert.True(foundCheck, "the expanded check should have been created")
+	assert.True(foundConfigCheck, "the broken template should have been reported")
+
+	port, err := parsePort("0.0.0.0:53:5353/udp")
+	assert.Nil(err)
+	assert.Equal(CheckPort{PublicPort: 53, PrivatePort: 5353, Protocol: "udp"}, port)
+}
+
+func TestAutoChecks(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	config.autoChecks = []string{"healthcheck"}
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent2", AccountId: "1a5", AgentIpAddress: "10.0.0.2",
+		InstanceIds: []string{"1i2"}, Resource: client.Resource{Id: "1h2"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", AgentIpAddress: "10.0.0.1",
+		InstanceIds: []string{"1i1"}, Resource: client.Resource{Id: "1h1"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1", "3a2"}})
+	config.rancher.AddService(client.Service{
+		Name:        "web",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "3a1"},
+		StackId:     "2a1",
+		InstanceIds: []string{"1i1", "1i2"},
+		LaunchConfig: &client.LaunchConfig{
+			Ports: []string{"8080:80/tcp", "53:53/udp", "443"},
+			HealthCheck: &client.InstanceHealthCheck{
+				Port:        80,
+				Interval:    2000,
+				RequestLine: `GET "/healthz" "HTTP/1.0"`},
+			Labels: map[string]interface{}{
+				"icinga.auto_checks": "ports,healthcheck",
+				"icinga.custom_checks": `- name: web-tcp-443
+  command: ssl`}}})
+	config.rancher.AddService(client.Service{
+		Name:      "db",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a2"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{
+			Ports:       []string{"5432"},
+			HealthCheck: &client.InstanceHealthCheck{Port: 5432}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	services, err := config.icinga.ListServices()
+	assert.Nil(err)
+
+	found := map[string]icinga2.Service{}
+	for _, service := range services {
+		found[service.HostName+"!"+service.Name] = service
+	}
+
+	assert.Equal(8, len(services), "we should have 2 hosts, 2 services, 3 checks for web and 1 for db")
+
+	// the published port on the first host running web, the unpublished port 443 is not checked
+	if s, ok := found["Default.mystack!web-tcp-8080"]; assert.True(ok) {
+		assert.Equal("tcp", s.CheckCommand)
+		assert.Equal("10.0.0.1", s.Vars["tcp_address"])
+		assert.Equal("8080", s.Vars["tcp_port"])
+		assert.Equal("custom-check", s.Vars["rancher_object_type"])
+		assert.Equal("web", s.Vars["rancher_service"])
+	}
+	if s, ok := found["Default.mystack!web-tcp-443"]; assert.True(ok) {
+		assert.Equal("ssl", s.CheckCommand, "the custom check should win over the auto check")
+	}
+	if s, ok := found["Default.mystack!web-healthcheck"]; assert.True(ok) {
+		assert.Equal("http", s.CheckCommand)
+		assert.Equal("/healthz", s.Vars["http_uri"])
+		assert.Equal("80", s.Vars["http_port"])
+	}
+	assert.Equal(float64(2), config.icinga.(*IcingaMockClient).objects["Service"]["Default.mystack!web-healthcheck"]["check_interval"])
+
+	// db only has the global default
+	if s, ok := found["Default.mystack!db-healthcheck"]; assert.True(ok) {
+		assert.Equal("tcp", s.CheckCommand)
+		assert.Equal("5432", s.Vars["tcp_port"])
+	}
+	_, ok := found["Default.mystack!db-tcp-5432"]
+	assert.False(ok, "ports are not checked for db")
+
+	// turn off the auto checks for web
+
+	config.rancher.AddService(client.Service{
+		Name:      "web",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{
+			Ports:  []string{"8080:80/tcp"},
+			Labels: map[string]interface{}{"icinga.auto_checks": "none"}}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, err = config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(5, len(services), "the auto checks of web should have been removed")
+}
+
+func TestLoadBalancerChecks(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "lbstack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "app",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a2"},
+		ServiceIds: []string{"3a2"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", AgentIpAddress: "10.0.0.1",
+		InstanceIds: []string{"1i1"}, Resource: client.Resource{Id: "1h1"}})
+	config.rancher.AddService(client.Service{
+		Name:        "lb",
+		Kind:        "loadBalancerService",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "3a1"},
+		StackId:     "2a1",
+		InstanceIds: []string{"1i1"},
+		LaunchConfig: &client.LaunchConfig{
+			Ports: []string{"80:80/tcp", "443:443/tcp", "5000:5000/tcp", "53:53/udp"}}})
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a2"},
+		StackId:      "2a2",
+		LaunchConfig: &client.LaunchConfig{}})
+	config.rancher.AddLoadBalancer(client.LoadBalancerService{
+		Name:     "lb",
+		Resource: client.Resource{Id: "3a1"},
+		LbConfig: &client.LbConfig{PortRules: []client.PortRule{
+			{Protocol: "http", SourcePort: 80, Hostname: "www.example.com", Path: "/api", ServiceId: "3a2", TargetPort: 8080},
+			{Protocol: "https", SourcePort: 443, Hostname: "*.example.com", ServiceId: "3a2", TargetPort: 8080},
+			{Protocol: "tcp", SourcePort: 5000, ServiceId: "3a2", TargetPort: 5000},
+			{Protocol: "udp", SourcePort: 53, ServiceId: "3a2", TargetPort: 53},
+			{Protocol: "tcp", SourcePort: 6000, ServiceId: "3a2", TargetPort: 6000},
+			{Protocol: "http", SourcePort: 8080, Selector: "app=web"}}}})
+
+	os.Setenv("RANCHER_URL", "http://rancher:8080/v2-beta/projects/1a5")
+	defer os.Unsetenv("RANCHER_URL")
+
+	err := sync(config)
+	assert.Nil(err)
+
+	services, err := config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(6, len(services), "we should have the agent, 2 services and 3 load balancer checks")
+
+	found := map[string]icinga2.Service{}
+	for _, service := range services {
+		found[service.HostName+"!"+service.Name] = service
+	}
+
+	if s, ok := found["Default.lbstack!lb-http-80-www.example.com-api"]; assert.True(ok) {
+		assert.Equal("http", s.CheckCommand)
+		assert.Equal("10.0.0.1", s.Vars["http_address"])
+		assert.Equal("80", s.Vars["http_port"])
+		assert.Equal("/api", s.Vars["http_uri"])
+		assert.Equal("www.example.com", s.Vars["http_vhost"])
+		assert.Equal("app", s.Vars["lb_target_stack"])
+		assert.Equal("web", s.Vars["lb_target_service"])
+		assert.Equal("lb", s.Vars["rancher_service"])
+		assert.Equal("http://rancher:8080/env/1a5/apps/stacks/2a2/services/3a2", s.NotesURL)
+		assert.Equal("lb www.example.com:80/api -> app/web",
+			config.icinga.(*IcingaMockClient).objects["Service"]["Default.lbstack!lb-http-80-www.example.com-api"]["display_name"])
+	}
+	if s, ok := found["Default.lbstack!lb-https-443-any.example.com"]; assert.True(ok) {
+		assert.Equal("true", s.Vars["http_ssl"])
+		assert.Nil(s.Vars["http_vhost"])
+	}
+	if s, ok := found["Default.lbstack!lb-tcp-5000"]; assert.True(ok) {
+		assert.Equal("tcp", s.CheckCommand)
+		assert.Equal("10.0.0.1", s.Vars["tcp_address"])
+		assert.Equal("5000", s.Vars["tcp_port"])
+	}
+	assert.NotContains(found, "Default.lbstack!lb-tcp-6000", "the port 6000 is not published")
+
+	// remove a rule
+
+	config.rancher.AddLoadBalancer(client.LoadBalancerService{
+		Name:     "lb",
+		Resource: client.Resource{Id: "3a1"},
+		LbConfig: &client.LbConfig{PortRules: []client.PortRule{
+			{Protocol: "tcp", SourcePort: 5000, ServiceId: "3a2", TargetPort: 5000}}}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, err = config.icinga.ListServices()
+	assert.Nil(err)
+	assert.Equal(4, len(services), "the checks for the removed rules should have been deleted")
+
+	// the checks are kept if the port rules cannot be fetched
+	config.rancher = &failingLoadBalancerClient{config.rancher.(*RancherMockClient)}
+	assert.Nil(sync(config))
+	services, _ = config.icinga.ListServices()
+	found = map[string]icinga2.Service{}
+	for _, service := range services {
+		found[service.HostName+"!"+service.Name] = service
+	}
+	assert.Contains(found, "Default.lbstack!lb-tcp-5000")
+	assert.Contains(found, "Default.lbstack!"+CONFIG_CHECK_NAME, "the error should be reported")
+}
+
+type failingLoadBalancerClient struct {
+	*RancherMockClient
+}
+
+func (r *failingLoadBalancerClient) GetLoadBalancer(id string) (client.LoadBalancerService, error) {
+	return client.LoadBalancerService{}, fmt.Errorf("503 Service Unavailable")
+}
+
+func TestDependencies(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	config.dependencies = true
+	mock := config.icinga.(*IcingaMockClient)
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:    "agent1",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "1h1"},
+		InstanceIds: []string{"1i1", "1i2"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:    "agent2",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "1h2"},
+		InstanceIds: []string{"1i3"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1", "3a2"}})
+	config.rancher.AddService(client.Service{
+		Name:         "service1",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		InstanceIds:  []string{"1i1"},
+		LaunchConfig: &client.LaunchConfig{}})
+	config.rancher.AddService(client.Service{
+		Name:         "service2",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a2"},
+		StackId:      "2a1",
+		InstanceIds:  []string{"1i2"},
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	dependencies, err := mock.ListObjects("Dependency", dependencyAttrs)
+	assert.Nil(err)
+	assert.Equal(1, len(dependencies), "both services run on agent1 only")
+
+	if d, ok := dependencies["Default.mystack!rancher-agent-agent1"]; assert.True(ok) {
+		assert.Equal("agent1", d["parent_host_name"])
+		assert.Equal("rancher-agent", d["parent_service_name"])
+		assert.Equal("Default.mystack", d["child_host_name"])
+		assert.Equal("rancher-agents", d["redundancy_group"])
+		assert.Equal("dependency", varsOf(d)["rancher_object_type"])
+		assert.Equal(true, d["disable_notifications"])
+	}
+
+	// changes in Icinga2 are reverted, by recreating the dependency unless only the vars changed
+
+	mock.UpdateObject("Dependency", "Default.mystack!rancher-agent-agent1", IcingaAttrs{
+		"redundancy_group":      "other",
+		"disable_notifications": false})
+	assert.Nil(sync(config))
+	dependencies, _ = mock.ListObjects("Dependency", dependencyAttrs)
+	if d, ok := dependencies["Default.mystack!rancher-agent-agent1"]; assert.True(ok) {
+		assert.Equal("rancher-agents", d["redundancy_group"])
+		assert.Equal(true, d["disable_notifications"])
+	}
+
+	mock.UpdateObject("Dependency", "Default.mystack!rancher-agent-agent1", IcingaAttrs{
+		"vars": mergeVars(varsOf(dependencies["Default.mystack!rancher-agent-agent1"]), icinga2.Vars{RANCHER_STACK: "other"})})
+	assert.Nil(sync(config))
+	dependencies, _ = mock.ListObjects("Dependency", dependencyAttrs)
+	if d, ok := dependencies["Default.mystack!rancher-agent-agent1"]; assert.True(ok) {
+		assert.Equal("mystack", varsOf(d)[RANCHER_STACK])
+	}
+
+	// service2 is rescheduled to agent2
+
+	config.rancher.AddHost(client.Host{
+		Hostname:    "agent1",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "1h1"},
+		InstanceIds: []string{"1i1"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:    "agent2",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "1h2"},
+		InstanceIds: []string{"1i3", "1i2"}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	dependencies, err = mock.ListObjects("Dependency", dependencyAttrs)
+	assert.Nil(err)
+	assert.Equal(2, len(dependencies))
+	assert.Contains(dependencies, "Default.mystack!rancher-agent-agent1")
+	assert.Contains(dependencies, "Default.mystack!rancher-agent-agent2")
+
+	// service1 is gone, so the stack only runs on agent2
+
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a2"}})
+	config.rancher.DeleteService("3a1")
+
+	err = sync(config)
+	assert.Nil(err)
+
+	dependencies, err = mock.ListObjects("Dependency", dependencyAttrs)
+	assert.Nil(err)
+	assert.Equal(1, len(dependencies))
+	assert.Contains(dependencies, "Default.mystack!rancher-agent-agent2")
+
+	// the stack is removed
+
+	config.rancher.DeleteService("3a2")
+	config.rancher.DeleteStack("2a1")
+
+	err = sync(config)
+	assert.Nil(err)
+
+	dependencies, err = mock.ListObjects("Dependency", dependencyAttrs)
+	assert.Nil(err)
+	assert.Empty(dependencies, "the dependencies should have been removed with the stack host")
+}
+
+func TestDowntimes(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", State: "active", Resource: client.Resource{Id: "1h1"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1", "3a2"}})
+	web := client.Service{
+		Name:      "web",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		State:     "active",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.custom_checks": `- name: web-http
+  command: http`}}}
+	config.rancher.AddService(web)
+	config.rancher.AddService(client.Service{
+		Name:         "db",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a2"},
+		StackId:      "2a1",
+		State:        "active",
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	downtimes, _ := mock.ListObjects("Downtime", []string{"author", "comment", "host_name", "service_name"})
+	assert.Empty(downtimes)
+
+	// web is upgraded, agent1 is deactivated
+
+	web.State = "upgrading"
+	config.rancher.AddService(web)
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", State: "inactive", Resource: client.Resource{Id: "1h1"}})
+
+	err = sync(config)
+	assert.Nil(err)
+	err = sync(config)
+	assert.Nil(err, "downtimes should not be scheduled twice")
+
+	downtimes, _ = mock.ListObjects("Downtime", []string{"author", "comment", "host_name", "service_name", "end_time"})
+	assert.Equal(3, len(downtimes), "web, its custom check and agent1 should be in downtime")
+
+	objects := []string{}
+	for _, d := range downtimes {
+		assert.Equal("rancher-icinga/default", d["author"])
+		objects = append(objects, d["host_name"].(string)+"!"+d["service_name"].(string))
+		if d["service_name"] == "web" {
+			assert.Equal("[Default.mystack!web] Rancher service is upgrading", d["comment"])
+			assert.InDelta(time.Now().Add(2*time.Hour).Unix(), d["end_time"], 5)
+		}
+	}
+	assert.ElementsMatch([]string{"Default.mystack!web", "Default.mystack!web-http", "agent1!"}, objects)
+
+	// after a restart, the downtime of web-http is gone and web has been upgrading for 90 minutes
+
+	config.downtimesSeen = make(map[string]time.Time)
+	for name, attrs := range mock.objects["Downtime"] {
+		if attrs["service_name"] == "web" {
+			attrs["start_time"] = time.Now().Add(-90 * time.Minute).Unix()
+		}
+		if attrs["service_name"] == "web-http" {
+			mock.DeleteObject("Downtime", name)
+		}
+	}
+
+	err = sync(config)
+	assert.Nil(err)
+
+	downtimes, _ = mock.ListObjects("Downtime", []string{"service_name", "end_time"})
+	rescheduled := false
+	for _, d := range downtimes {
+		if d["service_name"] == "web-http" {
+			rescheduled = true
+			assert.InDelta(time.Now().Add(30*time.Minute).Unix(), d["end_time"], 5,
+				"the downtime should end 2h after the existing downtime of web started")
+		}
+	}
+	assert.True(rescheduled, "the downtime of web-http should have been scheduled again")
+
+	// web is active again, agent1 has been in maintenance for longer than the maximum duration
+
+	web.State = "active"
+	config.rancher.AddService(web)
+	for name := range mock.objects["Downtime"] {
+		if strings.HasPrefix(name, "agent1!") {
+			mock.DeleteObject("Downtime", name)
+		}
+	}
+	config.downtimesSeen["agent1"] = time.Now().Add(-3 * time.Hour)
+
+	err = sync(config)
+	assert.Nil(err)
+
+	downtimes, _ = mock.ListObjects("Downtime", []string{"author"})
+	assert.Empty(downtimes, "the downtimes for web should have been removed and agent1 not scheduled again")
+}
+
+func TestServiceGroups(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	config.stackServiceGroupTemplate = template.Must(template.New("stack").Parse("{{.RancherEnvironment}}.{{.RancherStack}}"))
+	config.installationServiceGroupTemplate = template.Must(template.New("inst").Parse("rancher-{{.RancherInstallation}}"))
+	config.labelServiceGroupTemplate = template.Must(template.New("label").Parse("{{.Label}}-{{.Value}}"))
+	config.serviceGroupLabel = "team"
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{
+		Name:           "mystack",
+		AccountId:      "1a5",
+		Resource:       client.Resource{Id: "2a1"},
+		ServiceIds:     []string{"3a1", "3a2"},
+		RancherCompose: ".icinga:\n  labels:\n    team: payments\n"})
+	config.rancher.AddService(client.Service{
+		Name:      "web",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"team": "frontend",
+			"icinga.custom_checks": `- name: web-http
+  command: http
+  groups: [web]`}}})
+	config.rancher.AddService(client.Service{
+		Name:         "db",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a2"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	groups, _ := mock.ListObjects("ServiceGroup", []string{"vars"})
+	assert.Equal(4, len(groups))
+	for _, g := range []string{"Default.mystack", "rancher-default", "team-frontend", "team-payments"} {
+		if assert.Contains(groups, g) {
+			assert.Equal("servicegroup", varsOf(groups[g])["rancher_object_type"])
+		}
+	}
+
+	services := mock.objects["Service"]
+	assert.Equal([]string{"Default.mystack", "rancher-default", "team-frontend"}, services["Default.mystack!web"]["groups"])
+	assert.Equal([]string{"Default.mystack", "rancher-default", "team-payments"}, services["Default.mystack!db"]["groups"])
+	assert.Equal([]string{"web", "Default.mystack", "rancher-default", "team-frontend"}, services["Default.mystack!web-http"]["groups"])
+
+	// web moves to the payments team
+
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	groups, _ = mock.ListObjects("ServiceGroup", []string{"vars"})
+	assert.Equal(3, len(groups))
+	assert.NotContains(groups, "team-frontend", "the unused group should have been removed")
+	assert.Equal([]string{"Default.mystack", "rancher-default", "team-payments"}, mock.objects["Service"]["Default.mystack!web"]["groups"])
+}
+
+func TestHostGroups(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	config.installationHostGroupTemplate = template.Must(template.New("inst").Parse("rancher-{{.RancherInstallation}}"))
+	config.hostHostGroupTemplate = template.Must(template.New("host").Parse("{{.Label}}-{{.Value}}"))
+	config.hostHostGroupLabel = "zone"
+	config.stackHostGroupTemplate = template.Must(template.New("stack").Parse("{{.Value}}"))
+	config.stackHostGroupLabel = "team"
+	config.stackHostGroupPatterns = []hostGroupPattern{{"databases", glob.MustCompile("*-db")}}
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h1"},
+		Labels:    map[string]interface{}{"zone": "dc1"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "orders-db",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:         "postgres",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{"team": "payments"}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	hostGroups, _ := mock.ListHostGroups()
+	names := []string{}
+	for _, hg := range hostGroups {
+		names = append(names, hg.Name)
+		if hg.Name != "Default" {
+			assert.Equal("hostgroup", hg.Vars["rancher_object_type"])
+		}
+	}
+	assert.ElementsMatch([]string{"Default", "rancher-default", "zone-dc1", "payments", "databases"}, names)
+	assert.Equal([]string{"rancher-default"}, mock.objects["HostGroup"]["Default"]["groups"])
+
+	hosts, _ := mock.ListHosts()
+	for _, h := range hosts {
+		switch h.Name {
+		case "agent1":
+			assert.Equal([]string{"Default", "zone-dc1"}, h.Groups)
+		case "Default.orders-db":
+			assert.Equal([]string{"Default", "databases", "payments"}, h.Groups)
+		default:
+			assert.Fail("Got an unexpected host name " + h.Name)
+		}
+	}
+
+	// agent1 moves to dc2, the stack loses its team
+
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h1"},
+		Labels:    map[string]interface{}{"zone": "dc2"}})
+	config.rancher.AddService(client.Service{
+		Name:         "postgres",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	hostGroups, _ = mock.ListHostGroups()
+	names = []string{}
+	for _, hg := range hostGroups {
+		names = append(names, hg.Name)
+	}
+	assert.ElementsMatch([]string{"Default", "rancher-default", "zone-dc2", "databases"}, names)
+
+	hosts, _ = mock.ListHosts()
+	for _, h := range hosts {
+		switch h.Name {
+		case "agent1":
+			assert.Equal([]string{"Default", "zone-dc2"}, h.Groups)
+		case "Default.orders-db":
+			assert.Equal([]string{"Default", "databases"}, h.Groups)
+		}
+	}
+}
+
+func TestImports(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	config.hostImports = []string{"generic-host"}
+	config.agentServiceImports = []string{"generic-service"}
+	config.serviceImports = []string{"generic-service"}
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h1"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:      "web",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.templates": "web-service, generic-service"}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	assert.Equal([]string{"generic-host"}, importsOf("agent1", mock.objects["Host"]["agent1"]))
+	assert.Equal([]string{"generic-service"}, importsOf("agent1!rancher-agent", mock.objects["Service"]["agent1!rancher-agent"]))
+	assert.Equal([]string{"generic-service", "web-service"}, importsOf("Default.mystack!web", mock.objects["Service"]["Default.mystack!web"]))
+	assert.Equal([]string{}, importsOf("Default.mystack", mock.objects["Host"]["Default.mystack"]))
+
+	// Icinga2 also lists the templates imported by the templates
+
+	mock.objects["Host"]["agent1"]["templates"] = []interface{}{"agent1", "generic-host", "base-host"}
+	mock.objects["Service"]["Default.mystack!web"]["templates"] =
+		[]interface{}{"web", "generic-service", "base-service", "web-service"}
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Equal([]string{"generic-host", "base-host"}, importsOf("agent1", mock.objects["Host"]["agent1"]),
+		"inherited templates should not recreate the host")
+	assert.Equal([]string{"generic-service", "base-service", "web-service"},
+		importsOf("Default.mystack!web", mock.objects["Service"]["Default.mystack!web"]),
+		"inherited templates should not recreate the service")
+
+	// other templates for the hosts: the hosts and their services are created again
+
+	config.hostImports = []string{"rancher-host"}
+	config.stackImports = []string{"rancher-stack"}
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Equal([]string{"rancher-host"}, importsOf("agent1", mock.objects["Host"]["agent1"]))
+	assert.Equal([]string{"rancher-stack"}, importsOf("Default.mystack", mock.objects["Host"]["Default.mystack"]))
+	assert.Equal([]string{"generic-service"}, importsOf("agent1!rancher-agent", mock.objects["Service"]["agent1!rancher-agent"]))
+	assert.Equal([]string{"generic-service", "web-service"}, importsOf("Default.mystack!web", mock.objects["Service"]["Default.mystack!web"]))
+
+	services, _ := mock.ListServices()
+	names := []string{}
+	for _, s := range services {
+		names = append(names, s.HostName+"!"+s.Name)
+	}
+	assert.ElementsMatch([]string{"agent1!rancher-agent", "Default.mystack!web"}, names)
+
+	// no more templates
+
+	config.hostImports = nil
+	config.stackImports = nil
+	config.agentServiceImports = nil
+	config.serviceImports = nil
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	hosts, _ := mock.ListHosts()
+	assert.Len(hosts, 2)
+	assert.Equal([]string{}, importsOf("agent1", mock.objects["Host"]["agent1"]))
+	assert.Equal([]string{}, importsOf("Default.mystack!web", mock.objects["Service"]["Default.mystack!web"]))
+}
+
+func TestNotifications(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	mock.CreateObject("User", "alice", nil, IcingaAttrs{})
+	mock.CreateObject("UserGroup", "payments-oncall", nil, IcingaAttrs{})
+	mock.CreateObject("UserGroup", "ops", nil, IcingaAttrs{})
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h1"},
+		Labels:    map[string]interface{}{"icinga.notify_groups": "ops"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:      "web",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "3a1"},
+		StackId:   "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.notify_users":  "alice, bob",
+			"icinga.notify_groups": "payments-oncall"}}})
+
+	err := sync(config)
+	assert.Nil(err)
+
+	hosts, _ := mock.ListHosts()
+	for _, h := range hosts {
+		switch h.Name {
+		case "agent1":
+			assert.True(varEqual(map[string]interface{}{"mail": map[string]interface{}{"groups": []string{"ops"}}},
+				h.Vars["notification"]))
+		case "Default.mystack":
+			assert.Nil(h.Vars["notification"])
+		default:
+			assert.Fail("Got an unexpected host name " + h.Name)
+		}
+	}
+
+	services, _ := mock.ListServices()
+	for _, s := range services {
+		switch s.HostName + "!" + s.Name {
+		case "Default.mystack!web":
+			assert.True(varEqual(map[string]interface{}{"mail": map[string]interface{}{
+				"users":  []string{"alice", "bob"},
+				"groups": []string{"payments-oncall"}}}, s.Vars["notification"]))
+		case "Default.mystack!" + CONFIG_CHECK_NAME:
+			assert.Equal("service web: user bob in icinga.notify_users does not exist", s.Vars["dummy_text"])
+		case "agent1!rancher-agent":
+			assert.Nil(s.Vars["notification"])
+		default:
+			assert.Fail("Got an unexpected service name " + s.HostName + "!" + s.Name)
+		}
+	}
+
+	// bob is added to Icinga2
+
+	mock.CreateObject("User", "bob", nil, IcingaAttrs{})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	services, _ = mock.ListServices()
+	for _, s := range services {
+		assert.NotEqual(CONFIG_CHECK_NAME, s.Name)
+	}
+}
+
+func TestZones(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	os.Setenv("ICINGA_ZONE", "master")
+	os.Setenv("ICINGA_ZONE_RULES", "satellite-ber=label:datacenter=ber,satellite-prod=env:Prod*")
+	err := makeZoneConfig(config)
+	os.Unsetenv("ICINGA_ZONE")
+	os.Unsetenv("ICINGA_ZONE_RULES")
+	assert.Nil(err)
+
+	mock.CreateObject("Endpoint", "agent1", nil, IcingaAttrs{})
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent1",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h1"},
+		Labels: map[string]interface{}{
+			"datacenter":           "ber",
+			"icinga.custom_checks": "- name: disk\n  command: disk"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent2",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h2"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Equal("satellite-ber", mock.objects["Host"]["agent1"]["zone"])
+	assert.Equal("master", mock.objects["Host"]["agent2"]["zone"])
+	assert.Equal("master", mock.objects["Host"]["Default.mystack"]["zone"])
+
+	assert.Equal("satellite-ber", mock.objects["Service"]["agent1!rancher-agent"]["zone"])
+	assert.Equal("agent1", mock.objects["Service"]["agent1!rancher-agent"]["command_endpoint"])
+	assert.Equal("satellite-ber", mock.objects["Service"]["agent1!disk"]["zone"])
+	assert.Equal("agent1", mock.objects["Service"]["agent1!disk"]["command_endpoint"])
+	assert.Equal("master", mock.objects["Service"]["agent2!rancher-agent"]["zone"])
+	assert.Nil(mock.objects["Service"]["agent2!rancher-agent"]["command_endpoint"])
+	assert.Equal("master", mock.objects["Service"]["Default.mystack!web"]["zone"])
+
+	// agent2 moves to Berlin and gets an Icinga2 agent
+
+	mock.CreateObject("Endpoint", "agent2", nil, IcingaAttrs{})
+	config.rancher.AddHost(client.Host{
+		Hostname:  "agent2",
+		AccountId: "1a5",
+		Resource:  client.Resource{Id: "1h2"},
+		Labels:    map[string]interface{}{"datacenter": "ber"}})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Equal("satellite-ber", mock.objects["Host"]["agent2"]["zone"])
+	assert.Equal("satellite-ber", mock.objects["Service"]["agent2!rancher-agent"]["zone"])
+	assert.Equal("agent2", mock.objects["Service"]["agent2!rancher-agent"]["command_endpoint"])
+
+	hosts, _ := mock.ListHosts()
+	assert.Len(hosts, 3)
+	services, _ := mock.ListServices()
+	assert.Len(services, 4)
+}
+
+func TestPassiveChecks(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	mock := config.icinga.(*IcingaMockClient)
+
+	os.Setenv("PASSIVE_CHECKS", "1")
+	err := makePassiveConfig(config)
+	os.Unsetenv("PASSIVE_CHECKS")
+	assert.Nil(err)
+	assert.Equal("passive", config.serviceCheckCommand)
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{
+		Hostname:    "agent1",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "1h1"},
+		State:       "active",
+		AgentState:  "active",
+		InstanceIds: []string{"1i1", "1i2", "1i3"}})
+	config.rancher.AddStack(client.Stack{
+		Name:        "mystack",
+		AccountId:   "1a5",
+		Resource:    client.Resource{Id: "2a1"},
+		State:       "active",
+		HealthState: "degraded",
+		ServiceIds:  []string{"3a1", "3a2"}})
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		State:        "active",
+		HealthState:  "healthy",
+		Scale:        2,
+		LaunchConfig: &client.LaunchConfig{}})
+	config.rancher.AddService(client.Service{
+		Name:         "db",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a2"},
+		StackId:      "2a1",
+		State:        "active",
+		HealthState:  "unhealthy",
+		Scale:        1,
+		LaunchConfig: &client.LaunchConfig{}})
+	config.rancher.AddContainer(client.Container{Resource: client.Resource{Id: "1i1"}, ServiceIds: []string{"3a1"},
+		State: "running", HealthState: "healthy"})
+	config.rancher.AddContainer(client.Container{Resource: client.Resource{Id: "1i2"}, ServiceIds: []string{"3a1"},
+		State: "running", HealthState: "healthy"})
+	config.rancher.AddContainer(client.Container{Resource: client.Resource{Id: "1i3"}, ServiceIds: []string{"3a2"},
+		State: "running", HealthState: "unhealthy"})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	// a degraded stack is UP
+	assert.Equal(HOST_UP, mock.checkResults["Default.mystack"]["exit_status"])
+	assert.Equal([]string{"services=2;;;0", "healthy_services=1;;;0"},
+		mock.checkResults["Default.mystack"]["performance_data"])
+	assert.Equal(STATE_OK, mock.checkResults["Default.mystack!web"]["exit_status"])
+	assert.Equal([]string{"scale=2;;;0", "running=2;;;0", "healthy=2;;;0"},
+		mock.checkResults["Default.mystack!web"]["performance_data"])
+	assert.Equal(STATE_CRITICAL, mock.checkResults["Default.mystack!db"]["exit_status"])
+	assert.Equal(STATE_OK, mock.checkResults["agent1!rancher-agent"]["exit_status"])
+	assert.NotContains(mock.checkResults, "agent1")
+
+	// Icinga2 only runs the freshness check with active checks enabled
+	for _, name := range []string{"Default.mystack!web", "Default.mystack!db", "agent1!rancher-agent"} {
+		assert.Equal(true, mock.objects["Service"][name]["enable_active_checks"])
+		assert.Equal("passive", mock.objects["Service"][name]["check_command"])
+		assert.Equal(300.0, mock.objects["Service"][name]["check_interval"])
+	}
+	assert.Equal(true, mock.objects["Host"]["Default.mystack"]["enable_active_checks"])
+	assert.Equal("passive", mock.objects["Host"]["Default.mystack"]["check_command"])
+	assert.Nil(mock.objects["Host"]["agent1"])
+
+	// the agent disconnects
+
+	config.rancher.AddHost(client.Host{
+		Hostname:   "agent1",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "1h1"},
+		State:      "active",
+		AgentState: "disconnected"})
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Equal(STATE_CRITICAL, mock.checkResults["agent1!rancher-agent"]["exit_status"])
+
+	// an unhealthy stack is DOWN
+
+	stack := config.rancher.GetStack("2a1")
+	stack.HealthState = "unhealthy"
+	config.rancher.AddStack(stack)
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Equal(HOST_DOWN, mock.checkResults["Default.mystack"]["exit_status"])
+
+	// back to active checks
+
+	config.passiveChecks = false
+	config.stackCheckCommand = "check_rancher_stack"
+	config.serviceCheckCommand = "check_rancher_service"
+	config.agentServiceCheckCommand = "check_rancher_host"
+	mock.checkResults = nil
+
+	err = sync(config)
+	assert.Nil(err)
+
+	assert.Nil(mock.checkResults)
+	assert.Equal(true, mock.objects["Service"]["Default.mystack!web"]["enable_active_checks"])
+	assert.Equal("check_rancher_service", mock.objects["Service"]["Default.mystack!web"]["check_command"])
+	assert.Equal("check_rancher_stack", mock.objects["Host"]["Default.mystack"]["check_command"])
+}
+
+func TestConfigFiles(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	dir, err := ioutil.TempDir("", "rancher-icinga")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	api := config.icinga
+	config.icinga, err = NewIcingaConfigClient(&configDirOutput{dir: dir}, api, config.rancherInstallation, "global")
+	assert.Nil(err)
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	config.rancher.AddStack(client.Stack{Name: "mystack", AccountId: "1a5", Resource: client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{Name: "web", AccountId: "1a5", Resource: client.Resource{Id: "3a1"},
+		StackId: "2a1", LaunchConfig: &client.LaunchConfig{}})
+
+	assert.Nil(sync(config))
+
+	confFile := dir + "/conf.d/rancher-icinga-" + config.rancherInstallation + ".conf"
+	conf, err := ioutil.ReadFile(confFile)
+	assert.Nil(err)
+	assert.Contains(string(conf), "object Host \"agent1\" {\n")
+	assert.Contains(string(conf), "object Service \"web\" {\n")
+	assert.Contains(string(conf), "  vars.rancher_installation = \""+config.rancherInstallation+"\"\n")
+
+	groups, err := ioutil.ReadFile(dir + "/zones.d/global/rancher-icinga-" + config.rancherInstallation + ".conf")
+	assert.Nil(err)
+	assert.Contains(string(groups), "object HostGroup \"Default\" {\n")
+
+	// the objects were not created through the API
+	hosts, _ := api.ListHosts()
+	assert.Empty(hosts)
+
+	// nothing is written if nothing changed
+	assert.Nil(os.Remove(confFile))
+	assert.Nil(sync(config))
+	_, err = os.Stat(confFile)
+	assert.True(os.IsNotExist(err))
+
+	// the objects are loaded again after a restart
+	config.icinga, err = NewIcingaConfigClient(&configDirOutput{dir: dir}, api, config.rancherInstallation, "global")
+	assert.Nil(err)
+	_, err = config.icinga.GetHost("agent1")
+	assert.Nil(err)
+
+	config.rancher.DeleteHost("1h1")
+	assert.Nil(sync(config))
+
+	conf, err = ioutil.ReadFile(confFile)
+	assert.Nil(err)
+	assert.NotContains(string(conf), "object Host \"agent1\"")
+	assert.Contains(string(conf), "object Service \"web\" {\n")
+}
+
+func TestRenderObject(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`object Service "check \"x\"" {
+  import "generic-service"
+  check_command = "dummy"
+  groups = [ "a", "b" ]
+  host_name = "myhost"
+  max_check_attempts = 3
+  vars.enabled = true
+  vars["has-dash"] = "x\ny"
+  vars.notification = { mail = { users = [ "alice" ] } }
+}
+`, renderObject("Service", "myhost!check \"x\"", IcingaAttrs{
+		"host_name":          "myhost",
+		"check_command":      "dummy",
+		"notes_url":          "",
+		"groups":             []string{"a", "b"},
+		"max_check_attempts": 3,
+		"templates":          []interface{}{"generic-service", "check \"x\""},
+		"zone":               "satellite",
+		"vars": icinga2.Vars{
+			"enabled":      true,
+			"has-dash":     "x\ny",
+			"notification": map[string]interface{}{"mail": map[string]interface{}{"users": []string{"alice"}}}}}))
+}
+
+// A minimal Icinga Director REST API, which stores booleans as "y" and "n" like Director.
+type fakeDirector struct {
+	objects map[string]map[string]map[string]interface{}
+	deploys int
+	lock    chan struct{}
+}
+
+func (f *fakeDirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock <- struct{}{}
+	defer func() { <-f.lock }()
+
+	path := strings.TrimPrefix(r.URL.Path, "/director/")
+
+	if path == "config/deploy" && r.Method == "POST" {
+		f.deploys++
+		return
+	}
+
+	for typ, endpoint := range directorTypes {
+		if path == icingaPath(endpoint) && r.Method == "GET" {
+			result := directorObjects{Objects: []map[string]interface{}{}}
+			for _, o := range f.objects[typ] {
+				result.Objects = append(result.Objects, o)
+			}
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		if path != endpoint {
+			continue
+		}
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		for k, v := range body {
+			if b, ok := v.(bool); ok && containsStrings(directorBooleans, []string{k}) {
+				body[k] = map[bool]string{true: "y", false: "n"}[b]
+			}
+		}
+
+		key := r.URL.Query().Get("name")
+		if host := r.URL.Query().Get("host"); host != "" {
+			key = host + "!" + key
+		}
+		o, exists := f.objects[typ][key]
+
+		switch {
+		case r.Method == "POST" && key == "":
+			key, _ = body["object_name"].(string)
+			if host, ok := body["host"].(string); ok {
+				key = host + "!" + key
+			}
+			if _, ok := f.objects[typ][key]; ok {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(directorError{Error: "Trying to recreate " + key})
+				return
+			}
+			if f.objects[typ] == nil {
+				f.objects[typ] = make(map[string]map[string]interface{})
+			}
+			f.objects[typ][key] = body
+			w.WriteHeader(201)
+		case !exists:
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(directorError{Error: "Not found"})
+		case r.Method == "GET":
+			json.NewEncoder(w).Encode(o)
+		case r.Method == "POST":
+			for k, v := range body {
+				o[k] = v
+			}
+		case r.Method == "DELETE":
+			delete(f.objects[typ], key)
+		}
+		return
+	}
+
+	w.WriteHeader(404)
+}
+
+func TestDirector(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	director := &fakeDirector{objects: map[string]map[string]map[string]interface{}{
+		"Host": {
+			"manual":       {"object_name": "manual", "object_type": "object", "address": "10.0.0.1"},
+			"generic-host": {"object_name": "generic-host", "object_type": "template"}}},
+		lock: make(chan struct{}, 1)}
+	server := httptest.NewServer(director)
+	defer server.Close()
+
+	api := config.icinga
+	config.icinga = NewIcingaDirectorClient(server.URL, "admin", "secret", api, false, false)
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	config.rancher.AddStack(client.Stack{Name: "mystack", AccountId: "1a5", Resource: client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{Name: "web", AccountId: "1a5", Resource: client.Resource{Id: "3a1"},
+		StackId: "2a1", LaunchConfig: &client.LaunchConfig{}})
+
+	assert.Nil(sync(config))
+	assert.Equal(1, director.deploys)
+
+	agent := director.objects["Host"]["agent1"]
+	if assert.NotNil(agent) {
+		assert.Equal("object", agent["object_type"])
+		assert.Equal(config.rancherInstallation, agent["vars"].(map[string]interface{})[RANCHER_INSTALLATION])
+	}
+	assert.NotNil(director.objects["Service"]["agent1!rancher-agent"])
+	assert.NotNil(director.objects["HostGroup"]["Default"])
+	assert.NotNil(director.objects["Host"]["manual"])
+
+	hosts, err := config.icinga.ListHosts()
+	assert.Nil(err)
+	names := []string{}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	assert.Contains(names, "agent1")
+	assert.NotContains(names, "generic-host")
+
+	// nothing is changed or deployed if nothing changed in Rancher
+	assert.Nil(sync(config))
+	assert.Equal(1, director.deploys)
+
+	config.rancher.DeleteHost("1h1")
+	assert.Nil(sync(config))
+	assert.Equal(2, director.deploys)
+	assert.Nil(director.objects["Host"]["agent1"])
+	assert.Nil(director.objects["Service"]["agent1!rancher-agent"])
+	assert.NotNil(director.objects["Host"]["manual"])
+
+	// actions wait until created objects are deployed
+	d := config.icinga.(*IcingaDirectorClient)
+	assert.Nil(d.CreateHost(icinga2.Host{Name: "new", CheckCommand: "dummy"}))
+	result := IcingaAttrs{"type": "Host", "host": "new", "exit_status": HOST_UP}
+	assert.Nil(d.PerformAction("process-check-result", result))
+	assert.Nil(d.PerformAction("process-check-result",
+		IcingaAttrs{"type": "Service", "service": "new!web", "exit_status": STATE_OK}))
+	assert.NotContains(api.(*IcingaMockClient).checkResults, "new")
+	assert.NotContains(api.(*IcingaMockClient).checkResults, "new!web")
+	assert.Nil(d.PerformAction("process-check-result", IcingaAttrs{"type": "Host", "host": "manual", "exit_status": HOST_UP}))
+	assert.Contains(api.(*IcingaMockClient).checkResults, "manual")
+
+	assert.Nil(d.Commit())
+	assert.Nil(d.PerformAction("process-check-result", result))
+	assert.Contains(api.(*IcingaMockClient).checkResults, "new")
+
+	// objects created by Director are found with their Icinga2 names
+	name, attrs := icingaObject("Dependency", map[string]interface{}{
+		"object_name":          "mystack-rancher-agent-agent1",
+		"child_host":           "mystack",
+		"enable_active_checks": "n",
+		"imports":              []interface{}{"generic-dependency"}})
+	assert.Equal("mystack!rancher-agent-agent1", name)
+	assert.Equal(false, attrs["enable_active_checks"])
+	assert.Equal([]string{"generic-dependency"}, importsOf(name, attrs))
+}
+
+// Counts the listings of a mock client.
+type countingIcingaClient struct {
+	*IcingaMockClient
+	owned map[string]int
+	all   int
+}
+
+func (c *countingIcingaClient) ListOwnedObjects(typ, installation string, attrs []string) (map[string]IcingaAttrs, error) {
+	c.owned[typ]++
+	return c.IcingaMockClient.ListOwnedObjects(typ, installation, attrs)
+}
+
+func (c *countingIcingaClient) ListHosts() ([]icinga2.Host, error) {
+	c.all++
+	return c.IcingaMockClient.ListHosts()
+}
+
+func (c *countingIcingaClient) ListServices() ([]icinga2.Service, error) {
+	c.all++
+	return c.IcingaMockClient.ListServices()
+}
+
+func (c *countingIcingaClient) ListHostGroups() ([]icinga2.HostGroup, error) {
+	c.all++
+	return c.IcingaMockClient.ListHostGroups()
+}
+
+func TestOwnedObjects(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	icinga := &countingIcingaClient{IcingaMockClient: config.icinga.(*IcingaMockClient), owned: map[string]int{}}
+	config.icinga = icinga
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent2", AccountId: "1a5", Resource: client.Resource{Id: "1h2"}})
+	config.rancher.AddStack(client.Stack{Name: "mystack", AccountId: "1a5", Resource: client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{Name: "web", AccountId: "1a5", Resource: client.Resource{Id: "3a1"},
+		StackId: "2a1", LaunchConfig: &client.LaunchConfig{}})
+
+	// a host of another installation
+	assert.Nil(icinga.CreateHost(icinga2.Host{Name: "other1", Vars: icinga2.Vars{
+		RANCHER_INSTALLATION: "other", RANCHER_OBJECT_TYPE: "host", RANCHER_ENVIRONMENT: "Default"}}))
+
+	assert.Nil(sync(config))
+	assert.Equal(map[string]int{"Host": 1, "Service": 1, "HostGroup": 1}, icinga.owned)
+	assert.Equal(0, icinga.all)
+	assert.Equal(config.icinga, icinga)
+
+	_, err := icinga.GetService("agent1!rancher-agent")
+	assert.Nil(err)
+
+	// objects deleted in the sync are gone for the later phases
+	config.rancher.DeleteHost("1h2")
+	icinga.owned = map[string]int{}
+	assert.Nil(sync(config))
+	assert.Equal(map[string]int{"Host": 1, "Service": 1, "HostGroup": 1}, icinga.owned)
+
+	hosts, _ := icinga.IcingaMockClient.ListHosts()
+	names := []string{}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	assert.Contains(names, "agent1")
+	assert.NotContains(names, "agent2")
+	assert.Contains(names, "other1")
+}
+
+func TestWebListOwnedObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		assert.Equal("POST", r.Method)
+		assert.Equal("GET", r.Header.Get("X-HTTP-Method-Override"))
+		assert.Equal("/v1/objects/services", r.URL.Path)
+		assert.Equal("service.vars.rancher_installation == installation", body["filter"])
+		assert.Equal(map[string]interface{}{"installation": "prod"}, body["filter_vars"])
+		assert.Equal([]interface{}{"vars", "zone"}, body["attrs"])
+
+		w.Write([]byte(`{"results": [{"name": "agent1!rancher-agent", "attrs": {"zone": "master"}}]}`))
+	}))
+	defer server.Close()
+
+	icinga := NewIcingaWebClient(nil, server.URL, "root", "secret", false, false)
+	objects, err := icinga.ListOwnedObjects("Service", "prod", []string{"vars", "zone"})
+	assert.Nil(err)
+	assert.Equal(map[string]IcingaAttrs{"agent1!rancher-agent": {"zone": "master"}}, objects)
+}
+
+func TestUploadPackageStage(t *testing.T) {
+	assert := assert.New(t)
+	stagePollInterval = time.Millisecond
+
+	// Icinga2 validates a stage after two status requests, a stage named "broken" is invalid
+	newServer := func(stage string) *httptest.Server {
+		active, polls := "old", 0
+		lock := make(chan struct{}, 1)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock <- struct{}{}
+			defer func() { <-lock }()
+
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/v1/config/packages":
+				fmt.Fprintf(w, `{"results": [{"name": "rancher", "active-stage": %q, "stages": [%q]}]}`, active, active)
+			case r.Method == "POST" && r.URL.Path == "/v1/config/stages/rancher":
+				fmt.Fprintf(w, `{"results": [{"stage": %q}]}`, stage)
+			case r.URL.Path == "/v1/config/files/rancher/"+stage+"/status":
+				if polls++; polls < 2 {
+					w.WriteHeader(404)
+					w.Write([]byte(`{"error": 404, "status": "not found"}`))
+				} else if stage == "broken" {
+					w.Write([]byte("1"))
+				} else {
+					active = stage
+					w.Write([]byte("0"))
+				}
+			default:
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error": 400, "status": "unexpected request"}`))
+			}
+		}))
+	}
+
+	server := newServer("new")
+	icinga := NewIcingaWebClient(nil, server.URL, "root", "secret", false, false)
+	assert.Nil(icinga.UploadPackageStage("rancher", map[string]string{"conf.d/a.conf": ""}))
+	server.Close()
+
+	// an invalid stage is an error, so the files are uploaded again
+	server = newServer("broken")
+	defer server.Close()
+	icinga = NewIcingaWebClient(nil, server.URL, "root", "secret", false, false)
+	err := icinga.UploadPackageStage("rancher", map[string]string{"conf.d/a.conf": ""})
+	assert.EqualError(err, "the configuration in stage broken of config package rancher is invalid, "+
+		"see rancher/broken/startup.log")
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	// every path fails with the statuses in the query, then succeeds
+	requests := map[string]int{}
+	lock := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock <- struct{}{}
+		n := requests[r.URL.Path]
+		requests[r.URL.Path]++
+		<-lock
+
+		if statuses := r.URL.Query()["status"]; n < len(statuses) {
+			code, _ := strconv.Atoi(statuses[n])
+			w.WriteHeader(code)
+			w.Write([]byte(`{"error": 1, "status": "failed"}`))
+			return
+		}
+		if r.URL.Path == "/v1/actions/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte(`{"results": []}`))
+	}))
+	defer server.Close()
+	count := func(path string) int {
+		lock <- struct{}{}
+		defer func() { <-lock }()
+		return requests[path]
+	}
+
+	icinga := NewIcingaWebClient(nil, server.URL, "root", "secret", false, false)
+	icinga.retry = &retrier{api: "test", retries: 2, backoff: time.Millisecond}
+
+	// server errors and too many requests are retried
+	assert.Nil(icinga.PerformAction("retried?status=503&status=429", IcingaAttrs{}))
+	assert.Equal(3, count("/v1/actions/retried"))
+	assert.Equal("2", retriesMetric.Get("test").String())
+
+	// until the retries are used up
+	err := icinga.PerformAction("failing?status=500&status=500&status=500", IcingaAttrs{})
+	assert.Equal(500, err.(*apiError).statusCode)
+	assert.Equal(3, count("/v1/actions/failing"))
+	assert.Equal("1", failuresMetric.Get("test").String())
+
+	// other errors are not
+	err = icinga.PerformAction("unauthorized?status=401", IcingaAttrs{})
+	assert.Equal(401, err.(*apiError).statusCode)
+	assert.Equal(1, count("/v1/actions/unauthorized"))
+	err = icinga.PerformAction("missing?status=404", IcingaAttrs{})
+	assert.True(isNotFound(err))
+	assert.Equal(1, count("/v1/actions/missing"))
+
+	// timeouts are retried
+	icinga.napping.Client.Timeout = 20 * time.Millisecond
+	assert.NotNil(icinga.PerformAction("slow", IcingaAttrs{}))
+	assert.Equal(3, count("/v1/actions/slow"))
+
+	// errors of the Rancher API are classified like Icinga2 errors
+	assert.True(isRetryable(&client.ApiError{StatusCode: 503}))
+	assert.True(isRetryable(&client.ApiError{StatusCode: 429}))
+	assert.False(isRetryable(&client.ApiError{StatusCode: 401}))
+
+	// refused and reset connections are retried, like while Icinga2 restarts
+	assert.True(isRetryable(&url.Error{Op: "Get", URL: "http://icinga", Err: &net.OpError{
+		Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}}))
+	assert.True(isRetryable(&url.Error{Op: "Post", URL: "http://icinga", Err: &net.OpError{
+		Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}}))
+	assert.False(isRetryable(&url.Error{Op: "Get", URL: "http://icinga", Err: &net.OpError{
+		Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.EACCES}}}))
+
+	retries, _ := strconv.Atoi(retriesMetric.Get("test").String())
+	server.Close()
+	err = icinga.PerformAction("restarting", IcingaAttrs{})
+	assert.True(isConnectionError(err))
+	assert.Equal(strconv.Itoa(retries+2), retriesMetric.Get("test").String())
+}
+
+func TestRequestContext(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte(`{"results": []}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	icinga := NewIcingaWebClient(nil, server.URL, "root", "secret", false, false)
+	icinga.retry = &retrier{api: "test", retries: 2, backoff: time.Millisecond, ctx: ctx}
+	withContext(icinga.napping.Client, ctx)
+
+	// a stopped sync does not wait for the running request
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	assert.NotNil(icinga.PerformAction("slow", IcingaAttrs{}))
+	assert.True(time.Since(start) < time.Second)
+}
+
+// Fails to list the Rancher environments by panicking.
+type panickingRancherClient struct {
+	*RancherMockClient
+}
+
+func (r panickingRancherClient) Environments() (*client.ProjectCollection, error) {
+	panic("malformed response")
+}
+
+// Panics when looking up one environment.
+type brokenEnvironmentClient struct {
+	*RancherMockClient
+	broken string
+}
+
+func (r brokenEnvironmentClient) GetEnvironment(id string) client.Project {
+	if id == r.broken {
+		panic("malformed environment")
+	}
+	return r.RancherMockClient.GetEnvironment(id)
+}
+
+func TestPanicIsolation(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"},
+		Labels: map[string]interface{}{HOST_VARS_LABEL: 42}})
+	config.rancher.AddStack(client.Stack{Name: "good", AccountId: "1a5", Resource: client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1", "3a2"}})
+	config.rancher.AddStack(client.Stack{Name: "broken", AccountId: "1a5", Resource: client.Resource{Id: "2a2"}})
+	config.rancher.AddService(client.Service{Name: "web", AccountId: "1a5", StackId: "2a1",
+		Resource: client.Resource{Id: "3a1"}, LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{}}})
+	config.rancher.AddService(client.Service{Name: "nolaunch", AccountId: "1a5", StackId: "2a1",
+		Resource: client.Resource{Id: "3a2"}})
+
+	assert.Nil(sync(config))
+
+	// the name template fails for one stack
+	config.stackNameTemplate = template.Must(template.New("stackname").Parse(
+		`{{if eq .RancherStack "broken"}}{{.Missing}}{{end}}{{.RancherEnvironment}}.{{.RancherStack}}`))
+	config.rancher.AddStack(client.Stack{Name: "broken2", AccountId: "1a5", Resource: client.Resource{Id: "2a3"}})
+
+	assert.Nil(sync(config))
+
+	hosts, _ := config.icinga.ListHosts()
+	names := []string{}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	// the host of the broken stack is kept, but not updated
+	assert.ElementsMatch([]string{"agent1", "Default.good", "Default.broken", "Default.broken2"}, names)
+
+	services, _ := config.icinga.ListServices()
+	names = []string{}
+	for _, s := range services {
+		names = append(names, s.HostName+"!"+s.Name)
+		if s.Name == CONFIG_CHECK_NAME {
+			assert.Contains(s.Vars["dummy_text"], "could not sync service Default/good/nolaunch")
+		}
+	}
+	assert.ElementsMatch([]string{"agent1!rancher-agent", "Default.good!web", "Default.good!" + CONFIG_CHECK_NAME},
+		names)
+
+	// looking up the environment of a stack or service panics
+	mock := config.rancher.(*RancherMockClient)
+	config.rancher.AddStack(client.Stack{Name: "elsewhere", AccountId: "1a9", Resource: client.Resource{Id: "2a9"},
+		ServiceIds: []string{"3a9"}})
+	config.rancher.AddService(client.Service{Name: "web", AccountId: "1a9", StackId: "2a9",
+		Resource: client.Resource{Id: "3a9"}, LaunchConfig: &client.LaunchConfig{}})
+	config.rancher = brokenEnvironmentClient{mock, "1a9"}
+	assert.Nil(syncIsolated(config))
+	config.rancher = mock
+
+	// a panic outside of an object ends the sync only
+	icinga := config.icinga
+	config.rancher = panickingRancherClient{config.rancher.(*RancherMockClient)}
+	err := syncIsolated(config)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "malformed response")
+	assert.Equal(icinga, config.icinga)
+
+	assert.Nil(validateFilter("prod,-test!L"))
+	assert.NotNil(validateFilter("prod,my stack"))
+}
+
+// Stops the sync when the hosts are listed for the second time, which is in the phase syncing the hosts.
+type cancelingRancherClient struct {
+	*RancherMockClient
+	cancel func()
+	listed int
+}
+
+func (r *cancelingRancherClient) Hosts() (*client.HostCollection, error) {
+	if r.listed++; r.listed == 2 {
+		r.cancel()
+	}
+	return r.RancherMockClient.Hosts()
+}
+
+func TestCancel(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{Name: "s1", AccountId: "1a5", Resource: client.Resource{Id: "2a1"}})
+	assert.Nil(sync(config))
+
+	config.rancher.DeleteStack("2a1")
+	config.rancher.AddEnvironment(client.Project{Name: "Other", Resource: client.Resource{Id: "1a6"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	config.ctx = ctx
+	config.rancher = &cancelingRancherClient{RancherMockClient: config.rancher.(*RancherMockClient), cancel: cancel}
+	assert.Equal(context.Canceled, sync(config))
+
+	// the phases before are done, the objects after the stop are skipped and nothing is removed
+	hostGroups, _ := config.icinga.ListHostGroups()
+	names := []string{}
+	for _, hg := range hostGroups {
+		names = append(names, hg.Name)
+	}
+	assert.ElementsMatch([]string{"Default", "Other"}, names)
+
+	hosts, _ := config.icinga.ListHosts()
+	names = []string{}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	assert.ElementsMatch([]string{"Default.s1"}, names)
+
+	// a stopped sync does not wait for retries
+	calls := 0
+	r := &retrier{api: "test", retries: 3, backoff: time.Hour, ctx: ctx}
+	err := r.do("fail", func() error {
+		calls++
+		return &apiError{503, "503 Service Unavailable", "busy"}
+	})
+	assert.NotNil(err)
+	assert.Equal(1, calls)
+}
+
+func TestConfigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file, _ := ioutil.TempFile("", "rancher-icinga-config")
+	defer os.Remove(file.Name())
+
+	environment := startEnvironment
+	startEnvironment = append(os.Environ(), "CONFIG_FILE="+file.Name(), "RANCHER_ICINGA_TEST_B=environment")
+	defer func() {
+		startEnvironment = environment
+		loadConfigFile()
+	}()
+
+	ioutil.WriteFile(file.Name(), []byte("# test\nRANCHER_ICINGA_TEST_A=a=1\n\nRANCHER_ICINGA_TEST_B=file\n"), 0644)
+	assert.Nil(loadConfigFile())
+	assert.Equal("a=1", os.Getenv("RANCHER_ICINGA_TEST_A"))
+	assert.Equal("file", os.Getenv("RANCHER_ICINGA_TEST_B"))
+
+	// removed variables are reset on a reload
+	ioutil.WriteFile(file.Name(), []byte("RANCHER_ICINGA_TEST_A=2\n"), 0644)
+	assert.Nil(loadConfigFile())
+	assert.Equal("2", os.Getenv("RANCHER_ICINGA_TEST_A"))
+	assert.Equal("environment", os.Getenv("RANCHER_ICINGA_TEST_B"))
+
+	ioutil.WriteFile(file.Name(), []byte("RANCHER_ICINGA_TEST_A\n"), 0644)
+	assert.NotNil(loadConfigFile())
+}
+
+// Loses the leader lock after a number of acquires.
+type losingLock struct {
+	renewals int
+}
+
+func (l *losingLock) acquire() (bool, error) {
+	l.renewals--
+	return l.renewals >= 0, nil
+}
+
+func (l *losingLock) release() error {
+	return nil
+}
+
+func TestLeaderElection(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	api := NewIcingaMockClient()
+	a := &icingaLock{api: api, host: "rancher-icinga-leader-test", id: "a", installation: "test", lease: time.Minute}
+	b := &icingaLock{api: api, host: "rancher-icinga-leader-test", id: "b", installation: "test", lease: time.Minute}
+
+	leader, err := a.acquire()
+	assert.Nil(err)
+	assert.True(leader)
+	leader, err = b.acquire()
+	assert.Nil(err)
+	assert.False(leader)
+	leader, _ = a.acquire()
+	assert.True(leader)
+
+	// the lock is not removed by a sync
+	config.icinga = api
+	assert.Nil(sync(config))
+	lock, _ := api.GetObject("Host", "rancher-icinga-leader-test", []string{"vars"})
+	assert.NotNil(lock)
+
+	// a standby does not sync
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	config.leaderLock = b
+	assert.Nil(syncAsLeader(config))
+	hosts, _ := api.ListHosts()
+	assert.Len(hosts, 1) // the lock
+
+	// a standby takes over an expired lease
+	api.UpdateObject("Host", "rancher-icinga-leader-test", IcingaAttrs{"vars": a.vars(time.Now().Add(-time.Second))})
+	assert.Nil(syncAsLeader(config))
+	hosts, _ = api.ListHosts()
+	assert.Len(hosts, 2)
+	leader, _ = a.acquire()
+	assert.False(leader)
+
+	// or a released one
+	assert.Nil(b.release())
+	leader, _ = a.acquire()
+	assert.True(leader)
+
+	// a leader losing the lock during a sync abandons it without writing
+	config.rancher.AddHost(client.Host{Hostname: "agent2", AccountId: "1a5", Resource: client.Resource{Id: "1h2"}})
+	config.leaderLock = &losingLock{renewals: 4}
+	assert.EqualError(syncAsLeader(config), "another instance became the leader, abandoning the sync")
+	hosts, _ = api.ListHosts()
+	assert.Len(hosts, 2)
+	config.leaderLock = &losingLock{renewals: 100}
+	assert.Nil(syncAsLeader(config))
+	hosts, _ = api.ListHosts()
+	assert.Len(hosts, 3)
+
+	file, _ := ioutil.TempFile("", "rancher-icinga-leader")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	fa := &fileLock{path: file.Name(), id: "a"}
+	fb := &fileLock{path: file.Name(), id: "b"}
+	leader, err = fa.acquire()
+	assert.Nil(err)
+	assert.True(leader)
+	leader, err = fb.acquire()
+	assert.Nil(err)
+	assert.False(leader)
+	assert.Nil(fa.release())
+	leader, _ = fb.acquire()
+	assert.True(leader)
+	fb.release()
+
+	os.Setenv("LEADER_ELECTION", "file")
+	defer os.Unsetenv("LEADER_ELECTION")
+	assert.NotNil(makeLeaderConfig(config))
+	os.Setenv("LEADER_ELECTION", "consul")
+	assert.NotNil(makeLeaderConfig(config))
+	os.Setenv("LEADER_ELECTION", "icinga")
+	assert.Nil(makeLeaderConfig(config))
+	_, err = newLeaderLock(config, nil)
+	assert.NotNil(err)
+}
+
+func TestStateFile(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+
+	file, _ := ioutil.TempFile("", "rancher-icinga-state")
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+
+	var err error
+	config.state, err = loadState(file.Name(), config.rancherInstallation)
+	assert.Nil(err)
+	config.state.drift = "revert"
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	assert.Nil(sync(config))
+
+	state, err := loadState(file.Name(), config.rancherInstallation)
+	assert.Nil(err)
+	if assert.NotNil(state.Objects["Host"]["agent1"]) {
+		assert.Equal("1h1", state.Objects["Host"]["agent1"].RancherID)
+		assert.Equal("agent1", varsOf(state.Objects["Host"]["agent1"].Attrs)[RANCHER_HOST])
+	}
+	assert.NotNil(state.Objects["HostGroup"]["Default"])
+
+	_, err = loadState(file.Name(), "other")
+	assert.NotNil(err)
+
+	// a var changed by hand is reported and reverted, vars added by templates are not compared
+	objects := map[string]IcingaAttrs{"agent1": mergeAttrs(state.Objects["Host"]["agent1"].Attrs, nil)}
+	objects["agent1"]["vars"] = mergeVars(varsOf(objects["agent1"]), icinga2.Vars{"os": "Linux"})
+	assert.Empty(config.state.drifted("Host", objects))
+	objects["agent1"]["vars"] = mergeVars(varsOf(objects["agent1"]), icinga2.Vars{RANCHER_HOST: "changed"})
+	revert := config.state.drifted("Host", objects)
+	if assert.Contains(revert, "agent1") {
+		assert.Equal("agent1", varsOf(revert["agent1"])[RANCHER_HOST])
+		assert.Equal("Linux", varsOf(revert["agent1"])["os"])
+	}
+
+	// the host was renamed in Rancher
+	config.rancher.AddHost(client.Host{Hostname: "agent2", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	assert.Nil(sync(config))
+	assert.Nil(config.state.Objects["Host"]["agent1"])
+	if assert.NotNil(config.state.Objects["Host"]["agent2"]) {
+		assert.Equal("1h1", config.state.Objects["Host"]["agent2"].RancherID)
+	}
+
+	// the record moves with the Rancher ID
+	recorded := config.state.Objects["Host"]["agent2"]
+	config.state.rancherObject("Host", "agent3", "1h1")
+	assert.Nil(config.state.Objects["Host"]["agent2"])
+	assert.Equal(recorded, config.state.Objects["Host"]["agent3"])
+	config.state.rancherObject("Host", "agent2", "1h1")
+
+	// an empty listing does not create everything again, until it is listed empty in more syncs than allowed; the
+	// leader lock host does not count
+	api := NewIcingaMockClient()
+	api.CreateObject("Host", "rancher-icinga-leader", nil, IcingaAttrs{"vars": icinga2.Vars{
+		RANCHER_INSTALLATION: config.rancherInstallation, RANCHER_OBJECT_TYPE: "leader-lock"}})
+	config.icinga = api
+	config.state.maxEmpty = 2
+	for i := 1; i <= 2; i++ {
+		assert.Nil(sync(config))
+		hosts, _ := api.ListHosts()
+		assert.Len(hosts, 1)
+		state, _ = loadState(file.Name(), config.rancherInstallation)
+		assert.Equal(i, state.EmptyListings["Host"])
+	}
+	assert.Nil(sync(config))
+	hosts, _ := api.ListHosts()
+	assert.Len(hosts, 2)
+	state, _ = loadState(file.Name(), config.rancherInstallation)
+	assert.Empty(state.EmptyListings)
+	assert.NotNil(state.Objects["Host"]["agent2"])
+
+	// the records of the last sync are cleared when reading the file again
+	config.state.rancherObject("Host", "agent3", "1h3")
+	assert.Nil(config.state.load())
+	assert.Empty(config.state.pending)
+}
+
+// Records the writes to a mock client, which can fail a number of times with a status.
+type recordingIcingaClient struct {
+	*IcingaMockClient
+	lock                chan struct{}
+	calls               []string
+	active, maxActive   int
+	failures, failCodes map[string]int
+}
+
+func newRecordingIcingaClient() *recordingIcingaClient {
+	return &recordingIcingaClient{
+		IcingaMockClient: NewIcingaMockClient(),
+		lock:             make(chan struct{}, 1),
+		failures:         map[string]int{},
+		failCodes:        map[string]int{}}
+}
+
+func (c *recordingIcingaClient) ConcurrentWrites() bool {
+	return true
+}
+
+func (c *recordingIcingaClient) record(call string, do func() error) error {
+	c.lock <- struct{}{}
+	c.active++
+	if c.active > c.maxActive {
+		c.maxActive = c.active
+	}
+	<-c.lock
+
+	time.Sleep(5 * time.Millisecond)
+
+	c.lock <- struct{}{}
+	defer func() { <-c.lock }()
+	c.active--
+	c.calls = append(c.calls, call)
+	if c.failures[call] > 0 {
+		c.failures[call]--
+		return &apiError{c.failCodes[call], fmt.Sprintf("%d", c.failCodes[call]), "failed"}
+	}
+	return do()
+}
+
+func (c *recordingIcingaClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	return c.record("create hostgroup "+hg.Name, func() error { return c.IcingaMockClient.CreateHostGroup(hg) })
+}
+
+func (c *recordingIcingaClient) CreateHost(h icinga2.Host) error {
+	return c.record("create host "+h.Name, func() error { return c.IcingaMockClient.CreateHost(h) })
+}
+
+func (c *recordingIcingaClient) DeleteHost(name string) error {
+	return c.record("delete host "+name, func() error { return c.IcingaMockClient.DeleteHost(name) })
+}
+
+func (c *recordingIcingaClient) CreateService(s icinga2.Service) error {
+	return c.record("create service "+s.HostName+"!"+s.Name, func() error { return c.IcingaMockClient.CreateService(s) })
+}
+
+func (c *recordingIcingaClient) DeleteService(name string) error {
+	return c.record("delete service "+name, func() error { return c.IcingaMockClient.DeleteService(name) })
+}
+
+func (c *recordingIcingaClient) index(call string) int {
+	for i, c := range c.calls {
+		if c == call {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestWriteExecutor(t *testing.T) {
+	assert := assert.New(t)
+
+	icinga := newRecordingIcingaClient()
+	icinga.failures["create host h2"], icinga.failCodes["create host h2"] = 1, 400
+	icinga.failures["delete service h4!s"], icinga.failCodes["delete service h4!s"] = 1, 404
+
+	writes := NewIcingaBatchClient(icinga, 3, 0)
+
+	// the results of the writes, reported after the flush
+	made, failed := []string{}, []string{}
+	after := func(call string) {
+		writes.afterWrite(func() { made = append(made, call) }, func() { failed = append(failed, call) })
+	}
+
+	assert.Nil(writes.CreateHostGroup(icinga2.HostGroup{Name: "g"}))
+	for _, h := range []string{"h1", "h2", "h3", "h4"} {
+		assert.Nil(writes.CreateHost(icinga2.Host{Name: h, Groups: []string{"g"}}))
+		after("create host " + h)
+		assert.Nil(writes.CreateService(icinga2.Service{Name: "s", HostName: h}))
+	}
+	assert.Nil(writes.DeleteService("h3!s"))
+	assert.Nil(writes.DeleteHost("h3"))
+	assert.Nil(writes.DeleteHost("h4"))
+	assert.Nil(writes.DeleteService("h4!s"))
+	after("delete service h4!s")
+
+	// nothing is written before the flush
+	assert.Empty(icinga.calls)
+	assert.Empty(made)
+	// the service of h2 fails with its host
+	assert.EqualError(writes.Flush(), "2 of 13 writes failed")
+
+	assert.Equal([]string{"create host h1", "create host h3", "create host h4", "delete service h4!s"}, made)
+	assert.Equal([]string{"create host h2"}, failed)
+
+	assert.True(icinga.maxActive > 1)
+	assert.True(icinga.maxActive <= 3)
+
+	for _, h := range []string{"h1", "h2", "h3", "h4"} {
+		assert.True(icinga.index("create hostgroup g") < icinga.index("create host "+h))
+		assert.True(icinga.index("create host "+h) < icinga.index("create service "+h+"!s"))
+	}
+	assert.True(icinga.index("delete service h3!s") < icinga.index("delete host h3"))
+	assert.True(icinga.index("delete host h4") < icinga.index("delete service h4!s"))
+
+	hosts, _ := icinga.IcingaMockClient.ListHosts()
+	names := []string{}
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	// the failed write of h2 does not stop the others
+	assert.ElementsMatch([]string{"h1"}, names)
+
+	// writes are rate limited
+	writes = NewIcingaBatchClient(icinga, 3, 50)
+	for i := 0; i < 6; i++ {
+		writes.CreateHostGroup(icinga2.HostGroup{Name: fmt.Sprintf("rate%d", i)})
+	}
+	start := time.Now()
+	writes.Flush()
+	assert.True(time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestFailedWritesKeepGroups(t *testing.T) {
+	assert := assert.New(t)
+	config := initForTests()
+	icinga := newRecordingIcingaClient()
+	config.icinga = icinga
+
+	config.labelServiceGroupTemplate = template.Must(template.New("label").Parse("{{.Label}}-{{.Value}}"))
+	config.serviceGroupLabel = "team"
+
+	config.rancher.AddEnvironment(client.Project{Name: "Default", Resource: client.Resource{Id: "1a5"}})
+	config.rancher.AddStack(client.Stack{
+		Name:       "mystack",
+		AccountId:  "1a5",
+		Resource:   client.Resource{Id: "2a1"},
+		ServiceIds: []string{"3a1"}})
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{"team": "frontend"}}})
+
+	assert.Nil(sync(config))
+	groups, _ := icinga.ListObjects("ServiceGroup", []string{"vars"})
+	assert.Contains(groups, "team-frontend")
+
+	// web leaves the group while the new host cannot be created
+
+	config.rancher.AddService(client.Service{
+		Name:         "web",
+		AccountId:    "1a5",
+		Resource:     client.Resource{Id: "3a1"},
+		StackId:      "2a1",
+		LaunchConfig: &client.LaunchConfig{}})
+	config.rancher.AddHost(client.Host{Hostname: "agent1", AccountId: "1a5", Resource: client.Resource{Id: "1h1"}})
+	icinga.failures["create host agent1"], icinga.failCodes["create host agent1"] = 1, 400
+
+	// the rancher-agent service of agent1 fails with its host
+	assert.EqualError(sync(config), "2 of 3 writes failed")
+	groups, _ = icinga.ListObjects("ServiceGroup", []string{"vars"})
+	assert.Contains(groups, "team-frontend", "no group should be removed in a sync with failed writes")
+
+	assert.Nil(sync(config))
+	groups, _ = icinga.ListObjects("ServiceGroup", []string{"vars"})
+	assert.NotContains(groups, "team-frontend")
+}
@@ -0,0 +1,175 @@
+// Retries for the requests to Rancher and Icinga2, so a single timeout or an overloaded server does not abort a
+// sync. Requests that fail with a timeout, a refused or reset connection, a server error or 429 Too Many Requests
+// are retried with an exponential backoff, other errors like 401 Unauthorized or 404 Not Found are returned immediately. The retries
+// are logged and counted in the metrics.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rancher/go-rancher/v2"
+)
+
+// The number of retried requests and of requests that failed after all retries, by API, like
+// {"rancher": 2, "icinga": 0}. Served at /debug/vars if METRICS_LISTEN is set.
+var (
+	retriesMetric  = expvar.NewMap("retries")
+	failuresMetric = expvar.NewMap("retry_failures")
+)
+
+// Retries requests to an API. A nil retrier makes every request once.
+type retrier struct {
+	api     string // for the logs and metrics, like "rancher"
+	retries int
+	backoff time.Duration   // before the first retry, doubled for every further one
+	ctx     context.Context // stops retrying when canceled, can be nil
+}
+
+// Reads the timeouts and retries from the environment.
+func makeRetryConfig(cc *RancherIcingaConfig) (err error) {
+	cc.rancherTimeout, cc.icingaTimeout = 10*time.Second, 10*time.Second
+	cc.rancherRetries, cc.icingaRetries = 3, 3
+	cc.retryBackoff = time.Second
+
+	for env, d := range map[string]*time.Duration{
+		"RANCHER_TIMEOUT": &cc.rancherTimeout,
+		"ICINGA_TIMEOUT":  &cc.icingaTimeout,
+		"RETRY_BACKOFF":   &cc.retryBackoff,
+	} {
+		if c := os.Getenv(env); c != "" {
+			if *d, err = time.ParseDuration(c); err != nil {
+				return fmt.Errorf("error parsing %s: %s", env, err)
+			}
+		}
+	}
+
+	for env, n := range map[string]*int{
+		"RANCHER_RETRIES": &cc.rancherRetries,
+		"ICINGA_RETRIES":  &cc.icingaRetries,
+	} {
+		if c := os.Getenv(env); c != "" {
+			if *n, err = strconv.Atoi(c); err != nil || *n < 0 {
+				return fmt.Errorf("error parsing %s: %q is not a number", env, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Makes the requests of an HTTP client with a context, so a stopped sync cancels a running request instead of
+// waiting for its timeout.
+type contextTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// Cancels the requests of an HTTP client with the context.
+func withContext(c *http.Client, ctx context.Context) {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.Transport = &contextTransport{base: base, ctx: ctx}
+}
+
+// The request timed out, the server is restarting, overloaded or asks to slow down.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *apiError:
+		return e.statusCode >= 500 || e.statusCode == 429
+	case *client.ApiError:
+		return e.StatusCode >= 500 || e.StatusCode == 429
+	case net.Error:
+		return e.Timeout() || isConnectionError(err)
+	}
+	return false
+}
+
+// The connection to the server could not be made or was reset, like while it restarts. The HTTP clients wrap
+// these errors in a *url.Error.
+func isConnectionError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			if e.Op == "dial" {
+				return true
+			}
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET
+		default:
+			return false
+		}
+	}
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.statusCode == 404
+}
+
+// Makes a request, retrying it with a backoff if it fails with a retryable error. The request is described like
+// "list rancher hosts" for the logs.
+func (r *retrier) do(request string, call func() error) error {
+	if r == nil {
+		return call()
+	}
+
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= r.retries {
+			failuresMetric.Add(r.api, 1)
+			fmt.Printf("WARNING: giving up to %s after %d retries: %s\n", request, attempt, err)
+			return err
+		}
+
+		if r.ctx != nil && r.ctx.Err() != nil {
+			return err
+		}
+
+		retriesMetric.Add(r.api, 1)
+		fmt.Printf("WARNING: could not %s, retrying in %s: %s\n", request, backoff, err)
+		if !r.sleep(backoff) {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// Waits before a retry. Returns false if the context was canceled.
+func (r *retrier) sleep(d time.Duration) bool {
+	if r == nil || r.ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,217 @@
+// Icinga2 service groups for stacks, label values and the installation, so dashboards and notification rules
+// can use them without maintaining assign rules. Each kind of group is enabled by setting its name template.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"text/template"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"github.com/rancher/go-rancher/v2"
+)
+
+// The values available in service group and host group name templates.
+type GroupParameters struct {
+	RancherCheckParameters
+	RancherInstallation string
+	Label               string
+	Value               string
+}
+
+// Parses the service group templates from the environment. A template that is not set disables that kind
+// of service group.
+func makeServiceGroupTemplates(cc *RancherIcingaConfig) (err error) {
+	for env, t := range map[string]**template.Template{
+		"STACK_SERVICEGROUP_TEMPLATE":        &cc.stackServiceGroupTemplate,
+		"LABEL_SERVICEGROUP_TEMPLATE":        &cc.labelServiceGroupTemplate,
+		"INSTALLATION_SERVICEGROUP_TEMPLATE": &cc.installationServiceGroupTemplate,
+	} {
+		if c := os.Getenv(env); c != "" {
+			if *t, err = template.New(env).Parse(c); err != nil {
+				return fmt.Errorf("Failed to parse %s: %q", env, err.Error())
+			}
+		}
+	}
+
+	cc.serviceGroupLabel = os.Getenv("SERVICEGROUP_LABEL")
+	if cc.serviceGroupLabel != "" && cc.labelServiceGroupTemplate == nil {
+		cc.labelServiceGroupTemplate = template.Must(template.New("labelservicegroup").Parse("{{.Value}}"))
+	}
+
+	return nil
+}
+
+// The name of a service group or host group. Errors are logged and result in an empty name.
+func expandGroupTemplate(t *template.Template, params GroupParameters) string {
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, params); err != nil {
+		fmt.Printf("ERROR: could not expand group template %s: %s\n", t.Name(), err)
+		return ""
+	}
+	return buffer.String()
+}
+
+// Generates the vars for a service group
+func varsForServiceGroup(config *RancherIcingaConfig) icinga2.Vars {
+	return icinga2.Vars{
+		RANCHER_INSTALLATION: config.rancherInstallation,
+		RANCHER_OBJECT_TYPE:  "servicegroup"}
+}
+
+// The sorted service groups of a Rancher service. The label value is taken from the service's labels, or else
+// from the labels of its stack configuration.
+func serviceGroupsOf(config *RancherIcingaConfig, service client.Service, environment, stack string) []string {
+	params := GroupParameters{
+		RancherCheckParameters: RancherCheckParameters{
+			RancherEnvironment: environment,
+			RancherStack:       stack,
+			RancherService:     service.Name},
+		RancherInstallation: config.rancherInstallation,
+		Label:               config.serviceGroupLabel}
+
+	groups := []string{}
+	add := func(t *template.Template) {
+		if name := expandGroupTemplate(t, params); name != "" && !containsStrings(groups, []string{name}) {
+			groups = append(groups, name)
+		}
+	}
+
+	if config.installationServiceGroupTemplate != nil {
+		add(config.installationServiceGroupTemplate)
+	}
+	if config.stackServiceGroupTemplate != nil {
+		add(config.stackServiceGroupTemplate)
+	}
+	if config.serviceGroupLabel != "" {
+		if v, ok := service.LaunchConfig.Labels[config.serviceGroupLabel].(string); ok && v != "" {
+			params.Value = v
+		} else {
+			sc, _ := stackConfigOf(config.rancher, config.rancher.GetStack(service.StackId))
+			params.Value = sc.Labels[config.serviceGroupLabel]
+		}
+		if params.Value != "" {
+			add(config.labelServiceGroupTemplate)
+		}
+	}
+
+	sort.Strings(groups)
+	return groups
+}
+
+// All service groups of the Rancher services, sorted.
+func rancherServiceGroups(config *RancherIcingaConfig) ([]string, error) {
+	rancherServices, err := config.rancher.Services()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rancher services: %s", err)
+	}
+
+	found := make(map[string]bool)
+	for _, rs := range rancherServices.Data {
+		isolateService(config, rs, func() {
+			if !filterService(config.rancher, rs, config.filterServices) ||
+				!filterStack(config.rancher, config.rancher.GetStack(rs.StackId), config.filterStacks) ||
+				!filterEnvironment(config.rancher, config.rancher.GetEnvironment(rs.AccountId), config.filterEnvironments) {
+				return
+			}
+
+			stackName := config.rancher.GetStack(rs.StackId).Name
+			environmentName := config.rancher.GetEnvironment(rs.AccountId).Name
+
+			for _, g := range serviceGroupsOf(config, rs, environmentName, stackName) {
+				found[g] = true
+			}
+		})
+	}
+
+	groups := make([]string, 0, len(found))
+	for g := range found {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+// Creates the service groups needed by the Rancher services. This runs before the services are synced, so
+// the groups exist when services are added to them.
+func syncRancherServiceGroups(config *RancherIcingaConfig) error {
+	groups, err := rancherServiceGroups(config)
+	if err != nil {
+		return err
+	}
+
+	icingaGroups, err := config.icinga.ListObjects("ServiceGroup", []string{"vars"})
+	if err != nil {
+		return fmt.Errorf("error listing icinga service groups: %s", err)
+	}
+
+	for _, name := range groups {
+		if _, ok := icingaGroups[name]; ok {
+			continue
+		}
+
+		vars := varsForServiceGroup(config)
+		debugLog("Creating service group "+name, 1)
+		err := config.icinga.CreateObject("ServiceGroup", name, nil, IcingaAttrs{"vars": vars})
+		if err != nil {
+			fmt.Printf("ERROR: could not create service group %s: %s\n", name, err)
+		} else {
+			config.registerChange("create", name, "servicegroup", vars, name)
+		}
+	}
+
+	return nil
+}
+
+// Removes the service groups that are not used anymore. This runs after the services are synced, so the
+// groups have no members left when they are deleted.
+func syncIcingaServiceGroups(config *RancherIcingaConfig) error {
+	groups, err := rancherServiceGroups(config)
+	if err != nil {
+		return err
+	}
+
+	icingaGroups, err := config.icinga.ListObjects("ServiceGroup", []string{"vars"})
+	if err != nil {
+		return fmt.Errorf("error listing icinga service groups: %s", err)
+	}
+
+	for name, attrs := range icingaGroups {
+		if !config.matches(varsOf(attrs), "servicegroup", "", "", "") ||
+			containsStrings(groups, []string{name}) || config.objectsFailed() {
+			continue
+		}
+
+		debugLog("Deleting service group "+name, 1)
+		err := config.icinga.DeleteObject("ServiceGroup", name)
+		if err != nil {
+			fmt.Printf("ERROR: could not delete service group %s: %s\n", name, err)
+		} else {
+			config.registerChange("delete", name, "servicegroup", icinga2.Vars{}, name)
+		}
+	}
+
+	return nil
+}
+
+// Sets the service groups of the Icinga2 service for a Rancher service.
+func syncServiceGroupMembership(config *RancherIcingaConfig, serviceAttrs map[string]IcingaAttrs, name string, groups []string) {
+	current := stringList(serviceAttrs[name]["groups"])
+	sort.Strings(current)
+
+	if equalStrings(current, groups) {
+		return
+	}
+
+	debugLog("Updating service "+name+" with groups", 1)
+	err := config.icinga.UpdateObject("Service", name, IcingaAttrs{"groups": groups})
+	if err != nil {
+		fmt.Printf("ERROR: could not update service %s: %s\n", name, err)
+	} else {
+		config.registerChange("update", name, "service", icinga2.Vars{}, groups)
+	}
+}
@@ -0,0 +1,198 @@
+// Stack level configuration. Rancher stacks do not support labels, so the configuration for the Icinga2 host
+// representing a stack is collected from several places with a fixed precedence.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rancher/go-rancher/v2"
+	"gopkg.in/yaml.v2"
+)
+
+type StackConfig struct {
+	NotesURL     string                 `yaml:"notes_url,omitempty"`
+	Vars         map[string]interface{} `yaml:"vars,omitempty"`
+	Labels       map[string]string      `yaml:"labels,omitempty"`
+	Templates    []string               `yaml:"templates,omitempty"`
+	CustomChecks []CustomCheck          `yaml:"custom_checks,omitempty"`
+}
+
+// A stack configuration and where it was found, used for reporting conflicts.
+type stackConfigSource struct {
+	origin string
+	config StackConfig
+}
+
+// Collects the configuration for a stack. The sources are, in order of precedence:
+//
+// 1. the .icinga section of the stack's rancher-compose.yml
+// 2. the icinga section of the stack's description, if the description is YAML
+// 3. the icinga.stack_config label on the stack's services
+// 4. the icinga.stack_vars and icinga.stack_notes_url labels on the stack's services
+//
+// Services are considered in the order of their names. If two sources set the same value differently,
+// the one with the higher precedence wins and a warning is returned. During a sync, the configuration is collected
+// once per stack.
+func stackConfigOf(rancher RancherGenClient, stack client.Stack) (StackConfig, []string) {
+	if r, ok := rancher.(*RancherSyncClient); ok {
+		return r.stackConfig(stack)
+	}
+	return collectStackConfig(rancher, stack)
+}
+
+func collectStackConfig(rancher RancherGenClient, stack client.Stack) (sc StackConfig, warnings []string) {
+	sources := []stackConfigSource{}
+
+	if stack.RancherCompose != "" {
+		var compose struct {
+			Icinga *StackConfig `yaml:".icinga"`
+		}
+		if err := yaml.Unmarshal([]byte(stack.RancherCompose), &compose); err != nil {
+			warnings = append(warnings, fmt.Sprintf("could not parse rancher-compose.yml: %s", err))
+		} else if compose.Icinga != nil {
+			sources = append(sources, stackConfigSource{"rancher-compose.yml", *compose.Icinga})
+		}
+	}
+
+	if stack.Description != "" {
+		var description struct {
+			Icinga *StackConfig `yaml:"icinga"`
+		}
+		// Most descriptions are just text, so only complain if this was meant to be a configuration.
+		if err := yaml.Unmarshal([]byte(stack.Description), &description); err != nil {
+			if strings.Contains(stack.Description, "icinga:") {
+				warnings = append(warnings, fmt.Sprintf("could not parse stack description: %s", err))
+			}
+		} else if description.Icinga != nil {
+			sources = append(sources, stackConfigSource{"stack description", *description.Icinga})
+		}
+	}
+
+	services := make([]client.Service, 0, len(stack.ServiceIds))
+	for _, id := range stack.ServiceIds {
+		services = append(services, rancher.GetService(id))
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	for _, service := range services {
+		if service.LaunchConfig == nil {
+			continue
+		}
+		if l, ok := service.LaunchConfig.Labels[STACK_CONFIG_LABEL].(string); ok && l != "" {
+			var c StackConfig
+			if err := yaml.Unmarshal([]byte(l), &c); err != nil {
+				warnings = append(warnings, fmt.Sprintf("could not parse label %s on service %s: %s",
+					STACK_CONFIG_LABEL, service.Name, err))
+			} else {
+				sources = append(sources, stackConfigSource{STACK_CONFIG_LABEL + " on service " + service.Name, c})
+			}
+		}
+	}
+
+	for _, service := range services {
+		if service.LaunchConfig == nil {
+			continue
+		}
+		c := StackConfig{}
+		if l, ok := service.LaunchConfig.Labels[STACK_NOTES_URL_LABEL].(string); ok {
+			c.NotesURL = l
+		}
+		if l, ok := service.LaunchConfig.Labels[STACK_VARS_LABEL].(string); ok && l != "" {
+			vars, err := unpackVars(l)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("could not parse label %s on service %s: %s",
+					STACK_VARS_LABEL, service.Name, err))
+			}
+			c.Vars = vars
+		}
+		if c.NotesURL != "" || len(c.Vars) > 0 {
+			sources = append(sources, stackConfigSource{"legacy labels on service " + service.Name, c})
+		}
+	}
+
+	sc, conflicts := mergeStackConfigs(sources)
+	warnings = append(warnings, conflicts...)
+
+	return
+}
+
+// Merges stack configurations, the first source has the highest precedence.
+func mergeStackConfigs(sources []stackConfigSource) (sc StackConfig, warnings []string) {
+	sc.Vars = make(map[string]interface{})
+	sc.Labels = make(map[string]string)
+	sc.CustomChecks = []CustomCheck{}
+
+	notesURLOrigin := ""
+	templatesOrigin := ""
+	varOrigins := make(map[string]string)
+	labelOrigins := make(map[string]string)
+	checkOrigins := make(map[string]string)
+
+	for _, src := range sources {
+		if src.config.NotesURL != "" {
+			if notesURLOrigin == "" {
+				sc.NotesURL = src.config.NotesURL
+				notesURLOrigin = src.origin
+			} else if sc.NotesURL != src.config.NotesURL {
+				warnings = append(warnings, fmt.Sprintf("notes_url from %s is overridden by %s",
+					src.origin, notesURLOrigin))
+			}
+		}
+
+		if len(src.config.Templates) > 0 {
+			if templatesOrigin == "" {
+				sc.Templates = src.config.Templates
+				templatesOrigin = src.origin
+			} else if !equalStrings(sc.Templates, src.config.Templates) {
+				warnings = append(warnings, fmt.Sprintf("templates from %s are overridden by %s",
+					src.origin, templatesOrigin))
+			}
+		}
+
+		for k, v := range src.config.Vars {
+			v = normalizeValue(v)
+			if origin, ok := varOrigins[k]; !ok {
+				sc.Vars[k] = v
+				varOrigins[k] = src.origin
+			} else if !varEqual(sc.Vars[k], v) {
+				warnings = append(warnings, fmt.Sprintf("var %s from %s is overridden by %s", k, src.origin, origin))
+			}
+		}
+
+		for k, v := range src.config.Labels {
+			if origin, ok := labelOrigins[k]; !ok {
+				sc.Labels[k] = v
+				labelOrigins[k] = src.origin
+			} else if sc.Labels[k] != v {
+				warnings = append(warnings, fmt.Sprintf("label %s from %s is overridden by %s", k, src.origin, origin))
+			}
+		}
+
+		for _, check := range src.config.CustomChecks {
+			if origin, ok := checkOrigins[check.Name]; !ok {
+				sc.CustomChecks = append(sc.CustomChecks, check)
+				checkOrigins[check.Name] = src.origin
+			} else {
+				for _, c := range sc.CustomChecks {
+					if c.Name == check.Name && !reflect.DeepEqual(c, check) {
+						warnings = append(warnings, fmt.Sprintf("custom check %s from %s is overridden by %s",
+							check.Name, src.origin, origin))
+					}
+				}
+			}
+		}
+	}
+
+	// See parseCustomChecks.
+	for _, check := range sc.CustomChecks {
+		for k, v := range check.Vars {
+			check.Vars[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	return
+}
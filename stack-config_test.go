@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStackConfigPrecedence(t *testing.T) {
+
+	assert := assert.New(t)
+	rancher := NewRancherMockClient()
+
+	rancher.AddService(client.Service{
+		Name:     "service1",
+		Resource: client.Resource{Id: "3a1"},
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.stack_config": "notes_url: http://label\nvars:\n  var2: label2\n  var3: label3\n  var4: label4"}}})
+	rancher.AddService(client.Service{
+		Name:     "service2",
+		Resource: client.Resource{Id: "3a2"},
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.stack_vars": "var4=legacy4,var5=legacy5"}}})
+
+	stack := client.Stack{
+		Name:           "mystack",
+		ServiceIds:     []string{"3a1", "3a2"},
+		RancherCompose: ".icinga:\n  vars:\n    var1: compose1\n",
+		Description:    "icinga:\n  notes_url: http://description\n  vars:\n    var1: description1\n    var2: description2\n"}
+
+	sc, warnings := stackConfigOf(rancher, stack)
+
+	assert.Equal("http://description", sc.NotesURL)
+	assert.Equal("compose1", sc.Vars["var1"])
+	assert.Equal("description2", sc.Vars["var2"])
+	assert.Equal("label3", sc.Vars["var3"])
+	assert.Equal("label4", sc.Vars["var4"])
+	assert.Equal("legacy5", sc.Vars["var5"])
+
+	// var1, var2, var4 and the notes url conflict
+	assert.Equal(4, len(warnings), "every conflict should be reported")
+}
+
+func TestStackConfigConflictingServices(t *testing.T) {
+
+	assert := assert.New(t)
+	rancher := NewRancherMockClient()
+
+	rancher.AddService(client.Service{
+		Name:     "b-service",
+		Resource: client.Resource{Id: "3a1"},
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.stack_vars":      "var1=b",
+			"icinga.stack_notes_url": "http://b"}}})
+	rancher.AddService(client.Service{
+		Name:     "a-service",
+		Resource: client.Resource{Id: "3a2"},
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.stack_vars":      "var1=a",
+			"icinga.stack_notes_url": "http://a"}}})
+
+	// The order of the services in the stack must not matter
+	for _, ids := range [][]string{{"3a1", "3a2"}, {"3a2", "3a1"}} {
+		sc, warnings := stackConfigOf(rancher, client.Stack{Name: "mystack", ServiceIds: ids})
+
+		assert.Equal("a", sc.Vars["var1"], "the service whose name sorts first should win")
+		assert.Equal("http://a", sc.NotesURL, "the service whose name sorts first should win")
+		assert.Equal(2, len(warnings))
+	}
+}
+
+func TestStackConfigDescription(t *testing.T) {
+
+	assert := assert.New(t)
+	rancher := NewRancherMockClient()
+
+	sc, warnings := stackConfigOf(rancher, client.Stack{Name: "mystack", Description: "Just a stack: nothing to see"})
+
+	assert.Empty(sc.Vars)
+	assert.Empty(warnings, "plain text descriptions are not an error")
+
+	sc, warnings = stackConfigOf(rancher, client.Stack{Name: "mystack", Description: "icinga:\n  vars: [broken"})
+
+	assert.Empty(sc.Vars)
+	assert.Equal(1, len(warnings), "a broken configuration in the description should be reported")
+}
+
+// Counts the services fetched from Rancher.
+type countingRancherClient struct {
+	*RancherMockClient
+	serviceGets int
+}
+
+func (r *countingRancherClient) GetService(id string) client.Service {
+	r.serviceGets++
+	return r.RancherMockClient.GetService(id)
+}
+
+func TestStackConfigOncePerSync(t *testing.T) {
+
+	assert := assert.New(t)
+	rancher := &countingRancherClient{RancherMockClient: NewRancherMockClient()}
+
+	rancher.AddService(client.Service{
+		Name:     "service1",
+		Resource: client.Resource{Id: "3a1"},
+		LaunchConfig: &client.LaunchConfig{Labels: map[string]interface{}{
+			"icinga.stack_vars": "var1=label1"}}})
+	stack := client.Stack{Name: "mystack", Resource: client.Resource{Id: "2a1"}, ServiceIds: []string{"3a1"}}
+
+	syncClient := NewRancherSyncClient(rancher)
+	for i := 0; i < 3; i++ {
+		sc, _ := stackConfigOf(syncClient, stack)
+		assert.Equal("label1", sc.Vars["var1"])
+	}
+	assert.Equal(1, rancher.serviceGets)
+
+	// a new sync collects it again
+	stackConfigOf(NewRancherSyncClient(rancher), stack)
+	assert.Equal(2, rancher.serviceGets)
+}
@@ -0,0 +1,478 @@
+// An optional record of the Icinga2 hosts, services and host groups rancher-icinga manages, kept in STATE_FILE
+// between syncs, with the attributes last written to Icinga2 and the ID of the Rancher host, stack or service.
+//
+// When a type is first listed in a sync, the objects are compared with the record: attributes changed by hand in
+// Icinga2 are reported or, with STATE_DRIFT=revert, written again. Objects of a type of which objects are recorded
+// are neither created nor deleted in a sync listing none of them, so a temporarily empty listing does not recreate
+// everything, until STATE_EMPTY_LISTINGS syncs in a row listed none. The record of an object whose Rancher ID moves
+// to another name moves with it.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+type syncState struct {
+	path     string
+	drift    string // "report" or "revert"
+	maxEmpty int    // the syncs in a row listing no objects of a recorded type before they are created again
+	lock     gosync.Mutex
+
+	// the Rancher IDs seen in the current sync for objects that are not written yet, by type and name
+	pending map[string]map[string]string
+
+	Installation string                             `json:"installation"`
+	Objects      map[string]map[string]*stateObject `json:"objects"`
+	// the syncs in a row that listed no objects of a recorded type, by type
+	EmptyListings map[string]int `json:"empty_listings,omitempty"`
+	// when the objects with a downtime were first seen in their state, by downtime key
+	Downtimes map[string]time.Time `json:"downtimes,omitempty"`
+}
+
+type stateObject struct {
+	RancherID string      `json:"rancher_id,omitempty"`
+	Attrs     IcingaAttrs `json:"attrs"`
+}
+
+// Records the successful writes to a client in the state. Used below the IcingaBatchClient, which makes the
+// writes at the end of the sync.
+type IcingaStateClient struct {
+	IcingaGenClient
+	state *syncState
+}
+
+// Reads the state settings from the environment and loads STATE_FILE, if it exists.
+func makeStateConfig(cc *RancherIcingaConfig) error {
+	path := os.Getenv("STATE_FILE")
+	if path == "" {
+		return nil
+	}
+
+	drift := os.Getenv("STATE_DRIFT")
+	switch drift {
+	case "":
+		drift = "report"
+	case "report", "revert":
+	default:
+		return fmt.Errorf("error parsing STATE_DRIFT: %q is neither report nor revert", drift)
+	}
+
+	maxEmpty := 3
+	if c := os.Getenv("STATE_EMPTY_LISTINGS"); c != "" {
+		var err error
+		if maxEmpty, err = strconv.Atoi(c); err != nil || maxEmpty < 0 {
+			return fmt.Errorf("error parsing STATE_EMPTY_LISTINGS: %q is not a number", c)
+		}
+	}
+
+	state, err := loadState(path, cc.rancherInstallation)
+	if err != nil {
+		return err
+	}
+	state.drift = drift
+	state.maxEmpty = maxEmpty
+	cc.state = state
+	return nil
+}
+
+func loadState(path, installation string) (*syncState, error) {
+	state := &syncState{
+		path:         path,
+		maxEmpty:     3,
+		Installation: installation}
+
+	if err := state.load(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Reads STATE_FILE again. With leader election, another instance may have synced since it was read.
+func (s *syncState) load() error {
+	installation := s.Installation
+	s.pending = make(map[string]map[string]string)
+	s.Objects, s.EmptyListings, s.Downtimes = make(map[string]map[string]*stateObject), nil, nil
+
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading STATE_FILE: %s", err)
+	}
+	if err := json.Unmarshal(content, s); err != nil {
+		return fmt.Errorf("error parsing STATE_FILE: %s", err)
+	}
+	if s.Installation != installation {
+		other := s.Installation
+		s.Installation, s.Objects, s.Downtimes = installation, make(map[string]map[string]*stateObject), nil
+		return fmt.Errorf("STATE_FILE %s belongs to installation %s", s.path, other)
+	}
+	if s.Objects == nil {
+		s.Objects = make(map[string]map[string]*stateObject)
+	}
+	return nil
+}
+
+// Writes the state to STATE_FILE, replacing it only once it is written completely.
+func (s *syncState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path)
+}
+
+// Records the Rancher ID of the host, stack or service an Icinga2 object is synced from. An object with the ID
+// under another name was renamed in Rancher, its record moves to the new name.
+func (s *syncState) rancherObject(typ, name, id string) {
+	if s == nil || id == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for other, o := range s.Objects[typ] {
+		if other != name && o.RancherID == id {
+			fmt.Printf("%s %s was renamed to %s in Rancher\n", strings.ToLower(typ), other, name)
+			if _, ok := s.Objects[typ][name]; !ok {
+				s.Objects[typ][name] = o
+			}
+			delete(s.Objects[typ], other)
+		}
+	}
+
+	if o, ok := s.Objects[typ][name]; ok {
+		o.RancherID = id
+		return
+	}
+	if s.pending[typ] == nil {
+		s.pending[typ] = make(map[string]string)
+	}
+	s.pending[typ][name] = id
+}
+
+// Records the attributes written to an object. A created object replaces the record, only objects of the
+// installation are recorded.
+func (s *syncState) written(typ, name string, attrs IcingaAttrs, create bool) {
+	if _, ok := ownedAttrs[typ]; !ok {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o, ok := s.Objects[typ][name]
+	if create {
+		if varsOf(attrs)[RANCHER_INSTALLATION] != s.Installation {
+			return
+		}
+		id, found := s.pending[typ][name]
+		if !found && ok {
+			id = o.RancherID
+		}
+		delete(s.pending[typ], name)
+
+		o = &stateObject{RancherID: id, Attrs: make(IcingaAttrs)}
+		if s.Objects[typ] == nil {
+			s.Objects[typ] = make(map[string]*stateObject)
+		}
+		s.Objects[typ][name] = o
+	} else if !ok {
+		return
+	}
+
+	for k, v := range attrs {
+		if k != "templates" && containsStrings(ownedAttrs[typ], []string{k}) {
+			o.Attrs[k] = normalizeJSON(v)
+		}
+	}
+}
+
+// Forgets a deleted object. Deleting a host also deletes its services.
+func (s *syncState) deleted(typ, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.Objects[typ], name)
+	if typ == "Host" {
+		for service := range s.Objects["Service"] {
+			if strings.HasPrefix(service, name+"!") {
+				delete(s.Objects["Service"], service)
+			}
+		}
+	}
+}
+
+// Whether Icinga2 lists no objects of a type of which objects are recorded, as after an Icinga2 restart, so the
+// objects of the type are neither created nor deleted in this sync. After maxEmpty syncs in a row, the records of
+// the type are dropped and its objects are synced again.
+func (s *syncState) emptyListing(typ string, objects map[string]IcingaAttrs) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the leader lock host has the installation var, but is not synced
+	listed := 0
+	for _, attrs := range objects {
+		if varsOf(attrs)[RANCHER_OBJECT_TYPE] != "leader-lock" {
+			listed++
+		}
+	}
+	if listed > 0 || len(s.Objects[typ]) == 0 {
+		delete(s.EmptyListings, typ)
+		return false
+	}
+
+	if s.EmptyListings == nil {
+		s.EmptyListings = make(map[string]int)
+	}
+	s.EmptyListings[typ]++
+	if s.EmptyListings[typ] > s.maxEmpty {
+		fmt.Printf("WARNING: icinga2 listed no %s objects of installation %s in %d syncs, creating them again\n",
+			strings.ToLower(typ), s.Installation, s.EmptyListings[typ])
+		delete(s.Objects, typ)
+		delete(s.EmptyListings, typ)
+		return false
+	}
+
+	fmt.Printf("WARNING: icinga2 lists no %s objects of installation %s, but %d are recorded in STATE_FILE; "+
+		"not creating or deleting them in this sync (%d of %d)\n", strings.ToLower(typ), s.Installation,
+		len(s.Objects[typ]), s.EmptyListings[typ], s.maxEmpty)
+	return true
+}
+
+// Compares the listed objects of a type with the record and reports the objects changed or deleted in Icinga2.
+// Returns the recorded attributes of the changed objects, to revert them. Vars and lists are compared by the
+// recorded entries only, as templates can add others.
+func (s *syncState) drifted(typ string, objects map[string]IcingaAttrs) map[string]IcingaAttrs {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	revert := make(map[string]IcingaAttrs)
+	for name, o := range s.Objects[typ] {
+		live, ok := objects[name]
+		if !ok {
+			fmt.Printf("WARNING: %s %s was deleted in Icinga2\n", strings.ToLower(typ), name)
+			continue
+		}
+
+		changed := make(IcingaAttrs)
+		for k, v := range o.Attrs {
+			if lv, ok := live[k]; ok && !covers(v, normalizeJSON(lv)) {
+				changed[k] = v
+				if vars, ok := v.(map[string]interface{}); ok && k == "vars" {
+					// the vars are written as a whole
+					changed[k] = mergeVars(varsOf(live), icinga2.Vars(vars))
+				}
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+
+		names := changed.names()
+		sort.Strings(names)
+		fmt.Printf("WARNING: %s %s was changed in Icinga2: %s\n", strings.ToLower(typ), name, strings.Join(names, ", "))
+		if s.drift == "revert" {
+			revert[name] = changed
+		}
+	}
+	return revert
+}
+
+// A value as read from JSON, to compare the recorded and listed attributes.
+func normalizeJSON(v interface{}) (n interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	json.Unmarshal(b, &n)
+	return
+}
+
+// Whether a listed value has a recorded value. Maps need the recorded keys and lists the recorded elements.
+func covers(recorded, live interface{}) bool {
+	switch r := recorded.(type) {
+	case map[string]interface{}:
+		l, _ := live.(map[string]interface{})
+		for k, v := range r {
+			if !covers(v, l[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, _ := live.([]interface{})
+		for _, v := range r {
+			found := false
+			for _, lv := range l {
+				if reflect.DeepEqual(v, lv) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case nil, string:
+		if r == nil || r == "" {
+			return live == nil || live == "" || reflect.DeepEqual(live, []interface{}{}) ||
+				reflect.DeepEqual(live, map[string]interface{}{})
+		}
+	}
+	return reflect.DeepEqual(recorded, live)
+}
+
+// ---------
+
+func NewIcingaStateClient(icinga IcingaGenClient, state *syncState) *IcingaStateClient {
+	return &IcingaStateClient{IcingaGenClient: icinga, state: state}
+}
+
+func (c *IcingaStateClient) ConcurrentWrites() bool {
+	w, ok := c.IcingaGenClient.(concurrentWriter)
+	return ok && w.ConcurrentWrites()
+}
+
+func (c *IcingaStateClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	err := c.IcingaGenClient.CreateObject(typ, name, templates, attrs)
+	if err == nil {
+		c.state.written(typ, name, attrs, true)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	err := c.IcingaGenClient.UpdateObject(typ, name, attrs)
+	if err == nil {
+		c.state.written(typ, name, attrs, false)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) DeleteObject(typ, name string) error {
+	err := c.IcingaGenClient.DeleteObject(typ, name)
+	if err == nil || isNotFound(err) {
+		c.state.deleted(typ, name)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) CreateHost(h icinga2.Host) error {
+	err := c.IcingaGenClient.CreateHost(h)
+	if err == nil {
+		c.state.written("Host", h.Name, attrsForHost(h), true)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) DeleteHost(name string) error {
+	err := c.IcingaGenClient.DeleteHost(name)
+	if err == nil || isNotFound(err) {
+		c.state.deleted("Host", name)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) UpdateHost(h icinga2.Host) error {
+	err := c.IcingaGenClient.UpdateHost(h)
+	if err == nil {
+		c.state.written("Host", h.Name, IcingaAttrs{
+			"address":       h.Address,
+			"check_command": h.CheckCommand,
+			"notes_url":     h.NotesURL,
+			"groups":        h.Groups,
+			"vars":          h.Vars}, false)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	err := c.IcingaGenClient.CreateHostGroup(hg)
+	if err == nil {
+		c.state.written("HostGroup", hg.Name, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars}, true)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) DeleteHostGroup(name string) error {
+	err := c.IcingaGenClient.DeleteHostGroup(name)
+	if err == nil || isNotFound(err) {
+		c.state.deleted("HostGroup", name)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	err := c.IcingaGenClient.UpdateHostGroup(hg)
+	if err == nil {
+		c.state.written("HostGroup", hg.Name, IcingaAttrs{"display_name": hg.DisplayName, "vars": hg.Vars}, false)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) CreateService(s icinga2.Service) error {
+	err := c.IcingaGenClient.CreateService(s)
+	if err == nil {
+		c.state.written("Service", s.HostName+"!"+s.Name, attrsForService(s), true)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) DeleteService(name string) error {
+	err := c.IcingaGenClient.DeleteService(name)
+	if err == nil || isNotFound(err) {
+		c.state.deleted("Service", name)
+	}
+	return err
+}
+
+func (c *IcingaStateClient) UpdateService(s icinga2.Service) error {
+	err := c.IcingaGenClient.UpdateService(s)
+	if err == nil {
+		c.state.written("Service", s.HostName+"!"+s.Name, IcingaAttrs{
+			"check_command": s.CheckCommand,
+			"notes_url":     s.NotesURL,
+			"vars":          s.Vars}, false)
+	}
+	return err
+}
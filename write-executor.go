@@ -0,0 +1,359 @@
+// Writes to Icinga2 are queued during a sync and made at its end, concurrently where the order does not matter:
+// host groups before the hosts and services, a host before its services and dependencies, and the services and
+// dependencies of a host before the host is deleted. The requests are rate limited, the clients retry them when
+// Icinga2 is overloaded or does not answer.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+)
+
+// Implemented by clients that can make writes concurrently.
+type concurrentWriter interface {
+	ConcurrentWrites() bool
+}
+
+// Implemented by clients queuing the writes.
+type writeQueue interface {
+	// Calls ok once the last queued write was made, or failed if it failed.
+	afterWrite(ok, failed func())
+}
+
+// A queued write.
+type icingaWrite struct {
+	description string // like "create host agent1"
+	delete      bool
+	do          func() error
+	err         error
+
+	// called in the order of the queue after the writes are made
+	ok     []func()
+	failed []func()
+
+	// the writes that must be made before this one
+	after []*icingaWrite
+	done  chan struct{}
+}
+
+// Queues the writes to a client until Flush or Commit. Queuing a write always succeeds, errors are reported when
+// they are made, to the callbacks registered with afterWrite and by Flush.
+type IcingaBatchClient struct {
+	IcingaGenClient
+	concurrency int
+	limiter     *rateLimiter
+
+	queue []*icingaWrite
+	// the last write of each object, and the writes depending on an object since
+	lastWrite map[string]*icingaWrite
+	readers   map[string][]*icingaWrite
+}
+
+// Spaces requests to a number per second. The channel holds the time of the next request.
+type rateLimiter struct {
+	interval time.Duration
+	next     chan time.Time
+}
+
+// Reads the configuration of the writes from the environment.
+func makeWriteConfig(cc *RancherIcingaConfig) (err error) {
+	cc.writeConcurrency = 4
+
+	if c := os.Getenv("ICINGA_WRITE_CONCURRENCY"); c != "" {
+		if cc.writeConcurrency, err = strconv.Atoi(c); err != nil || cc.writeConcurrency < 1 {
+			return fmt.Errorf("error parsing ICINGA_WRITE_CONCURRENCY: %q is not a positive number", c)
+		}
+	}
+	if c := os.Getenv("ICINGA_WRITE_RATE"); c != "" {
+		if cc.writeRate, err = strconv.ParseFloat(c, 64); err != nil || cc.writeRate < 0 {
+			return fmt.Errorf("error parsing ICINGA_WRITE_RATE: %q is not a number of requests per second", c)
+		}
+	}
+
+	return nil
+}
+
+func NewIcingaBatchClient(icinga IcingaGenClient, concurrency int, rate float64) *IcingaBatchClient {
+	if c, ok := icinga.(concurrentWriter); !ok || !c.ConcurrentWrites() {
+		concurrency = 1
+	}
+	return &IcingaBatchClient{
+		IcingaGenClient: icinga,
+		concurrency:     concurrency,
+		limiter:         newRateLimiter(rate),
+		lastWrite:       make(map[string]*icingaWrite),
+		readers:         make(map[string][]*icingaWrite)}
+}
+
+// No limit if the rate is 0.
+func newRateLimiter(rate float64) *rateLimiter {
+	l := &rateLimiter{next: make(chan time.Time, 1)}
+	if rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / rate)
+	}
+	l.next <- time.Now()
+	return l
+}
+
+func (l *rateLimiter) wait() {
+	if l.interval == 0 {
+		return
+	}
+
+	next := <-l.next
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	l.next <- next.Add(l.interval)
+
+	time.Sleep(next.Sub(now))
+}
+
+// The objects a write changes and the objects it depends on. Groups and writes of other types are ordered with
+// everything else.
+func writeObjects(typ, name string, attrs IcingaAttrs) (writes, reads []string) {
+	switch typ {
+	case "Host":
+		return []string{"Host!" + name}, []string{"*"}
+	case "Service":
+		return []string{"Service!" + name}, []string{"*", "Host!" + hostOfName(name)}
+	case "Dependency":
+		reads = []string{"*", "Host!" + hostOfName(name)}
+		if parent := stringAttr(attrs, "parent_host_name"); parent != "" {
+			reads = append(reads, "Host!"+parent, "Service!"+parent+"!"+stringAttr(attrs, "parent_service_name"))
+		}
+		return []string{"Dependency!" + name}, reads
+	}
+	return []string{"*"}, nil
+}
+
+// The host of a service or dependency name like "host!service".
+func hostOfName(name string) string {
+	if n := strings.Index(name, "!"); n >= 0 {
+		return name[:n]
+	}
+	return name
+}
+
+// Queues a write after the writes it depends on.
+func (c *IcingaBatchClient) enqueue(description string, writes, reads []string, do func() error) {
+	w := &icingaWrite{description: description, do: do, done: make(chan struct{})}
+	w.delete = strings.HasPrefix(description, "delete ")
+
+	for _, o := range append(writes, reads...) {
+		if last, ok := c.lastWrite[o]; ok {
+			w.after = append(w.after, last)
+		}
+	}
+	for _, o := range writes {
+		w.after = append(w.after, c.readers[o]...)
+		c.lastWrite[o] = w
+		delete(c.readers, o)
+	}
+	for _, o := range reads {
+		c.readers[o] = append(c.readers[o], w)
+	}
+
+	c.queue = append(c.queue, w)
+}
+
+// Makes a write. Deleting an object that does not exist, like the services of a deleted host, is no error.
+func (c *IcingaBatchClient) execute(w *icingaWrite) {
+	c.limiter.wait()
+
+	if err := w.do(); err != nil && !(w.delete && isNotFound(err)) {
+		fmt.Printf("ERROR: could not %s: %s\n", w.description, err)
+		w.err = err
+	}
+}
+
+// Registers the callbacks for the last queued write. They are called at once if nothing is queued.
+func (c *IcingaBatchClient) afterWrite(ok, failed func()) {
+	if len(c.queue) == 0 {
+		ok()
+		return
+	}
+	w := c.queue[len(c.queue)-1]
+	w.ok = append(w.ok, ok)
+	w.failed = append(w.failed, failed)
+}
+
+// Makes the queued writes and returns an error if any failed. Without concurrency, they are made in the order
+// they were queued.
+func (c *IcingaBatchClient) Flush() error {
+	queue := c.queue
+	c.queue = nil
+	c.lastWrite = make(map[string]*icingaWrite)
+	c.readers = make(map[string][]*icingaWrite)
+
+	if len(queue) > 0 {
+		debugLog(fmt.Sprintf("Making %d writes", len(queue)), 1)
+	}
+
+	if c.concurrency <= 1 {
+		for _, w := range queue {
+			c.execute(w)
+		}
+	} else {
+		c.executeConcurrently(queue)
+	}
+
+	failed := 0
+	for _, w := range queue {
+		callbacks := w.ok
+		if w.err != nil {
+			failed++
+			callbacks = w.failed
+		}
+		for _, f := range callbacks {
+			f()
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d writes failed", failed, len(queue))
+	}
+	return nil
+}
+
+// Makes each write once the writes it depends on are made.
+func (c *IcingaBatchClient) executeConcurrently(queue []*icingaWrite) {
+	running := make(chan struct{}, c.concurrency)
+	for _, w := range queue {
+		go func(w *icingaWrite) {
+			defer close(w.done)
+			for _, a := range w.after {
+				<-a.done
+			}
+			running <- struct{}{}
+			c.execute(w)
+			<-running
+		}(w)
+	}
+	for _, w := range queue {
+		<-w.done
+	}
+}
+
+// The writes that were made are committed also if others failed.
+func (c *IcingaBatchClient) Commit() error {
+	failed := c.Flush()
+	if err := c.IcingaGenClient.Commit(); err != nil {
+		return err
+	}
+	return failed
+}
+
+// ---------
+
+func (c *IcingaBatchClient) CreateObject(typ, name string, templates []string, attrs IcingaAttrs) error {
+	writes, reads := writeObjects(typ, name, attrs)
+	c.enqueue("create "+strings.ToLower(typ)+" "+name, writes, reads, func() error {
+		return c.IcingaGenClient.CreateObject(typ, name, templates, attrs)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) UpdateObject(typ, name string, attrs IcingaAttrs) error {
+	writes, reads := writeObjects(typ, name, attrs)
+	c.enqueue("update "+strings.ToLower(typ)+" "+name, writes, reads, func() error {
+		return c.IcingaGenClient.UpdateObject(typ, name, attrs)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) DeleteObject(typ, name string) error {
+	writes, reads := writeObjects(typ, name, nil)
+	c.enqueue("delete "+strings.ToLower(typ)+" "+name, writes, reads, func() error {
+		return c.IcingaGenClient.DeleteObject(typ, name)
+	})
+	return nil
+}
+
+// Actions for a host or service are made after the writes of the host or service.
+func (c *IcingaBatchClient) PerformAction(action string, params IcingaAttrs) error {
+	writes, reads := []string{"*"}, []string(nil)
+	object := ""
+	if s := stringAttr(params, "service"); s != "" {
+		object = s
+		writes, reads = nil, []string{"*", "Service!" + s, "Host!" + hostOfName(s)}
+	} else if h := stringAttr(params, "host"); h != "" {
+		object = h
+		writes, reads = nil, []string{"*", "Host!" + h}
+	}
+
+	c.enqueue("perform "+action+" for "+object, writes, reads, func() error {
+		return c.IcingaGenClient.PerformAction(action, params)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) CreateHost(h icinga2.Host) error {
+	writes, reads := writeObjects("Host", h.Name, nil)
+	c.enqueue("create host "+h.Name, writes, reads, func() error { return c.IcingaGenClient.CreateHost(h) })
+	return nil
+}
+
+func (c *IcingaBatchClient) DeleteHost(name string) error {
+	writes, reads := writeObjects("Host", name, nil)
+	c.enqueue("delete host "+name, writes, reads, func() error { return c.IcingaGenClient.DeleteHost(name) })
+	return nil
+}
+
+func (c *IcingaBatchClient) UpdateHost(h icinga2.Host) error {
+	writes, reads := writeObjects("Host", h.Name, nil)
+	c.enqueue("update host "+h.Name, writes, reads, func() error { return c.IcingaGenClient.UpdateHost(h) })
+	return nil
+}
+
+func (c *IcingaBatchClient) CreateHostGroup(hg icinga2.HostGroup) error {
+	writes, reads := writeObjects("HostGroup", hg.Name, nil)
+	c.enqueue("create hostgroup "+hg.Name, writes, reads, func() error {
+		return c.IcingaGenClient.CreateHostGroup(hg)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) DeleteHostGroup(name string) error {
+	writes, reads := writeObjects("HostGroup", name, nil)
+	c.enqueue("delete hostgroup "+name, writes, reads, func() error {
+		return c.IcingaGenClient.DeleteHostGroup(name)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) UpdateHostGroup(hg icinga2.HostGroup) error {
+	writes, reads := writeObjects("HostGroup", hg.Name, nil)
+	c.enqueue("update hostgroup "+hg.Name, writes, reads, func() error {
+		return c.IcingaGenClient.UpdateHostGroup(hg)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) CreateService(s icinga2.Service) error {
+	writes, reads := writeObjects("Service", s.HostName+"!"+s.Name, nil)
+	c.enqueue("create service "+s.HostName+"!"+s.Name, writes, reads, func() error {
+		return c.IcingaGenClient.CreateService(s)
+	})
+	return nil
+}
+
+func (c *IcingaBatchClient) DeleteService(name string) error {
+	writes, reads := writeObjects("Service", name, nil)
+	c.enqueue("delete service "+name, writes, reads, func() error { return c.IcingaGenClient.DeleteService(name) })
+	return nil
+}
+
+func (c *IcingaBatchClient) UpdateService(s icinga2.Service) error {
+	writes, reads := writeObjects("Service", s.HostName+"!"+s.Name, nil)
+	c.enqueue("update service "+s.HostName+"!"+s.Name, writes, reads, func() error {
+		return c.IcingaGenClient.UpdateService(s)
+	})
+	return nil
+}
@@ -0,0 +1,124 @@
+// Icinga2 zones for distributed setups: the generated hosts and their services are put into the zone of the
+// satellites that should check them, chosen by rules on the environment name or the labels. Checks for agent
+// hosts run on the Icinga2 agent of the node if there is one.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Nexinto/go-icinga2-client/icinga2"
+	"github.com/gobwas/glob"
+)
+
+// A rule that puts the objects of an environment or with a label into a zone.
+type zoneRule struct {
+	zone        string
+	environment glob.Glob // if set, the environment name must match
+	label       string    // if set, the value of this label must match value
+	value       glob.Glob
+}
+
+// Reads the zone configuration from the environment. The rules are a comma separated list like
+// "satellite-fra=env:prod-fra*,satellite-ber=label:datacenter=ber".
+func makeZoneConfig(cc *RancherIcingaConfig) error {
+	cc.icingaZone = os.Getenv("ICINGA_ZONE")
+
+	c := os.Getenv("ICINGA_ZONE_RULES")
+	if c == "" {
+		return nil
+	}
+
+	for _, r := range strings.Split(c, ",") {
+		kv := strings.SplitN(r, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("error parsing ICINGA_ZONE_RULES: %q is not ZONE=SELECTOR", r)
+		}
+		rule := zoneRule{zone: kv[0]}
+
+		var err error
+		switch {
+		case strings.HasPrefix(kv[1], "env:"):
+			rule.environment, err = glob.Compile(strings.TrimPrefix(kv[1], "env:"))
+		case strings.HasPrefix(kv[1], "label:"):
+			lv := strings.SplitN(strings.TrimPrefix(kv[1], "label:"), "=", 2)
+			if len(lv) != 2 || lv[0] == "" {
+				return fmt.Errorf("error parsing ICINGA_ZONE_RULES: %q is not label:LABEL=VALUE", kv[1])
+			}
+			rule.label = lv[0]
+			rule.value, err = glob.Compile(lv[1])
+		default:
+			return fmt.Errorf("error parsing ICINGA_ZONE_RULES: %q does not start with env: or label:", kv[1])
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing ICINGA_ZONE_RULES: %s", err)
+		}
+
+		cc.zoneRules = append(cc.zoneRules, rule)
+	}
+
+	return nil
+}
+
+// The zone for a host in an environment with the labels: the zone of the first matching rule, or ICINGA_ZONE.
+// The services of a host are in the zone of the host.
+func zoneOf(config *RancherIcingaConfig, environment string, labels map[string]interface{}) string {
+	for _, r := range config.zoneRules {
+		if r.environment != nil && r.environment.Match(environment) {
+			return r.zone
+		}
+		if r.label != "" {
+			if v, ok := labels[r.label].(string); ok && r.value.Match(v) {
+				return r.zone
+			}
+		}
+	}
+	return config.icingaZone
+}
+
+// The endpoint of the Icinga2 agent on a Rancher host, which is named like the host, or "" if there is none.
+func agentEndpoint(config *RancherIcingaConfig, hostname string) string {
+	endpoints, ok := listObjectsOnce(config, "Endpoint")
+	if !ok {
+		return ""
+	}
+	if _, ok := endpoints[hostname]; !ok {
+		return ""
+	}
+	return hostname
+}
+
+// Sets the zone and command endpoint of custom checks that do not configure their own.
+func checksInZone(checks []CustomCheck, zone, endpoint string) []CustomCheck {
+	res := make([]CustomCheck, len(checks))
+	for i, check := range checks {
+		if check.Zone == "" {
+			check.Zone = zone
+		}
+		if check.CommandEndpoint == "" {
+			check.CommandEndpoint = endpoint
+		}
+		res[i] = check
+	}
+	return res
+}
+
+// Icinga2 cannot move an object to another zone, so an object in another zone than configured is deleted and then
+// created again. Objects are only moved if a zone is configured. Returns true if the object was deleted.
+func recreateForZone(config *RancherIcingaConfig, typ, name string, attrs IcingaAttrs, zone string) bool {
+	if current, _ := attrs["zone"].(string); zone == "" || current == zone {
+		return false
+	}
+
+	debugLog("Recreating "+typ+" "+name+" in zone "+zone, 1)
+	err := config.icinga.DeleteObject(typ, name)
+	if err != nil {
+		fmt.Printf("ERROR: could not delete %s %s: %s\n", strings.ToLower(typ), name, err)
+		return false
+	}
+	config.registerChange("delete", name, strings.ToLower(typ), icinga2.Vars{}, attrs)
+
+	return true
+}